@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/controller/models"
+	"github.com/ICKelin/cframe/pkg/etcdstorage"
+)
+
+func addACL(ns string, rule *codec.ACLRule, store *etcdstorage.Etcd) {
+	aclMgr := models.NewACLManager(store)
+	err := aclMgr.VerifyRule(rule)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	err = aclMgr.AddRule(ns, rule)
+	if err != nil {
+		fmt.Printf("add acl %s ret: %v", rule.Name, err)
+		return
+	}
+	fmt.Printf("add acl %s OK\n", rule.Name)
+}
+
+func delACL(ns, name string, store *etcdstorage.Etcd) {
+	aclMgr := models.NewACLManager(store)
+	err := aclMgr.DelRule(ns, name)
+	if err != nil {
+		fmt.Printf("del acl %s ret: %v", name, err)
+		return
+	}
+	fmt.Printf("del acl %s OK\n", name)
+}
+
+func listACLs(ns string, store *etcdstorage.Etcd) {
+	aclMgr := models.NewACLManager(store)
+	rules := aclMgr.GetRules(ns)
+
+	anyOf := func(s string) string {
+		if len(s) == 0 {
+			return "any"
+		}
+		return s
+	}
+
+	fmt.Printf("\nacls for %s namespace\n", ns)
+	fmt.Printf("      %-15s %-8s %-10s %-5s %-20s %-12s %-20s %-12s %-6s\n",
+		"Name", "Priority", "Edge", "Proto", "Src", "SrcPorts", "Dst", "DstPorts", "Action")
+	fmt.Println("------------------------------------------------------------------------------------------------------------------")
+	for i, r := range rules {
+		edge := r.Edge
+		if len(edge) == 0 {
+			edge = "all"
+		}
+
+		fmt.Printf("%-5d %-15s %-8d %-10s %-5s %-20s %-12s %-20s %-12s %-6s\n", i+1,
+			r.Name, r.Priority, edge, anyOf(r.Proto),
+			anyOf(r.Src), anyOf(r.SrcPorts), anyOf(r.Dst), anyOf(r.DstPorts), r.Action)
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ICKelin/cframe/pkg/pki"
+)
+
+func createCA(certFile, keyFile string) {
+	certPEM, keyPEM, err := pki.GenerateCA("cframe ca")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	err = writeCert(certFile, keyFile, certPEM, keyPEM)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("create ca %s %s OK\n", certFile, keyFile)
+}
+
+func issueServerCert(caCert, caKey string, hosts []string, certFile, keyFile string) {
+	caCertPEM, caKeyPEM, err := readCA(caCert, caKey)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	certPEM, keyPEM, err := pki.IssueServerCert(caCertPEM, caKeyPEM, hosts)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	err = writeCert(certFile, keyFile, certPEM, keyPEM)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	pin, _ := pki.PinFromPEM(certPEM)
+	fmt.Printf("issue controller certificate %s %s OK\n", certFile, keyFile)
+	fmt.Printf("pin: %s\n", pin)
+}
+
+func issueEdgeCert(caCert, caKey, ns, name, certFile, keyFile string) {
+	caCertPEM, caKeyPEM, err := readCA(caCert, caKey)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	certPEM, keyPEM, err := pki.IssueEdgeCert(caCertPEM, caKeyPEM, ns, name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	err = writeCert(certFile, keyFile, certPEM, keyPEM)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("issue edge %s/%s certificate %s %s OK\n", ns, name, certFile, keyFile)
+}
+
+func readCA(caCert, caKey string) ([]byte, []byte, error) {
+	certPEM, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func writeCert(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	err := ioutil.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, keyPEM, 0600)
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	cli "github.com/urfave/cli/v2"
 )
@@ -33,10 +34,18 @@ func main() {
 							Name:     "name",
 							Required: true,
 						},
+						&cli.StringFlag{
+							Name:  "transport",
+							Usage: "transport of edges without scheme in listener, udp/tcp/kcp/quic",
+						},
+						&cli.StringFlag{
+							Name:  "compress",
+							Usage: "compression of packets between edges, lz4/zstd",
+						},
 					},
 					Action: func(ctx *cli.Context) error {
 						name := ctx.String("name")
-						addNamespace(name, store)
+						addNamespace(name, ctx.String("transport"), ctx.String("compress"), store)
 						return nil
 					},
 				},
@@ -48,9 +57,13 @@ func main() {
 							Name:     "name",
 							Required: true,
 						},
+						&cli.BoolFlag{
+							Name:  "force",
+							Usage: "delete edges, routes, acls and rate limits of the namespace as well",
+						},
 					},
 					Action: func(ctx *cli.Context) error {
-						delNamespace(ctx.String("name"), store)
+						delNamespace(ctx.String("name"), ctx.Bool("force"), store)
 						return nil
 					},
 				},
@@ -62,6 +75,20 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:  "rollkey",
+					Usage: "roll data key of namespace and push it to online edges",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "name",
+							Required: true,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						rollKey(ctx.String("name"), store)
+						return nil
+					},
+				},
 			},
 		},
 		{
@@ -84,12 +111,20 @@ func main() {
 						&cli.StringFlag{
 							Name:     "listener",
 							Required: true,
-							Usage:    "edge listener, eg: 1.2.3.4:58423",
+							Usage:    "edge listener, eg: 1.2.3.4:58423 or [2001:db8::1]:58423",
 						},
 						&cli.StringFlag{
 							Name:     "cidr",
 							Required: true,
-							Usage:    "eg: 172.18.0.0/16",
+							Usage:    "eg: 172.18.0.0/16 or 2001:db8::/64",
+						},
+						&cli.StringFlag{
+							Name:  "fec",
+							Usage: "reed-solomon fec of udp packets sent to the edge in data:parity shards, eg: 10:3",
+						},
+						&cli.BoolFlag{
+							Name:  "force",
+							Usage: "add edge even if its cidr conflicts with other edges or routes",
 						},
 					},
 					Action: func(ctx *cli.Context) error {
@@ -98,7 +133,7 @@ func main() {
 						listen := ctx.String("listener")
 						cidr := ctx.String("cidr")
 
-						addEdge(ns, edgeName, listen, cidr, store)
+						addEdge(ns, edgeName, listen, cidr, ctx.String("fec"), ctx.Bool("force"), store)
 						return nil
 					},
 				},
@@ -137,6 +172,30 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:  "stats",
+					Usage: "show edge reports, latest report of each edge if name is empty",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Value:   "default",
+						},
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "edge name",
+						},
+						&cli.IntFlag{
+							Name:  "history",
+							Usage: "count of latest reports of the edge, 0 for all",
+							Value: 10,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						edgeStats(ctx.String("ns"), ctx.String("name"), ctx.Int("history"), store)
+						return nil
+					},
+				},
 			},
 		},
 		{
@@ -154,9 +213,9 @@ func main() {
 							Usage:   "namespace",
 							Value:   "default",
 						},
-						&cli.StringFlag{
+						&cli.StringSliceFlag{
 							Name:     "listener",
-							Usage:    "edge listener",
+							Usage:    "edge listener as nexthop, repeat for redundant nexthops, eg: 1.2.3.4:58423@10, lower priority is preferred",
 							Required: true,
 						},
 						&cli.StringFlag{
@@ -169,13 +228,21 @@ func main() {
 							Usage:    "dst cidr block",
 							Required: true,
 						},
+						&cli.BoolFlag{
+							Name:  "ecmp",
+							Usage: "hash flows across nexthops of the same priority",
+						},
+						&cli.BoolFlag{
+							Name:  "force",
+							Usage: "add route even if it conflicts with edges or other routes",
+						},
 					},
 					Action: func(ctx *cli.Context) error {
 						ns := ctx.String("namespace")
 						name := ctx.String("name")
-						listener := ctx.String("listener")
+						listeners := ctx.StringSlice("listener")
 						cidr := ctx.String("cidr")
-						addRoute(ns, name, listener, cidr, store)
+						addRoute(ns, name, listeners, cidr, ctx.Bool("ecmp"), ctx.Bool("force"), store)
 						return nil
 					},
 				},
@@ -218,6 +285,298 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "acl",
+			Usage: "manage acl rules enforced by edges",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "add",
+					Usage: "add or replace an acl rule",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Usage:   "namespace",
+							Value:   "default",
+						},
+						&cli.StringFlag{
+							Name:     "name",
+							Usage:    "rule name",
+							Required: true,
+						},
+						&cli.IntFlag{
+							Name:  "priority",
+							Usage: "rules are matched in priority order, the lower first",
+						},
+						&cli.StringFlag{
+							Name:  "edge",
+							Usage: "edge name enforcing the rule, all edges if empty",
+						},
+						&cli.StringFlag{
+							Name:  "src",
+							Usage: "src cidr, any if empty",
+						},
+						&cli.StringFlag{
+							Name:  "dst",
+							Usage: "dst cidr, any if empty",
+						},
+						&cli.StringFlag{
+							Name:  "proto",
+							Usage: "tcp, udp or icmp, any if empty",
+						},
+						&cli.StringFlag{
+							Name:  "src-ports",
+							Usage: "src port ranges, eg: 22,80,8000-9000",
+						},
+						&cli.StringFlag{
+							Name:  "dst-ports",
+							Usage: "dst port ranges, eg: 22,80,8000-9000",
+						},
+						&cli.StringFlag{
+							Name:     "action",
+							Usage:    "allow or deny",
+							Required: true,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						addACL(ctx.String("namespace"), &codec.ACLRule{
+							Name:     ctx.String("name"),
+							Priority: ctx.Int("priority"),
+							Edge:     ctx.String("edge"),
+							Src:      ctx.String("src"),
+							Dst:      ctx.String("dst"),
+							Proto:    ctx.String("proto"),
+							SrcPorts: ctx.String("src-ports"),
+							DstPorts: ctx.String("dst-ports"),
+							Action:   ctx.String("action"),
+						}, store)
+						return nil
+					},
+				},
+				{
+					Name:  "del",
+					Usage: "del an acl rule",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Usage:   "namespace",
+							Value:   "default",
+						},
+						&cli.StringFlag{
+							Name:     "name",
+							Usage:    "rule name",
+							Required: true,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						delACL(ctx.String("namespace"), ctx.String("name"), store)
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list namespace acl rules",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Usage:   "namespace",
+							Value:   "default",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						listACLs(ctx.String("namespace"), store)
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "ratelimit",
+			Usage: "manage rate limits enforced by edges",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "add",
+					Usage: "add or replace a rate limit",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Usage:   "namespace",
+							Value:   "default",
+						},
+						&cli.StringFlag{
+							Name:     "name",
+							Usage:    "rate limit name",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  "edge",
+							Usage: "edge name enforcing the limit, all edges if empty",
+						},
+						&cli.StringFlag{
+							Name:  "peer",
+							Usage: "peer edge name, any peer if empty",
+						},
+						&cli.StringFlag{
+							Name:  "dst",
+							Usage: "dst cidr, any if empty",
+						},
+						&cli.StringFlag{
+							Name:     "rate",
+							Usage:    "bits per second, eg: 800k, 100m, 1g",
+							Required: true,
+						},
+						&cli.Int64Flag{
+							Name:  "burst",
+							Usage: "burst in bytes, traffic of 100ms at rate if empty",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						addRateLimit(ctx.String("namespace"), ctx.String("rate"), &codec.RateLimit{
+							Name:  ctx.String("name"),
+							Edge:  ctx.String("edge"),
+							Peer:  ctx.String("peer"),
+							Dst:   ctx.String("dst"),
+							Burst: ctx.Int64("burst"),
+						}, store)
+						return nil
+					},
+				},
+				{
+					Name:  "del",
+					Usage: "del a rate limit",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Usage:   "namespace",
+							Value:   "default",
+						},
+						&cli.StringFlag{
+							Name:     "name",
+							Usage:    "rate limit name",
+							Required: true,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						delRateLimit(ctx.String("namespace"), ctx.String("name"), store)
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list namespace rate limits",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Usage:   "namespace",
+							Value:   "default",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						listRateLimits(ctx.String("namespace"), store)
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "cert",
+			Usage: "manage certificates of controller and edges",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "ca",
+					Usage: "create ca for controller and edges",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "ca-cert",
+							Value: "ca.crt",
+						},
+						&cli.StringFlag{
+							Name:  "ca-key",
+							Value: "ca.key",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						createCA(ctx.String("ca-cert"), ctx.String("ca-key"))
+						return nil
+					},
+				},
+				{
+					Name:  "controller",
+					Usage: "issue controller certificate",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "ca-cert",
+							Value: "ca.crt",
+						},
+						&cli.StringFlag{
+							Name:  "ca-key",
+							Value: "ca.key",
+						},
+						&cli.StringSliceFlag{
+							Name:     "host",
+							Usage:    "controller ip or domain, eg: 1.2.3.4",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  "cert",
+							Value: "controller.crt",
+						},
+						&cli.StringFlag{
+							Name:  "key",
+							Value: "controller.key",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						issueServerCert(ctx.String("ca-cert"), ctx.String("ca-key"),
+							ctx.StringSlice("host"), ctx.String("cert"), ctx.String("key"))
+						return nil
+					},
+				},
+				{
+					Name:  "edge",
+					Usage: "issue edge certificate",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "ca-cert",
+							Value: "ca.crt",
+						},
+						&cli.StringFlag{
+							Name:  "ca-key",
+							Value: "ca.key",
+						},
+						&cli.StringFlag{
+							Name:    "namespace",
+							Aliases: []string{"ns"},
+							Value:   "default",
+						},
+						&cli.StringFlag{
+							Name:     "name",
+							Usage:    "edge name",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:  "cert",
+							Value: "edge.crt",
+						},
+						&cli.StringFlag{
+							Name:  "key",
+							Value: "edge.key",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						issueEdgeCert(ctx.String("ca-cert"), ctx.String("ca-key"),
+							ctx.String("namespace"), ctx.String("name"),
+							ctx.String("cert"), ctx.String("key"))
+						return nil
+					},
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
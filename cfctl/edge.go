@@ -2,25 +2,48 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/controller/models"
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
 )
 
-func addEdge(ns, edgeName, listenAddr, cidr string, store *etcdstorage.Etcd) {
-	edgeMgr := models.NewEdgeManager(store)
-	edgeMgr.AddEdge(ns, &codec.Edge{
+func addEdge(ns, edgeName, listenAddr, cidr, fec string, force bool, store *etcdstorage.Etcd) {
+	fecConfig, err := codec.ParseFEC(fec)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	edge := &codec.Edge{
 		Name:       edgeName,
 		Cidr:       cidr,
 		ListenAddr: listenAddr,
-	})
+		FEC:        fecConfig,
+	}
+
+	edgeMgr := models.NewEdgeManager(store)
+	routeMgr := models.NewRouteManager(store)
+	err = edgeMgr.VerifyEdge(ns, edge, routeMgr.GetRoutes(ns), force)
+	if err != nil {
+		printVerifyError(err)
+		return
+	}
+
+	err = edgeMgr.AddEdge(ns, edge)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("create edge %s cidr %s OK\n", listenAddr, cidr)
 }
 
 func delEdge(ns, edgeName string, store *etcdstorage.Etcd) {
 	edgeMgr := models.NewEdgeManager(store)
 	edgeMgr.DelEdge(ns, edgeName)
+	models.NewReportManager(store).DelReports(ns, edgeName)
 	fmt.Printf("delete edge %s OK\n", edgeName)
 }
 
@@ -29,9 +52,74 @@ func listEdges(ns string, store *etcdstorage.Etcd) {
 	edges := edgeMgr.GetEdges(ns)
 
 	fmt.Println("edge list:")
-	fmt.Printf("      %-15s %-25s %-15s\n", "Name", "Listener", "CIDR")
-	fmt.Println("-----------------------------------------------------------")
+	fmt.Printf("      %-15s %-25s %-20s %-6s\n", "Name", "Listener", "CIDR", "FEC")
+	fmt.Println("--------------------------------------------------------------------------")
 	for i, edge := range edges {
-		fmt.Printf("%-5d %-15s %-25s %-15s\n", i+1, edge.Name, edge.ListenAddr, edge.Cidr)
+		fec := edge.FEC.String()
+		if len(fec) == 0 {
+			fec = "-"
+		}
+		fmt.Printf("%-5d %-15s %-25s %-20s %-6s\n", i+1, edge.Name, edge.ListenAddr, edge.Cidr, fec)
+	}
+}
+
+func edgeStats(ns, edgeName string, history int, store *etcdstorage.Etcd) {
+	reportMgr := models.NewReportManager(store)
+
+	var reports []*models.EdgeReport
+	if len(edgeName) > 0 {
+		reports = reportMgr.GetReports(ns, edgeName, history)
+	} else {
+		names := make([]string, 0)
+		for _, edge := range models.NewEdgeManager(store).GetEdges(ns) {
+			names = append(names, edge.Name)
+		}
+		reports = reportMgr.GetLatestReports(ns, names)
+	}
+
+	fmt.Println("edge stats:")
+	fmt.Printf("      %-15s %-20s %-5s %-5s %-15s %-15s %-4s %-6s\n",
+		"Name", "Time", "CPU", "Mem", "TrafficIn", "TrafficOut", "Key", "Status")
+	fmt.Println("----------------------------------------------------------------------------------------------")
+	for i, r := range reports {
+		status := "ok"
+		if r.HasError() {
+			status = "error"
+		}
+
+		fmt.Printf("%-5d %-15s %-20s %-5d %-5d %-15d %-15d %-4d %-6s\n",
+			i+1, r.Name, time.Unix(r.Timestamp, 0).Format("2006-01-02 15:04:05"),
+			r.CPU, r.Mem, r.TrafficIn, r.TrafficOut, r.KeyID, status)
+		for _, e := range r.Error {
+			fmt.Printf("      error: %s\n", e)
+		}
+		if r.FECRecovered+r.FECLost > 0 {
+			fmt.Printf("      fec: recovered %d lost %d\n", r.FECRecovered, r.FECLost)
+		}
+		if r.CompressOut > 0 {
+			fmt.Printf("      compress: %d => %d bytes ratio %.2f\n",
+				r.CompressIn, r.CompressOut, float64(r.CompressIn)/float64(r.CompressOut))
+		}
+		for _, l := range r.RateLimits {
+			fmt.Printf("      ratelimit: %s rate %s sent %d bytes %d packets dropped %d\n",
+				l.Name, codec.FormatRate(l.Rate), l.Bytes, l.Packets, l.Dropped)
+		}
+		for _, p := range r.Peers {
+			fmt.Printf("      peer: %s path %s rtt %.2fms loss %.0f%% cidrs %s\n",
+				p.ListenAddr, p.Path, p.RTT, p.Loss*100, strings.Join(p.Cidrs, ","))
+		}
+	}
+}
+
+func printVerifyError(err error) {
+	conflictErr, ok := err.(*models.ConflictError)
+	if !ok {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println("conflict found, use --force to ignore:")
+	for _, c := range conflictErr.Conflicts {
+		fmt.Printf("      %s\n", c)
 	}
 }
@@ -1,21 +1,32 @@
 package main
 
 import (
-	"encoding/base64"
+	"errors"
 	"fmt"
 
+	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/controller/models"
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
-	uuid "github.com/satori/go.uuid"
 )
 
-func addNamespace(name string, store *etcdstorage.Etcd) {
-	uniq := uuid.NewV4()
-	secret := base64.StdEncoding.EncodeToString(uniq.Bytes())
+func addNamespace(name, transport, compress string, store *etcdstorage.Etcd) {
+	if len(transport) > 0 && !codec.IsTransport(transport) {
+		fmt.Printf("unsupported transport %s\n", transport)
+		return
+	}
+
+	if len(compress) > 0 && !codec.IsCompress(compress) {
+		fmt.Printf("unsupported compress %s\n", compress)
+		return
+	}
+
+	secret := models.GenerateSecret()
 	namespaceMgr := models.NewNamespaceManager(store)
 	err := namespaceMgr.AddNamespace(&models.Namespace{
-		Name:   name,
-		Secret: secret,
+		Name:      name,
+		Secret:    secret,
+		Transport: transport,
+		Compress:  compress,
 	})
 	if err != nil {
 		fmt.Println(err)
@@ -30,9 +41,14 @@ func addNamespace(name string, store *etcdstorage.Etcd) {
 	fmt.Printf("create namespace %s, secret %s OK\n", nsInfo.Name, nsInfo.Secret)
 }
 
-func delNamespace(name string, store *etcdstorage.Etcd) {
+func delNamespace(name string, force bool, store *etcdstorage.Etcd) {
 	namespaceMgr := models.NewNamespaceManager(store)
-	err := namespaceMgr.DelNamespace(name)
+	err := namespaceMgr.DelNamespace(name, force)
+	if errors.Is(err, models.ErrNamespaceNotEmpty) {
+		fmt.Printf("%v, use --force to delete them\n", err)
+		return
+	}
+
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -44,9 +60,35 @@ func listNamespace(store *etcdstorage.Etcd) {
 	namespaceMgr := models.NewNamespaceManager(store)
 	nss := namespaceMgr.GetNamespaces()
 	fmt.Println("namespace list:")
-	fmt.Printf("      %-15s %-30s\n", "Name", "SecretKey")
-	fmt.Println("--------------------------------------------")
+	fmt.Printf("      %-15s %-30s %-10s %-10s\n", "Name", "SecretKey", "Transport", "Compress")
+	fmt.Println("------------------------------------------------------------------")
 	for i, ns := range nss {
-		fmt.Printf("%-5d %-15s %-30s\n", i+1, ns.Name, ns.Secret)
+		transport := ns.Transport
+		if len(transport) == 0 {
+			transport = codec.TransportUDP
+		}
+		compress := ns.Compress
+		if len(compress) == 0 {
+			compress = "-"
+		}
+		fmt.Printf("%-5d %-15s %-30s %-10s %-10s\n", i+1, ns.Name, ns.Secret, transport, compress)
+	}
+}
+
+func rollKey(name string, store *etcdstorage.Etcd) {
+	namespaceMgr := models.NewNamespaceManager(store)
+	_, err := namespaceMgr.GetNamespace(name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	keyMgr := models.NewKeyManager(store)
+	key, err := keyMgr.RollKey(name)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	fmt.Printf("roll key of namespace %s, edges seal packets by key %d in %s OK\n",
+		name, key.ID, codec.KeyActivateDelay)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/controller/models"
+	"github.com/ICKelin/cframe/pkg/etcdstorage"
+)
+
+func addRateLimit(ns, rate string, limit *codec.RateLimit, store *etcdstorage.Etcd) {
+	bps, err := codec.ParseRate(rate)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	limit.Rate = bps
+
+	rateLimitMgr := models.NewRateLimitManager(store)
+	err = rateLimitMgr.VerifyLimit(limit)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	err = rateLimitMgr.AddLimit(ns, limit)
+	if err != nil {
+		fmt.Printf("add rate limit %s ret: %v", limit.Name, err)
+		return
+	}
+	fmt.Printf("add rate limit %s OK\n", limit.Name)
+}
+
+func delRateLimit(ns, name string, store *etcdstorage.Etcd) {
+	rateLimitMgr := models.NewRateLimitManager(store)
+	err := rateLimitMgr.DelLimit(ns, name)
+	if err != nil {
+		fmt.Printf("del rate limit %s ret: %v", name, err)
+		return
+	}
+	fmt.Printf("del rate limit %s OK\n", name)
+}
+
+func listRateLimits(ns string, store *etcdstorage.Etcd) {
+	rateLimitMgr := models.NewRateLimitManager(store)
+	limits := rateLimitMgr.GetLimits(ns)
+
+	orOf := func(s, or string) string {
+		if len(s) == 0 {
+			return or
+		}
+		return s
+	}
+
+	fmt.Printf("\nrate limits for %s namespace\n", ns)
+	fmt.Printf("      %-15s %-10s %-10s %-20s %-12s %-10s\n",
+		"Name", "Edge", "Peer", "Dst", "Rate", "Burst")
+	fmt.Println("------------------------------------------------------------------------------------")
+	for i, l := range limits {
+		fmt.Printf("%-5d %-15s %-10s %-10s %-20s %-12s %-10d\n", i+1,
+			l.Name, orOf(l.Edge, "all"), orOf(l.Peer, "any"), orOf(l.Dst, "any"),
+			codec.FormatRate(l.Rate), l.BurstBytes())
+	}
+	fmt.Println("OK")
+}
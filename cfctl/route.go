@@ -18,13 +18,38 @@ func delRoute(ns, name string, store *etcdstorage.Etcd) {
 	fmt.Printf("del route %s OK\n", name)
 }
 
-func addRoute(ns, name, listener, cidr string, store *etcdstorage.Etcd) {
+func addRoute(ns, name string, listeners []string, cidr string, ecmp, force bool, store *etcdstorage.Etcd) {
+	route := &codec.Route{
+		Name: name,
+		CIDR: cidr,
+		ECMP: ecmp,
+	}
+
+	for _, listener := range listeners {
+		nexthop, err := codec.ParseNexthop(listener)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		route.Nexthops = append(route.Nexthops, nexthop)
+	}
+
+	// single nexthop is stored as before
+	nexthops := route.NextHops()
+	route.Nexthop = nexthops[0].Addr
+	if len(nexthops) == 1 && nexthops[0].Priority == 0 {
+		route.Nexthops = nil
+	}
+
 	routeMgr := models.NewRouteManager(store)
-	err := routeMgr.AddRoute(ns, &codec.Route{
-		Name:    name,
-		CIDR:    cidr,
-		Nexthop: listener,
-	})
+	edgeMgr := models.NewEdgeManager(store)
+	err := routeMgr.VerifyRoute(ns, route, edgeMgr.GetEdges(ns), force)
+	if err != nil {
+		printVerifyError(err)
+		return
+	}
+
+	err = routeMgr.AddRoute(ns, route)
 	if err != nil {
 		fmt.Printf("add route %s ret: %v", name, err)
 		return
@@ -37,10 +62,11 @@ func listRoutes(ns string, store *etcdstorage.Etcd) {
 	routes := routeMgr.GetRoutes(ns)
 
 	fmt.Printf("\nroutes for %s namespace\n", ns)
-	fmt.Printf("      %-20s %-25s %-15s\n", "Name", "Listener", "CIDR")
-	fmt.Println("-----------------------------------------------------------")
+	fmt.Printf("      %-20s %-25s %-15s %-5s\n", "Name", "Listener", "CIDR", "ECMP")
+	fmt.Println("-----------------------------------------------------------------")
 	for i, r := range routes {
-		fmt.Printf("%-5d %-20s %-25s %-15s\n", i+1, r.Name, r.Nexthop, r.CIDR)
+		fmt.Printf("%-5d %-20s %-25s %-15s %-5v\n", i+1, r.Name,
+			codec.FormatNexthops(r.NextHops()), r.CIDR, r.ECMP)
 	}
 	fmt.Println("OK")
 }
@@ -2,7 +2,8 @@
 // of edge and controller
 // includes the following sections:
 //  1. header
-//		| 1byte ver | 1byte cmd | 2bytes bodylen | payload..... |
+//		v1: | 1byte ver | 1byte cmd | 2bytes bodylen | payload..... |
+//		v2: | 1byte ver | 1byte cmd | 4bytes bodylen | payload..... |
 //  2. encode/decode from network connection
 //  @ICKelin 2020.07..5
 
@@ -11,10 +12,42 @@ package codec
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"net"
 )
 
+const (
+	// 2bytes body length
+	Version1 = 0x01
+
+	// 4bytes body length
+	Version2 = 0x02
+
+	// version used by Write
+	CurrentVersion = Version2
+
+	// default max body length of a frame
+	DefaultMaxFrameSize = 16 * 1024 * 1024
+
+	// max body length of frames before edge is authenticated
+	PreAuthMaxFrameSize = 64 * 1024
+)
+
+var (
+	ErrFrameTooLarge      = errors.New("frame too large")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+)
+
+var maxFrameSize = DefaultMaxFrameSize
+
+// SetMaxFrameSize sets max body length for Read and Write
+func SetMaxFrameSize(size int) {
+	if size > 0 {
+		maxFrameSize = size
+	}
+}
+
 const (
 	_ = iota
 	// heartbeat between controller and edge
@@ -43,40 +76,101 @@ const (
 
 	// exit edge
 	CmdExit
+
+	// edge probe controller over udp
+	CmdProbe
+
+	// controller tell edge its public udp endpoint
+	CmdEndpoint
+
+	// packet relayed by controller over udp
+	CmdRelay
+
+	// controller deploy acl rules to edge
+	CmdACL
+
+	// controller deploy rate limits to edge
+	CmdRateLimit
+
+	// controller deploy data keys to edge
+	CmdKey
 )
 
 // version: 1byte
 // cmd: 1byte
-// body len: 2bytes
-type Header [4]byte
+// body len: 2bytes for v1, 4bytes for v2
+type Header struct {
+	version int
+	cmd     int
+	bodylen int
+}
 
 func (h Header) Version() int {
-	return int(h[0])
+	return h.version
 }
 
 func (h Header) Cmd() int {
-	return int(h[1])
+	return h.cmd
 }
 
 func (h Header) Bodylen() int {
-	return (int(h[2]) << 8) + int(h[3])
+	return h.bodylen
 }
 
-// Read from net connection
+// Read from net connection or udp datagram
+// both v1 and v2 frames are accepted
 // return header, body and error
-func Read(conn net.Conn) (Header, []byte, error) {
+func Read(conn io.Reader) (Header, []byte, error) {
+	return ReadLimit(conn, maxFrameSize)
+}
+
+// ReadLimit reads frame whose body length is at most limit,
+// it is used for frames of unauthenticated peers
+func ReadLimit(conn io.Reader, limit int) (Header, []byte, error) {
 	h := Header{}
-	_, err := io.ReadFull(conn, h[:])
+	verCmd := make([]byte, 2)
+	_, err := io.ReadFull(conn, verCmd)
 	if err != nil {
 		return h, nil, err
 	}
 
-	bodylen := h.Bodylen()
-	if bodylen <= 0 {
+	h.version = int(verCmd[0])
+	h.cmd = int(verCmd[1])
+
+	switch h.version {
+	case Version1:
+		bodylen := make([]byte, 2)
+		_, err = io.ReadFull(conn, bodylen)
+		if err != nil {
+			return h, nil, err
+		}
+		h.bodylen = int(binary.BigEndian.Uint16(bodylen))
+		if h.bodylen > limit {
+			return h, nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, h.bodylen, limit)
+		}
+
+	case Version2:
+		bodylen := make([]byte, 4)
+		_, err = io.ReadFull(conn, bodylen)
+		if err != nil {
+			return h, nil, err
+		}
+
+		l := binary.BigEndian.Uint32(bodylen)
+		if uint64(l) > uint64(limit) {
+			return h, nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, l, limit)
+		}
+		h.bodylen = int(l)
+
+	default:
+		return h, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.version)
+	}
+
+	if h.bodylen <= 0 {
 		return h, nil, nil
 	}
 
-	body := make([]byte, bodylen)
+	body := make([]byte, h.bodylen)
 	_, err = io.ReadFull(conn, body)
 	if err != nil {
 		return h, nil, err
@@ -85,17 +179,39 @@ func Read(conn net.Conn) (Header, []byte, error) {
 	return h, body, nil
 }
 
-// Write to net connection
+// Write to net connection with CurrentVersion
 // cmd: header.cmd
 // body: payload
-func Write(conn net.Conn, cmd int, body []byte) error {
-	bodylen := make([]byte, 2)
-	binary.BigEndian.PutUint16(bodylen, uint16(len(body)))
+func Write(conn io.Writer, cmd int, body []byte) error {
+	return WriteVersion(conn, CurrentVersion, cmd, body)
+}
 
-	hdr := []byte{0x01, byte(cmd)}
-	hdr = append(hdr, bodylen...)
+// WriteVersion writes frame of the specified version
+// so that v1 peers can still be served
+func WriteVersion(conn io.Writer, version, cmd int, body []byte) error {
+	if len(body) > maxFrameSize {
+		return fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, len(body), maxFrameSize)
+	}
 
-	writebody := make([]byte, 0)
+	var hdr []byte
+	switch version {
+	case Version1:
+		if len(body) > 0xffff {
+			return fmt.Errorf("%w: %d > %d for v1", ErrFrameTooLarge, len(body), 0xffff)
+		}
+		hdr = make([]byte, 4)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(body)))
+
+	case Version2:
+		hdr = make([]byte, 6)
+		binary.BigEndian.PutUint32(hdr[2:], uint32(len(body)))
+
+	default:
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	hdr[0], hdr[1] = byte(version), byte(cmd)
+
+	writebody := make([]byte, 0, len(hdr)+len(body))
 	writebody = append(writebody, hdr...)
 	writebody = append(writebody, body...)
 	_, err := conn.Write(writebody)
@@ -103,16 +219,21 @@ func Write(conn net.Conn, cmd int, body []byte) error {
 }
 
 // WriteJSON wraps Write with json encoder
-func WriteJSON(conn net.Conn, cmd int, obj interface{}) error {
+func WriteJSON(conn io.Writer, cmd int, obj interface{}) error {
+	return WriteJSONVersion(conn, CurrentVersion, cmd, obj)
+}
+
+// WriteJSONVersion wraps WriteVersion with json encoder
+func WriteJSONVersion(conn io.Writer, version, cmd int, obj interface{}) error {
 	body, err := json.Marshal(obj)
 	if err != nil {
 		return err
 	}
-	return Write(conn, cmd, body)
+	return WriteVersion(conn, version, cmd, body)
 }
 
 // ReadJSON wraps Read with json decoder
-func ReadJSON(conn net.Conn, obj interface{}) error {
+func ReadJSON(conn io.Reader, obj interface{}) error {
 	_, body, err := Read(conn)
 	if err != nil {
 		return err
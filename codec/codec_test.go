@@ -0,0 +1,149 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	for _, version := range []int{Version1, Version2} {
+		for _, body := range [][]byte{nil, []byte("hello"), make([]byte, 0xffff)} {
+			buf := &bytes.Buffer{}
+			err := WriteVersion(buf, version, CmdHeartbeat, body)
+			if err != nil {
+				t.Fatalf("write v%d fail: %v", version, err)
+			}
+
+			hdr, rbody, err := Read(buf)
+			if err != nil {
+				t.Fatalf("read v%d fail: %v", version, err)
+			}
+
+			if hdr.Version() != version || hdr.Cmd() != CmdHeartbeat || hdr.Bodylen() != len(body) {
+				t.Fatalf("read header %+v, expect v%d cmd %d len %d", hdr, version, CmdHeartbeat, len(body))
+			}
+
+			if !bytes.Equal(rbody, body) {
+				t.Fatalf("read v%d body of %d bytes mismatch", version, len(body))
+			}
+		}
+	}
+}
+
+func TestReadWriteJSON(t *testing.T) {
+	for _, version := range []int{Version1, Version2} {
+		buf := &bytes.Buffer{}
+		req := &RegisterReq{Namespace: "default", SecretKey: "secret", Name: "edge"}
+		err := WriteJSONVersion(buf, version, CmdRegister, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := &RegisterReq{}
+		err = ReadJSON(buf, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if *reply != *req {
+			t.Fatalf("read %+v, expect %+v", reply, req)
+		}
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	err := WriteVersion(ioutil.Discard, Version1, CmdReport, make([]byte, 0x10000))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("write v1 body over 64k got %v", err)
+	}
+
+	err = WriteVersion(ioutil.Discard, Version2, CmdReport, make([]byte, maxFrameSize+1))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("write v2 body over max frame size got %v", err)
+	}
+}
+
+func TestReadTooLarge(t *testing.T) {
+	// header only, body is not read
+	hdr := []byte{Version2, CmdReport, 0xff, 0xff, 0xff, 0xff}
+	_, _, err := Read(bytes.NewReader(hdr))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("read v2 body over max frame size got %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = WriteVersion(buf, Version2, CmdRegister, make([]byte, PreAuthMaxFrameSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ReadLimit(buf, PreAuthMaxFrameSize)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("read v2 body over pre auth limit got %v", err)
+	}
+
+	buf.Reset()
+	err = WriteVersion(buf, Version1, CmdRegister, make([]byte, 1025))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ReadLimit(buf, 1024)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("read v1 body over limit got %v", err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WriteVersion(buf, Version2, CmdRegister, make([]byte, PreAuthMaxFrameSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, body, err := ReadLimit(buf, PreAuthMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(body) != PreAuthMaxFrameSize {
+		t.Fatalf("read %d bytes, expect %d", len(body), PreAuthMaxFrameSize)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	full := &bytes.Buffer{}
+	err := WriteVersion(full, Version2, CmdHeartbeat, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := full.Bytes()
+
+	// truncated in version/cmd, body length and body
+	for n := 0; n < len(frame); n++ {
+		_, _, err := Read(bytes.NewReader(frame[:n]))
+		if err == nil {
+			t.Fatalf("read frame truncated to %d bytes", n)
+		}
+	}
+
+	v1 := []byte{Version1, CmdHeartbeat, 0x00}
+	_, _, err = Read(bytes.NewReader(v1))
+	if err == nil {
+		t.Fatal("read v1 frame with truncated body length")
+	}
+}
+
+func TestReadUnsupportedVersion(t *testing.T) {
+	_, _, err := Read(bytes.NewReader([]byte{0x03, CmdHeartbeat, 0, 0}))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("read unknown version got %v", err)
+	}
+
+	err = WriteVersion(ioutil.Discard, 0x03, CmdHeartbeat, nil)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("write unknown version got %v", err)
+	}
+}
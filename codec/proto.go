@@ -10,7 +10,12 @@ package codec
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type CSPType int
@@ -21,21 +26,211 @@ const (
 	CSP_TYPE_AWS
 )
 
+func (t CSPType) String() string {
+	switch t {
+	case CSP_TYPE_ALI:
+		return "ali"
+	case CSP_TYPE_AWS:
+		return "aws"
+	}
+	return "none"
+}
+
 type Route struct {
 	CIDR    string
 	Nexthop string
 	Name    string
+
+	// redundant next hops, Nexthop is the only one if empty
+	Nexthops []*Nexthop `json:",omitempty"`
+
+	// hash flows across next hops of the same priority
+	ECMP bool `json:",omitempty"`
 }
 
 func (r *Route) String() string {
-	return fmt.Sprintf("name %s, listener %s, cidr %s", r.Name, r.Nexthop, r.CIDR)
+	return fmt.Sprintf("name %s, listener %s, cidr %s", r.Name, FormatNexthops(r.NextHops()), r.CIDR)
+}
+
+// NextHops returns next hops of route sorted by priority
+func (r *Route) NextHops() []*Nexthop {
+	return nextHops(r.Nexthop, r.Nexthops)
+}
+
+// HasNexthop reports whether addr is one of next hops of route
+func (r *Route) HasNexthop(addr string) bool {
+	for _, n := range r.NextHops() {
+		if n.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// next hop of route
+// the lower priority is preferred, healthy next hops
+// with the same priority are equally weighted
+type Nexthop struct {
+	// edge listen address
+	Addr     string `json:"addr"`
+	Priority int    `json:"priority"`
+}
+
+func (n *Nexthop) String() string {
+	if n.Priority == 0 {
+		return n.Addr
+	}
+	return fmt.Sprintf("%s@%d", n.Addr, n.Priority)
+}
+
+// ParseNexthop parses next hop in addr@priority format
+// priority is 0 if omitted
+func ParseNexthop(s string) (*Nexthop, error) {
+	nexthop := &Nexthop{Addr: s}
+	if idx := strings.LastIndex(s, "@"); idx >= 0 {
+		priority, err := strconv.Atoi(s[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid nexthop priority %s", s)
+		}
+		nexthop.Addr, nexthop.Priority = s[:idx], priority
+	}
+	return nexthop, nil
+}
+
+func FormatNexthops(nexthops []*Nexthop) string {
+	strs := make([]string, 0, len(nexthops))
+	for _, n := range nexthops {
+		strs = append(strs, n.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+func nextHops(nexthop string, nexthops []*Nexthop) []*Nexthop {
+	if len(nexthops) == 0 {
+		if len(nexthop) == 0 {
+			return nil
+		}
+		return []*Nexthop{{Addr: nexthop}}
+	}
+
+	sorted := make([]*Nexthop, len(nexthops))
+	copy(sorted, nexthops)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+	return sorted
+}
+
+// transports between edges, scheme of edge listen address
+const (
+	TransportUDP  = "udp"
+	TransportTCP  = "tcp"
+	TransportKCP  = "kcp"
+	TransportQUIC = "quic"
+)
+
+// ParseListenAddr splits listen address in scheme://host:port format
+// transport is empty if no scheme
+func ParseListenAddr(addr string) (string, string, error) {
+	idx := strings.Index(addr, "://")
+	if idx < 0 {
+		return "", addr, nil
+	}
+
+	transport := addr[:idx]
+	if !IsTransport(transport) {
+		return "", "", fmt.Errorf("unsupported transport %s", transport)
+	}
+	return transport, addr[idx+3:], nil
+}
+
+func IsTransport(transport string) bool {
+	switch transport {
+	case TransportUDP, TransportTCP, TransportKCP, TransportQUIC:
+		return true
+	}
+	return false
+}
+
+// compression of packets between edges
+const (
+	CompressLZ4  = "lz4"
+	CompressZstd = "zstd"
+)
+
+func IsCompress(compress string) bool {
+	switch compress {
+	case CompressLZ4, CompressZstd:
+		return true
+	}
+	return false
+}
+
+// max shards of a fec group
+const FECMaxShards = 64
+
+// reed-solomon fec of udp packets sent to edge
+type FECConfig struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+}
+
+// ParseFEC parses fec config in data:parity format, eg: 10:3
+// nil is returned if empty
+func ParseFEC(s string) (*FECConfig, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid fec %s, expect data:parity", s)
+	}
+
+	data, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid fec data shards %s", fields[0])
+	}
+
+	parity, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid fec parity shards %s", fields[1])
+	}
+
+	cfg := &FECConfig{DataShards: data, ParityShards: parity}
+	return cfg, cfg.Verify()
+}
+
+func (c *FECConfig) Verify() error {
+	if c.DataShards <= 0 || c.ParityShards <= 0 ||
+		c.DataShards+c.ParityShards > FECMaxShards {
+		return fmt.Errorf("invalid fec %s, shards should be positive and at most %d in total",
+			c, FECMaxShards)
+	}
+	return nil
+}
+
+func (c *FECConfig) String() string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", c.DataShards, c.ParityShards)
 }
 
 type Edge struct {
-	Name       string  `json:"name"`
-	Cidr       string  `json:"cidr"`
+	Name string `json:"name"`
+	Cidr string `json:"cidr"`
+
+	// host:port or transport://host:port
 	ListenAddr string  `json:"listen_addr"`
 	Type       CSPType `json:"type"`
+
+	// fec of udp packets sent to the edge, disabled if nil
+	FEC *FECConfig `json:"fec,omitempty"`
+
+	// public udp endpoint observed by controller
+	// only set for online edges, never stored
+	PublicAddr string `json:"public_addr,omitempty"`
 }
 
 // edge register req
@@ -60,6 +255,27 @@ type RegisterReply struct {
 	EdgeList []*Edge
 	CSPInfo  *CSPInfo
 	Routes   []*Route
+
+	// address of control connection observed by controller
+	ObservedAddr string
+
+	// token of udp probe, empty if controller
+	// does not support nat traversal
+	ProbeToken string
+
+	// controller relays packets between edges
+	// that can not reach each other
+	Relay bool
+
+	// listen address of edge known by peers
+	ListenAddr string
+
+	// transport of namespace for listen addresses
+	// without scheme, udp if empty
+	Transport string
+
+	// compression of packets sent to peers, disabled if empty
+	Compress string `json:",omitempty"`
 }
 
 func (r *RegisterReply) String() string {
@@ -77,6 +293,13 @@ type BroadcastOnlineMsg struct {
 
 	// offline edge network subnet(192.168.10.0/24)
 	Cidr string
+
+	// onlined edge public udp endpoint(ip:port)
+	// edges start hole punching once received
+	PublicAddr string
+
+	// fec of udp packets sent to onlined edge
+	FEC *FECConfig `json:",omitempty"`
 }
 
 // broadcase edge offline
@@ -108,10 +331,97 @@ type ReportMsg struct {
 	TrafficIn  int64
 	TrafficOut int64
 	Error      []string
+
+	// packets from peers recovered by fec
+	// and lost even with fec
+	FECRecovered int64
+	FECLost      int64
+
+	// bytes of packets sent to peers before
+	// and after compression
+	CompressIn  int64
+	CompressOut int64
+
+	// path health to peer edges
+	Peers []*PeerStat
+
+	// rate limits enforced by edge
+	RateLimits []*RateLimitStat `json:",omitempty"`
+
+	// id of data key sealing packets
+	KeyID uint8
+}
+
+// path health from edge to peer edge
+// measured by periodic probes
+type PeerStat struct {
+	// peer listen address
+	ListenAddr string
+
+	// cidrs routed to peer
+	Cidrs []string
+
+	// direct, relay or transport of stream
+	Path string
+
+	// direct address or remote address of stream packets sent to
+	Addr string
+
+	// average round trip time in milliseconds
+	RTT float64
+
+	// probe loss ratio, 0-1
+	Loss float64
+
+	// path mtu of ip packets sent to peer
+	PMTU int
+
+	// fec of packets sent to peer, empty if disabled
+	FEC string
+
+	// packets from peer recovered by fec
+	// and lost even with fec since edge started
+	FECRecovered uint64
+	FECLost      uint64
+
+	// unix timestamp of last probe reply, 0 if never
+	LastSeen int64
+
+	// probes replied recently, down peer is not
+	// selected as next hop if others alive
+	Up bool
+}
+
+// traffic of rate limit since edge started
+type RateLimitStat struct {
+	Name    string
+	Rate    int64
+	Bytes   uint64
+	Packets uint64
+
+	// packets dropped since queues of limit are full
+	Dropped uint64
+
+	// packets waiting for tokens
+	Queued int
 }
 
 type Heartbeat struct{}
 
+// edge probe controller over udp
+// from the same socket as peer traffic
+// so that controller learns public endpoint
+// of edge behind nat
+type ProbeMsg struct {
+	Token string
+}
+
+// controller tell edge the public endpoint
+// observed from udp probe
+type EndpointMsg struct {
+	PublicAddr string
+}
+
 // controller deploy route added to edges
 type AddRouteMsg struct {
 	// dst cidr
@@ -119,7 +429,288 @@ type AddRouteMsg struct {
 	// next hop edge listen address
 	// ip:port
 	Nexthop string
+
+	// redundant next hops, see Route
+	Nexthops []*Nexthop `json:",omitempty"`
+	ECMP     bool       `json:",omitempty"`
+}
+
+// NextHops returns next hops of route sorted by priority
+func (m *AddRouteMsg) NextHops() []*Nexthop {
+	return nextHops(m.Nexthop, m.Nexthops)
 }
 
 // controller deploy route deleted to edges
 type DelRouteMsg AddRouteMsg
+
+// acl actions
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// acl protocols, any protocol if empty
+const (
+	ACLProtoTCP  = "tcp"
+	ACLProtoUDP  = "udp"
+	ACLProtoICMP = "icmp"
+)
+
+// firewall rule enforced by edges for packets
+// from local hosts to peers and from peers to local hosts.
+// rules are matched in priority order, the lower first,
+// and the first matched rule decides.
+// packets matching no rule are allowed
+type ACLRule struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+
+	// edge name enforcing the rule, all edges if empty
+	Edge string `json:"edge,omitempty"`
+
+	// src and dst cidr, any address if empty
+	Src string `json:"src,omitempty"`
+	Dst string `json:"dst,omitempty"`
+
+	// tcp, udp or icmp, any protocol if empty
+	Proto string `json:"proto,omitempty"`
+
+	// tcp/udp port ranges, eg: 22,80,8000-9000
+	// any port if empty
+	SrcPorts string `json:"src_ports,omitempty"`
+	DstPorts string `json:"dst_ports,omitempty"`
+
+	// allow or deny
+	Action string `json:"action"`
+}
+
+func (r *ACLRule) String() string {
+	return fmt.Sprintf("name %s, priority %d, %s %s:%s => %s:%s %s",
+		r.Name, r.Priority, anyOf(r.Proto), anyOf(r.Src), anyOf(r.SrcPorts),
+		anyOf(r.Dst), anyOf(r.DstPorts), r.Action)
+}
+
+// AppliesTo reports whether edge name enforces the rule
+func (r *ACLRule) AppliesTo(name string) bool {
+	return len(r.Edge) == 0 || r.Edge == name
+}
+
+func anyOf(s string) string {
+	if len(s) == 0 {
+		return "any"
+	}
+	return s
+}
+
+// port range, From <= To
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// ParsePorts parses port ranges like 22,80,8000-9000
+func ParsePorts(s string) ([]PortRange, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	ranges := make([]PortRange, 0)
+	for _, item := range strings.Split(s, ",") {
+		from, to := item, item
+		if idx := strings.Index(item, "-"); idx >= 0 {
+			from, to = item[:idx], item[idx+1:]
+		}
+
+		f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s", item)
+		}
+
+		t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || t < f {
+			return nil, fmt.Errorf("invalid port range %s", item)
+		}
+		ranges = append(ranges, PortRange{From: uint16(f), To: uint16(t)})
+	}
+	return ranges, nil
+}
+
+// controller deploy acl rules of edge,
+// the rules replace all rules of edge
+type ACLMsg struct {
+	Rules []*ACLRule
+}
+
+// token bucket rate limit enforced by edges for packets
+// from local hosts to peers. a limit without Peer and Dst
+// limits all traffic of the edge to peers, packets are
+// delayed by every matched limit, the more specific first.
+type RateLimit struct {
+	Name string `json:"name"`
+
+	// edge name enforcing the limit, all edges if empty
+	Edge string `json:"edge,omitempty"`
+
+	// peer edge name, any peer if empty.
+	// listen address of peer edge in RateLimitMsg
+	Peer string `json:"peer,omitempty"`
+
+	// dst cidr, any address if empty
+	Dst string `json:"dst,omitempty"`
+
+	// bits per second
+	Rate int64 `json:"rate"`
+
+	// bytes sent at once, DefaultBurst if zero
+	Burst int64 `json:"burst,omitempty"`
+}
+
+func (l *RateLimit) String() string {
+	return fmt.Sprintf("name %s, peer %s, dst %s, rate %s, burst %d",
+		l.Name, anyOf(l.Peer), anyOf(l.Dst), FormatRate(l.Rate), l.BurstBytes())
+}
+
+// AppliesTo reports whether edge name enforces the limit
+func (l *RateLimit) AppliesTo(name string) bool {
+	return len(l.Edge) == 0 || l.Edge == name
+}
+
+// BurstBytes returns burst of the limit,
+// traffic of 100ms at rate if not set
+func (l *RateLimit) BurstBytes() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+
+	burst := l.Rate / 8 / 10
+	if burst < MinBurst {
+		burst = MinBurst
+	}
+	return burst
+}
+
+// min burst of rate limits, holds a few full sized packets
+const MinBurst = 16 * 1500
+
+// ParseRate parses bits per second like 800k, 100m or 1g
+func ParseRate(s string) (int64, error) {
+	unit := int64(1)
+	num := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "bit")
+	if len(num) > 0 {
+		switch num[len(num)-1] {
+		case 'k':
+			unit = 1000
+		case 'm':
+			unit = 1000 * 1000
+		case 'g':
+			unit = 1000 * 1000 * 1000
+		}
+		if unit > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+
+	rate, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid rate %s", s)
+	}
+	return rate * unit, nil
+}
+
+// FormatRate formats bits per second
+func FormatRate(rate int64) string {
+	switch {
+	case rate >= 1000*1000*1000 && rate%(1000*1000*1000) == 0:
+		return fmt.Sprintf("%dgbit", rate/1000/1000/1000)
+	case rate >= 1000*1000 && rate%(1000*1000) == 0:
+		return fmt.Sprintf("%dmbit", rate/1000/1000)
+	case rate >= 1000 && rate%1000 == 0:
+		return fmt.Sprintf("%dkbit", rate/1000)
+	}
+	return fmt.Sprintf("%dbit", rate)
+}
+
+// controller deploy rate limits of edge,
+// the limits replace all limits of edge
+type RateLimitMsg struct {
+	Limits []*RateLimit
+}
+
+// data key of namespace, packets between edges are
+// sealed by keys derived from it.
+// key 0 is derived from namespace secret and Key is empty,
+// it is used until data key of namespace is rolled
+type DataKey struct {
+	ID uint8 `json:"id"`
+
+	// base64 encoded random bytes
+	Key string `json:"key,omitempty"`
+}
+
+// max data keys accepted by edges, the active one
+// and the previous one during rotation
+const MaxDataKeys = 2
+
+// edges seal packets by the active key KeyActivateDelay
+// after data key of namespace is rolled, so that
+// all online edges install the new key meanwhile
+const KeyActivateDelay = 10 * time.Second
+
+// controller deploy data keys of namespace,
+// the keys replace all keys of edge
+type KeyMsg struct {
+	Keys   []*DataKey
+	Active uint8
+
+	// seal packets by the active key after it,
+	// KeyActivateDelay if key is rolled, 0 on register
+	Delay time.Duration
+}
+
+// relay packet between edges over udp
+// it is binary encoded since it is sent per packet.
+// edge to controller: Token of sender, Addr is listen address of receiver.
+// controller to edge: Token is empty, Addr is listen address of sender.
+// | 1byte token len | token | 1byte addr len | addr | payload |
+type RelayMsg struct {
+	Token   string
+	Addr    string
+	Payload []byte
+}
+
+var ErrInvalidRelayMsg = errors.New("invalid relay msg")
+
+func (m *RelayMsg) Encode() ([]byte, error) {
+	if len(m.Token) > 0xff || len(m.Addr) > 0xff {
+		return nil, ErrInvalidRelayMsg
+	}
+
+	buf := make([]byte, 0, 2+len(m.Token)+len(m.Addr)+len(m.Payload))
+	buf = append(buf, byte(len(m.Token)))
+	buf = append(buf, m.Token...)
+	buf = append(buf, byte(len(m.Addr)))
+	buf = append(buf, m.Addr...)
+	buf = append(buf, m.Payload...)
+	return buf, nil
+}
+
+func (m *RelayMsg) Decode(buf []byte) error {
+	if len(buf) < 1 || len(buf) < 2+int(buf[0]) {
+		return ErrInvalidRelayMsg
+	}
+	tokenLen := int(buf[0])
+	m.Token = string(buf[1 : 1+tokenLen])
+	buf = buf[1+tokenLen:]
+
+	addrLen := int(buf[0])
+	if len(buf) < 1+addrLen {
+		return ErrInvalidRelayMsg
+	}
+	m.Addr = string(buf[1 : 1+addrLen])
+	m.Payload = buf[1+addrLen:]
+	return nil
+}
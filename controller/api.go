@@ -0,0 +1,679 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/controller/models"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// management api for namespaces, edges and routes
+//
+//	GET    /api/v1/namespaces
+//	POST   /api/v1/namespaces
+//	GET    /api/v1/namespaces/{ns}
+//	DELETE /api/v1/namespaces/{ns}
+//	GET    /api/v1/namespaces/{ns}/edges
+//	POST   /api/v1/namespaces/{ns}/edges
+//	GET    /api/v1/namespaces/{ns}/edges/{name}
+//	PUT    /api/v1/namespaces/{ns}/edges/{name}
+//	DELETE /api/v1/namespaces/{ns}/edges/{name}
+//	GET    /api/v1/namespaces/{ns}/edges/{name}/stats
+//	GET    /api/v1/namespaces/{ns}/routes
+//	POST   /api/v1/namespaces/{ns}/routes
+//	GET    /api/v1/namespaces/{ns}/routes/{name}
+//	PUT    /api/v1/namespaces/{ns}/routes/{name}
+//	DELETE /api/v1/namespaces/{ns}/routes/{name}
+//	GET    /api/v1/namespaces/{ns}/acls
+//	POST   /api/v1/namespaces/{ns}/acls
+//	GET    /api/v1/namespaces/{ns}/acls/{name}
+//	PUT    /api/v1/namespaces/{ns}/acls/{name}
+//	DELETE /api/v1/namespaces/{ns}/acls/{name}
+//	GET    /api/v1/namespaces/{ns}/keys
+//	POST   /api/v1/namespaces/{ns}/keys
+//	GET    /api/v1/namespaces/{ns}/ratelimits
+//	POST   /api/v1/namespaces/{ns}/ratelimits
+//	GET    /api/v1/namespaces/{ns}/ratelimits/{name}
+//	PUT    /api/v1/namespaces/{ns}/ratelimits/{name}
+//	DELETE /api/v1/namespaces/{ns}/ratelimits/{name}
+//	GET    /api/v1/namespaces/{ns}/sessions
+//
+// requests must carry "Authorization: Bearer {rpc_token}"
+// namespace with edges, routes, acls or rate limits is deleted
+// only with ?force=true, which deletes them as well
+type ApiServer struct {
+	addr  string
+	token string
+
+	edgeManager  *models.EdgeManager
+	routeManager *models.RouteManager
+	namespaceMgr *models.NamespaceManager
+	reportMgr    *models.ReportManager
+	aclManager   *models.ACLManager
+	rateLimitMgr *models.RateLimitManager
+	keyManager   *models.KeyManager
+	registry     *RegistryServer
+
+	tlsConfig *tls.Config
+}
+
+type namespaceBody struct {
+	Name      string `json:"name"`
+	Secret    string `json:"secret"`
+	Transport string `json:"transport,omitempty"`
+	Compress  string `json:"compress,omitempty"`
+}
+
+func newNamespaceBody(ns *models.Namespace) *namespaceBody {
+	return &namespaceBody{
+		Name:      ns.Name,
+		Secret:    ns.Secret,
+		Transport: ns.Transport,
+		Compress:  ns.Compress,
+	}
+}
+
+// nexthops takes precedence over nexthop
+type routeBody struct {
+	Name     string           `json:"name"`
+	Cidr     string           `json:"cidr"`
+	Nexthop  string           `json:"nexthop"`
+	Nexthops []*codec.Nexthop `json:"nexthops,omitempty"`
+	ECMP     bool             `json:"ecmp"`
+}
+
+func newRouteBody(route *codec.Route) *routeBody {
+	return &routeBody{
+		Name:     route.Name,
+		Cidr:     route.CIDR,
+		Nexthop:  route.Nexthop,
+		Nexthops: route.Nexthops,
+		ECMP:     route.ECMP,
+	}
+}
+
+type errorBody struct {
+	Error     string             `json:"error"`
+	Conflicts []*models.Conflict `json:"conflicts,omitempty"`
+}
+
+func NewApiServer(addr, token string,
+	edgeMgr *models.EdgeManager,
+	routeMgr *models.RouteManager,
+	namespaceMgr *models.NamespaceManager,
+	reportMgr *models.ReportManager,
+	aclMgr *models.ACLManager,
+	rateLimitMgr *models.RateLimitManager,
+	keyMgr *models.KeyManager,
+	registry *RegistryServer) *ApiServer {
+	return &ApiServer{
+		addr:         addr,
+		token:        token,
+		edgeManager:  edgeMgr,
+		routeManager: routeMgr,
+		namespaceMgr: namespaceMgr,
+		reportMgr:    reportMgr,
+		aclManager:   aclMgr,
+		rateLimitMgr: rateLimitMgr,
+		keyManager:   keyMgr,
+		registry:     registry,
+	}
+}
+
+func (s *ApiServer) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+func (s *ApiServer) ListenAndServe() error {
+	if len(s.token) == 0 {
+		return fmt.Errorf("empty api token")
+	}
+
+	lis, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	if s.tlsConfig != nil {
+		lis = tls.NewListener(lis, s.tlsConfig)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/", s)
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  time.Second * 30,
+		WriteTimeout: time.Second * 30,
+	}
+	return srv.Serve(lis)
+}
+
+func (s *ApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.auth(r) {
+		s.fail(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+	segs := strings.Split(path, "/")
+	if segs[0] != "namespaces" {
+		s.fail(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+
+	switch len(segs) {
+	case 1:
+		s.namespaces(w, r)
+	case 2:
+		s.namespace(w, r, segs[1])
+	case 3, 4, 5:
+		nsInfo, err := s.namespaceMgr.GetNamespace(segs[1])
+		if err != nil {
+			s.fail(w, http.StatusNotFound, fmt.Errorf("namespace %s not found", segs[1]))
+			return
+		}
+
+		switch {
+		case segs[2] == "edges" && len(segs) == 3:
+			s.edges(w, r, nsInfo.Name)
+		case segs[2] == "edges" && len(segs) == 4:
+			s.edge(w, r, nsInfo.Name, segs[3])
+		case segs[2] == "edges" && segs[4] == "stats":
+			s.edgeStats(w, r, nsInfo.Name, segs[3])
+		case segs[2] == "routes" && len(segs) == 3:
+			s.routes(w, r, nsInfo.Name)
+		case segs[2] == "routes" && len(segs) == 4:
+			s.route(w, r, nsInfo.Name, segs[3])
+		case segs[2] == "acls" && len(segs) == 3:
+			s.acls(w, r, nsInfo.Name)
+		case segs[2] == "acls" && len(segs) == 4:
+			s.acl(w, r, nsInfo.Name, segs[3])
+		case segs[2] == "keys" && len(segs) == 3:
+			s.keys(w, r, nsInfo.Name)
+		case segs[2] == "ratelimits" && len(segs) == 3:
+			s.rateLimits(w, r, nsInfo.Name)
+		case segs[2] == "ratelimits" && len(segs) == 4:
+			s.rateLimit(w, r, nsInfo.Name, segs[3])
+		case segs[2] == "sessions" && len(segs) == 3:
+			s.sessions(w, r, nsInfo.Name)
+		default:
+			s.fail(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		}
+	default:
+		s.fail(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+func (s *ApiServer) namespaces(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		nss := s.namespaceMgr.GetNamespaces()
+		res := make([]*namespaceBody, 0, len(nss))
+		for _, ns := range nss {
+			res = append(res, newNamespaceBody(ns))
+		}
+		s.reply(w, http.StatusOK, res)
+
+	case http.MethodPost:
+		body := namespaceBody{}
+		if !s.decode(w, r, &body) {
+			return
+		}
+
+		err := models.VerifyName(body.Name)
+		if err == nil && len(body.Transport) > 0 && !codec.IsTransport(body.Transport) {
+			err = fmt.Errorf("unsupported transport %s", body.Transport)
+		}
+		if err == nil && len(body.Compress) > 0 && !codec.IsCompress(body.Compress) {
+			err = fmt.Errorf("unsupported compress %s", body.Compress)
+		}
+		if err != nil {
+			s.fail(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := s.namespaceMgr.GetNamespace(body.Name); err == nil {
+			s.fail(w, http.StatusConflict, fmt.Errorf("namespace %s exists", body.Name))
+			return
+		}
+
+		ns := &models.Namespace{
+			Name:      body.Name,
+			Secret:    models.GenerateSecret(),
+			Transport: body.Transport,
+			Compress:  body.Compress,
+		}
+		err = s.namespaceMgr.AddNamespace(ns)
+		if err != nil {
+			s.fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.reply(w, http.StatusCreated, newNamespaceBody(ns))
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) namespace(w http.ResponseWriter, r *http.Request, name string) {
+	nsInfo, err := s.namespaceMgr.GetNamespace(name)
+	if err != nil {
+		s.fail(w, http.StatusNotFound, fmt.Errorf("namespace %s not found", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, newNamespaceBody(nsInfo))
+
+	case http.MethodDelete:
+		err := s.namespaceMgr.DelNamespace(name, s.force(r))
+		if errors.Is(err, models.ErrNamespaceNotEmpty) {
+			s.fail(w, http.StatusConflict, fmt.Errorf("%v, use ?force=true to delete them", err))
+			return
+		}
+
+		if err != nil {
+			s.fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) edges(w http.ResponseWriter, r *http.Request, ns string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, s.edgeManager.GetEdges(ns))
+
+	case http.MethodPost:
+		edge := codec.Edge{}
+		if !s.decode(w, r, &edge) {
+			return
+		}
+
+		if s.edgeManager.GetEdge(ns, edge.Name) != nil {
+			s.fail(w, http.StatusConflict, fmt.Errorf("edge %s exists", edge.Name))
+			return
+		}
+		s.saveEdge(w, r, ns, &edge, http.StatusCreated)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) edge(w http.ResponseWriter, r *http.Request, ns, name string) {
+	old := s.edgeManager.GetEdge(ns, name)
+	if old == nil {
+		s.fail(w, http.StatusNotFound, fmt.Errorf("edge %s not found", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, old)
+
+	case http.MethodPut:
+		edge := codec.Edge{}
+		if !s.decode(w, r, &edge) {
+			return
+		}
+		edge.Name = name
+		s.saveEdge(w, r, ns, &edge, http.StatusOK)
+
+	case http.MethodDelete:
+		s.edgeManager.DelEdge(ns, name)
+		s.reportMgr.DelReports(ns, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// saveEdge verifies and stores edge
+// conflicts of cidr are ignored with ?force=true, listener is never shared
+func (s *ApiServer) saveEdge(w http.ResponseWriter, r *http.Request, ns string, edge *codec.Edge, status int) {
+	err := s.edgeManager.VerifyEdge(ns, edge, s.routeManager.GetRoutes(ns), s.force(r))
+	if err != nil {
+		s.failVerify(w, err)
+		return
+	}
+
+	err = s.edgeManager.AddEdge(ns, edge)
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.reply(w, status, edge)
+}
+
+func (s *ApiServer) edgeStats(w http.ResponseWriter, r *http.Request, ns, name string) {
+	if r.Method != http.MethodGet {
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	count := 0
+	fmt.Sscanf(r.URL.Query().Get("history"), "%d", &count)
+	s.reply(w, http.StatusOK, s.reportMgr.GetReports(ns, name, count))
+}
+
+func (s *ApiServer) routes(w http.ResponseWriter, r *http.Request, ns string) {
+	switch r.Method {
+	case http.MethodGet:
+		routes := s.routeManager.GetRoutes(ns)
+		res := make([]*routeBody, 0, len(routes))
+		for _, route := range routes {
+			res = append(res, newRouteBody(route))
+		}
+		s.reply(w, http.StatusOK, res)
+
+	case http.MethodPost:
+		body := routeBody{}
+		if !s.decode(w, r, &body) {
+			return
+		}
+
+		if s.routeManager.GetRoute(ns, body.Name) != nil {
+			s.fail(w, http.StatusConflict, fmt.Errorf("route %s exists", body.Name))
+			return
+		}
+		s.saveRoute(w, r, ns, &body, http.StatusCreated)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) route(w http.ResponseWriter, r *http.Request, ns, name string) {
+	old := s.routeManager.GetRoute(ns, name)
+	if old == nil {
+		s.fail(w, http.StatusNotFound, fmt.Errorf("route %s not found", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, newRouteBody(old))
+
+	case http.MethodPut:
+		body := routeBody{}
+		if !s.decode(w, r, &body) {
+			return
+		}
+		body.Name = name
+		s.saveRoute(w, r, ns, &body, http.StatusOK)
+
+	case http.MethodDelete:
+		s.routeManager.DelRoute(ns, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// saveRoute verifies and stores route
+// conflicts are ignored with ?force=true
+func (s *ApiServer) saveRoute(w http.ResponseWriter, r *http.Request, ns string, body *routeBody, status int) {
+	route := &codec.Route{
+		Name:     body.Name,
+		CIDR:     body.Cidr,
+		Nexthop:  body.Nexthop,
+		Nexthops: body.Nexthops,
+		ECMP:     body.ECMP,
+	}
+
+	// best nexthop for edges without redundant nexthops support
+	if nexthops := route.NextHops(); len(nexthops) > 0 {
+		route.Nexthop = nexthops[0].Addr
+	}
+
+	err := s.routeManager.VerifyRoute(ns, route, s.edgeManager.GetEdges(ns), s.force(r))
+	if err != nil {
+		s.failVerify(w, err)
+		return
+	}
+
+	err = s.routeManager.AddRoute(ns, route)
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.reply(w, status, body)
+}
+
+func (s *ApiServer) acls(w http.ResponseWriter, r *http.Request, ns string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, s.aclManager.GetRules(ns))
+
+	case http.MethodPost:
+		rule := codec.ACLRule{}
+		if !s.decode(w, r, &rule) {
+			return
+		}
+
+		if s.aclManager.GetRule(ns, rule.Name) != nil {
+			s.fail(w, http.StatusConflict, fmt.Errorf("acl %s exists", rule.Name))
+			return
+		}
+		s.saveACL(w, ns, &rule, http.StatusCreated)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) acl(w http.ResponseWriter, r *http.Request, ns, name string) {
+	old := s.aclManager.GetRule(ns, name)
+	if old == nil {
+		s.fail(w, http.StatusNotFound, fmt.Errorf("acl %s not found", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, old)
+
+	case http.MethodPut:
+		rule := codec.ACLRule{}
+		if !s.decode(w, r, &rule) {
+			return
+		}
+		rule.Name = name
+		s.saveACL(w, ns, &rule, http.StatusOK)
+
+	case http.MethodDelete:
+		s.aclManager.DelRule(ns, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) saveACL(w http.ResponseWriter, ns string, rule *codec.ACLRule, status int) {
+	err := s.aclManager.VerifyRule(rule)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.aclManager.AddRule(ns, rule)
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.reply(w, status, rule)
+}
+
+// keyBody is data key without key material
+type keyBody struct {
+	ID     uint8 `json:"id"`
+	Active bool  `json:"active"`
+}
+
+// keys lists data keys of namespace or rolls a new one
+func (s *ApiServer) keys(w http.ResponseWriter, r *http.Request, ns string) {
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := s.keyManager.GetKeys(ns)
+		if err != nil {
+			s.fail(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		res := make([]*keyBody, 0, len(keys))
+		for i, k := range keys {
+			res = append(res, &keyBody{ID: k.ID, Active: i == len(keys)-1})
+		}
+		s.reply(w, http.StatusOK, res)
+
+	case http.MethodPost:
+		key, err := s.keyManager.RollKey(ns)
+		if err != nil {
+			s.fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.reply(w, http.StatusCreated, &keyBody{ID: key.ID, Active: true})
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) rateLimits(w http.ResponseWriter, r *http.Request, ns string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, s.rateLimitMgr.GetLimits(ns))
+
+	case http.MethodPost:
+		limit := codec.RateLimit{}
+		if !s.decode(w, r, &limit) {
+			return
+		}
+
+		if s.rateLimitMgr.GetLimit(ns, limit.Name) != nil {
+			s.fail(w, http.StatusConflict, fmt.Errorf("rate limit %s exists", limit.Name))
+			return
+		}
+		s.saveRateLimit(w, ns, &limit, http.StatusCreated)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) rateLimit(w http.ResponseWriter, r *http.Request, ns, name string) {
+	old := s.rateLimitMgr.GetLimit(ns, name)
+	if old == nil {
+		s.fail(w, http.StatusNotFound, fmt.Errorf("rate limit %s not found", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.reply(w, http.StatusOK, old)
+
+	case http.MethodPut:
+		limit := codec.RateLimit{}
+		if !s.decode(w, r, &limit) {
+			return
+		}
+		limit.Name = name
+		s.saveRateLimit(w, ns, &limit, http.StatusOK)
+
+	case http.MethodDelete:
+		s.rateLimitMgr.DelLimit(ns, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *ApiServer) saveRateLimit(w http.ResponseWriter, ns string, limit *codec.RateLimit, status int) {
+	err := s.rateLimitMgr.VerifyLimit(limit)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.rateLimitMgr.AddLimit(ns, limit)
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.reply(w, status, limit)
+}
+
+func (s *ApiServer) sessions(w http.ResponseWriter, r *http.Request, ns string) {
+	if r.Method != http.MethodGet {
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	s.reply(w, http.StatusOK, s.registry.Sessions(ns))
+}
+
+func (s *ApiServer) auth(r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(h, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *ApiServer) decode(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(obj)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err))
+		return false
+	}
+	return true
+}
+
+func (s *ApiServer) reply(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(obj)
+	if err != nil {
+		log.Error("write api response fail: %v", err)
+	}
+}
+
+func (s *ApiServer) force(r *http.Request) bool {
+	return r.URL.Query().Get("force") == "true"
+}
+
+// failVerify replies 409 with conflicts or 400 for invalid format
+func (s *ApiServer) failVerify(w http.ResponseWriter, err error) {
+	if conflictErr, ok := err.(*models.ConflictError); ok {
+		s.reply(w, http.StatusConflict, &errorBody{
+			Error:     err.Error(),
+			Conflicts: conflictErr.Conflicts,
+		})
+		return
+	}
+	s.fail(w, http.StatusBadRequest, err)
+}
+
+func (s *ApiServer) fail(w http.ResponseWriter, status int, err error) {
+	s.reply(w, status, &errorBody{Error: err.Error()})
+}
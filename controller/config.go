@@ -14,9 +14,25 @@ type Config struct {
 	DBName         string   `toml:"dbname"`
 	UserCenterAddr string   `toml:"usercenter_addr"`
 	RpcAddr        string   `toml:"rpc_addr"`
+	RpcToken       string   `toml:"rpc_token"`
+	MetricsAddr    string   `toml:"metrics_addr"`
+	MaxFrameSize   int      `toml:"max_frame_size"`
+	Relay          bool     `toml:"relay"`
+	TLS            TLS      `toml:"tls"`
 	Log            Log      `toml:"log"`
 }
 
+// TLS for registry listener
+// plain tcp is used if cert is empty
+type TLS struct {
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+
+	// ca to verify edge certificates
+	// edges must present certificate if it is set
+	ClientCA string `toml:"client_ca"`
+}
+
 type Log struct {
 	Level string `toml:"level"`
 	Path  string `toml:"path"`
@@ -8,6 +8,7 @@ import (
 	"github.com/ICKelin/cframe/controller/models"
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/pki"
 )
 
 func main() {
@@ -23,6 +24,9 @@ func main() {
 	log.Init(conf.Log.Path, conf.Log.Level, conf.Log.Days)
 	log.Debug("%v", conf)
 
+	// max body length of control frame
+	codec.SetMaxFrameSize(conf.MaxFrameSize)
+
 	// create etcd storage
 	store := etcdstorage.NewEtcd(conf.Etcd)
 
@@ -35,28 +39,116 @@ func main() {
 	// create namespace manager
 	namespaceManager := models.NewNamespaceManager(store)
 
+	// create report manager
+	reportManager := models.NewReportManager(store)
+
+	// create acl manager
+	aclManager := models.NewACLManager(store)
+
+	// create rate limit manager
+	rateLimitManager := models.NewRateLimitManager(store)
+
+	// create data key manager
+	keyManager := models.NewKeyManager(store)
+
 	// registry server for edge
-	r := NewRegistryServer(conf.ListenAddr, edgeManager, routeManager, namespaceManager)
+	r := NewRegistryServer(conf.ListenAddr, edgeManager, routeManager, namespaceManager, reportManager, aclManager, rateLimitManager, keyManager)
+	r.SetRelay(conf.Relay)
+
+	// management api
+	api := NewApiServer(conf.RpcAddr, conf.RpcToken,
+		edgeManager, routeManager, namespaceManager, reportManager, aclManager, rateLimitManager, keyManager, r)
+
+	if len(conf.TLS.Cert) > 0 {
+		tlsConfig, err := pki.NewServerTLSConfig(conf.TLS.Cert, conf.TLS.Key, conf.TLS.ClientCA)
+		if err != nil {
+			log.Error("load tls config fail: %v", err)
+			return
+		}
+		r.SetTLSConfig(tlsConfig)
+
+		// api clients are authenticated by token
+		apiTLSConfig, err := pki.NewServerTLSConfig(conf.TLS.Cert, conf.TLS.Key, "")
+		if err != nil {
+			log.Error("load tls config fail: %v", err)
+			return
+		}
+		api.SetTLSConfig(apiTLSConfig)
+	}
+
+	if len(conf.RpcAddr) > 0 {
+		go func() {
+			err := api.ListenAndServe()
+			if err != nil {
+				log.Error("api server fail: %v", err)
+			}
+		}()
+	}
 
 	// watch for edge delete/put
 	// notify online edge
 	go edgeManager.Watch(
 		func(namespace string, edg *codec.Edge) {
+			watchEvents.WithLabelValues("edge", "delete").Inc()
 			r.DelEdge(namespace, edg)
 		},
 		func(namespace string, edg *codec.Edge) {
+			watchEvents.WithLabelValues("edge", "put").Inc()
 			r.ModifyEdge(namespace, edg)
+
+			// peers of rate limits are resolved to listen address
+			r.UpdateRateLimit(namespace)
 		})
 
 	// watch for route delete/put
 	// notify online edge
 	go routeManager.Watch(
 		func(namespace string, route *codec.Route) {
+			watchEvents.WithLabelValues("route", "delete").Inc()
 			r.DelRoute(namespace, route)
 		},
 		func(namespace string, route *codec.Route) {
+			watchEvents.WithLabelValues("route", "put").Inc()
 			r.AddRoute(namespace, route)
 		},
 	)
+
+	// watch for acl changes
+	// notify online edges of namespace
+	go aclManager.Watch(
+		func(namespace string) {
+			watchEvents.WithLabelValues("acl", "change").Inc()
+			r.UpdateACL(namespace)
+		},
+	)
+
+	// watch for rate limit changes
+	// notify online edges of namespace
+	go rateLimitManager.Watch(
+		func(namespace string) {
+			watchEvents.WithLabelValues("ratelimit", "change").Inc()
+			r.UpdateRateLimit(namespace)
+		},
+	)
+
+	// watch for data key rolls
+	// notify online edges of namespace
+	go keyManager.Watch(
+		func(namespace string) {
+			watchEvents.WithLabelValues("key", "change").Inc()
+			r.UpdateKeys(namespace)
+		},
+	)
+
+	// prometheus metrics, disabled if empty
+	if len(conf.MetricsAddr) > 0 {
+		go func() {
+			err := ServeMetrics(conf.MetricsAddr)
+			if err != nil {
+				log.Error("serve metrics fail: %v", err)
+			}
+		}()
+	}
+
 	r.ListenAndServe()
 }
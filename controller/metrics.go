@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// register failure reasons
+const (
+	registerReadFail      = "read_fail"
+	registerBadNamespace  = "bad_namespace"
+	registerBadSecret     = "bad_secret"
+	registerBadCert       = "bad_cert"
+	registerUnknownEdge   = "unknown_edge"
+	registerDuplicateEdge = "duplicate_edge"
+	registerReplyFail     = "reply_fail"
+)
+
+// relay results
+const (
+	relayForwarded = "forwarded"
+	relayDisabled  = "disabled"
+	relayBadToken  = "bad_token"
+	relayBadSource = "bad_source"
+	relayNoPeer    = "no_peer"
+	relaySendFail  = "send_fail"
+)
+
+var (
+	sessionsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cframe_controller",
+		Name:      "sessions",
+		Help:      "online edge sessions per namespace",
+	}, []string{"namespace"})
+
+	broadcasts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_controller",
+		Name:      "broadcasts_total",
+		Help:      "messages broadcast to edges by cmd and result",
+	}, []string{"cmd", "result"})
+
+	watchEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_controller",
+		Name:      "etcd_watch_events_total",
+		Help:      "etcd watch events by resource and type",
+	}, []string{"resource", "type"})
+
+	registerFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_controller",
+		Name:      "register_failures_total",
+		Help:      "edge register failures by reason",
+	}, []string{"reason"})
+
+	relayPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_controller",
+		Name:      "relay_packets_total",
+		Help:      "packets relayed between edges by result",
+	}, []string{"result"})
+
+	relayBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_controller",
+		Name:      "relay_bytes_total",
+		Help:      "bytes relayed between edges",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sessionsGauge, broadcasts,
+		watchEvents, registerFailures, relayPackets, relayBytes)
+}
+
+// ServeMetrics serves prometheus metrics on addr
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func observeBroadcast(cmd string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "fail"
+	}
+	broadcasts.WithLabelValues(cmd, result).Inc()
+}
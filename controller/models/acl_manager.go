@@ -0,0 +1,114 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/etcdstorage"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+var (
+	aclPrefix = "/acls/"
+)
+
+type ACLManager struct {
+	storage *etcdstorage.Etcd
+}
+
+func NewACLManager(store *etcdstorage.Etcd) *ACLManager {
+	return &ACLManager{
+		storage: store,
+	}
+}
+
+// Watch calls changefunc with namespace once any acl rule
+// of the namespace is added, modified or deleted
+func (m *ACLManager) Watch(changefunc func(namespace string)) {
+	chs := m.storage.Watch(aclPrefix)
+	for c := range chs {
+		for _, evt := range c.Events {
+			log.Info("type: %v", evt.Type)
+			log.Info("new: %v", evt.Kv)
+			sp := strings.Split(string(evt.Kv.Key), "/")
+
+			if len(sp) < 3 {
+				log.Warn("unsupported key value")
+				continue
+			}
+
+			if changefunc != nil {
+				changefunc(sp[2])
+			}
+		}
+	}
+}
+
+// VerifyRule checks acl rule format
+func (m *ACLManager) VerifyRule(rule *codec.ACLRule) error {
+	return verifyACLRule(rule)
+}
+
+func (m *ACLManager) AddRule(namespace string, rule *codec.ACLRule) error {
+	key := fmt.Sprintf("%s%s/%s", aclPrefix, namespace, rule.Name)
+	return m.storage.Set(key, rule)
+}
+
+func (m *ACLManager) DelRule(namespace, name string) error {
+	key := fmt.Sprintf("%s%s/%s", aclPrefix, namespace, name)
+	m.storage.Del(key)
+	return nil
+}
+
+func (m *ACLManager) GetRule(namespace, name string) *codec.ACLRule {
+	key := fmt.Sprintf("%s%s/%s", aclPrefix, namespace, name)
+	rule := codec.ACLRule{}
+	err := m.storage.Get(key, &rule)
+	if err != nil {
+		return nil
+	}
+	return &rule
+}
+
+// GetRules returns acl rules of namespace sorted by priority
+func (m *ACLManager) GetRules(namespace string) []*codec.ACLRule {
+	key := fmt.Sprintf("%s%s/", aclPrefix, namespace)
+	res, err := m.storage.List(key)
+	if err != nil {
+		log.Error("list %s fail: %v", key, err)
+		return nil
+	}
+
+	rules := make([]*codec.ACLRule, 0)
+	for _, val := range res {
+		r := codec.ACLRule{}
+		err := json.Unmarshal([]byte(val), &r)
+		if err != nil {
+			log.Error("unmarshal to acl rule fail: %v", err)
+			continue
+		}
+		rules = append(rules, &r)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
+
+// GetEdgeRules returns acl rules enforced by edge name
+func (m *ACLManager) GetEdgeRules(namespace, name string) []*codec.ACLRule {
+	rules := make([]*codec.ACLRule, 0)
+	for _, r := range m.GetRules(namespace) {
+		if r.AppliesTo(name) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
@@ -45,7 +45,7 @@ func (m *CSPManagr) DelCSP(namespace, name string) error {
 }
 
 func (m *CSPManagr) GetCSPList(namespace string) []*codec.CSPInfo {
-	key := fmt.Sprintf("%s%s", cspPrefix, namespace)
+	key := fmt.Sprintf("%s%s/", cspPrefix, namespace)
 	res, err := m.storage.List(key)
 	if err != nil {
 		log.Error("list %s fail: %v", key, err)
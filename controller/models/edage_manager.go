@@ -3,12 +3,10 @@ package models
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
-	"github.com/ICKelin/cframe/pkg/ip"
 	log "github.com/ICKelin/cframe/pkg/logs"
 	"github.com/coreos/etcd/clientv3"
 )
@@ -74,12 +72,13 @@ func (m *EdgeManager) Watch(delfunc, putfunc func(namespace string, edge *codec.
 
 }
 
-func (m *EdgeManager) AddEdge(namespace string, edge *codec.Edge) {
+func (m *EdgeManager) AddEdge(namespace string, edge *codec.Edge) error {
 	key := fmt.Sprintf("%s%s/%s", edgePrefix, namespace, edge.Name)
 	e := m.storage.Set(key, edge)
 	if e != nil {
 		log.Error("add edge fail: %v", e)
 	}
+	return e
 }
 
 func (m *EdgeManager) DelEdge(namespace, name string) {
@@ -98,7 +97,7 @@ func (m *EdgeManager) GetEdge(namespace, name string) *codec.Edge {
 }
 
 func (m *EdgeManager) GetEdges(namespace string) []*codec.Edge {
-	key := fmt.Sprintf("%s%s", edgePrefix, namespace)
+	key := fmt.Sprintf("%s%s/", edgePrefix, namespace)
 	res, err := m.storage.List(key)
 	if err != nil {
 		log.Error("list %s fail: %v", edgePrefix, err)
@@ -119,8 +118,13 @@ func (m *EdgeManager) GetEdges(namespace string) []*codec.Edge {
 }
 
 func (m *EdgeManager) VerifyCidr(cidr string) bool {
-	b := true
-	return b
+	return VerifyCidr(cidr) == nil
+}
+
+// VerifyEdge checks edge format and conflicts with
+// other edges and routes of the namespace, see verifyEdge
+func (m *EdgeManager) VerifyEdge(namespace string, edge *codec.Edge, routes []*codec.Route, force bool) error {
+	return verifyEdge(edge, m.GetEdges(namespace), routes, force)
 }
 
 // VerifyConflict verify cidr1 and cidr2 ip range
@@ -129,53 +133,4 @@ func (m *EdgeManager) VerifyCidr(cidr string) bool {
 // bip1 < eip2 < eip1 or
 // bip2 < bip1 < eip2
 // bip2 < eip1 < eip2
-func (m *EdgeManager) verifyConflict(cidr1, cidr2 string) bool {
-	sp := strings.Split(cidr1, "/")
-	if len(sp) != 2 {
-		log.Error("invalid cidr format: %s", cidr1)
-		return false
-	}
-
-	ip1, sprefix1 := sp[0], sp[1]
-	prefix1, err := strconv.Atoi(sprefix1)
-	if err != nil {
-		log.Error("invalid cidr format: %s", cidr1)
-		return false
-	}
-
-	ipv41, err := ip.ParseIP4(ip1)
-	if err != nil {
-		log.Error("invalid cidr format: %s", cidr1)
-		return false
-	}
-
-	sp = strings.Split(cidr2, "/")
-	if len(sp) != 2 {
-		log.Error("invalid cidr format: %s", cidr2)
-		return false
-	}
-
-	ip2, sprefix2 := sp[0], sp[1]
-	prefix2, err := strconv.Atoi(sprefix2)
-	if err != nil {
-		log.Error("invalid cidr format: %s", cidr2)
-		return false
-	}
-
-	ipv42, err := ip.ParseIP4(ip2)
-	if err != nil {
-		log.Error("invalid cidr format: %s", cidr2)
-		return false
-	}
-
-	ipn1 := ip.IP4Net{
-		IP:        ipv41,
-		PrefixLen: uint(prefix1),
-	}
-	ipn2 := ip.IP4Net{
-		IP:        ipv42,
-		PrefixLen: uint(prefix2),
-	}
-
-	return !ipn1.Overlaps(ipn2)
-}
+// ipv4 and ipv6 cidr never conflict
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/etcdstorage"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+var (
+	keyPrefix = "/keys/"
+)
+
+// size of random data keys
+const dataKeySize = 32
+
+// attempts to roll key while others rolling
+const maxRollRetries = 5
+
+// KeyManager manages data keys of namespaces
+// the last key is the active one
+type KeyManager struct {
+	storage *etcdstorage.Etcd
+}
+
+func NewKeyManager(store *etcdstorage.Etcd) *KeyManager {
+	return &KeyManager{
+		storage: store,
+	}
+}
+
+// Watch calls changefunc with namespace once
+// data key of the namespace is rolled
+func (m *KeyManager) Watch(changefunc func(namespace string)) {
+	chs := m.storage.Watch(keyPrefix)
+	for c := range chs {
+		for _, evt := range c.Events {
+			log.Info("type: %v", evt.Type)
+			sp := strings.Split(string(evt.Kv.Key), "/")
+
+			if len(sp) < 3 {
+				log.Warn("unsupported key value")
+				continue
+			}
+
+			if changefunc != nil {
+				changefunc(sp[2])
+			}
+		}
+	}
+}
+
+// GetKeys returns data keys of namespace, key 0
+// derived from namespace secret if never rolled
+func (m *KeyManager) GetKeys(namespace string) ([]*codec.DataKey, error) {
+	keys, _, err := m.getKeys(namespace)
+	return keys, err
+}
+
+// getKeys returns data keys and mod revision of them
+func (m *KeyManager) getKeys(namespace string) ([]*codec.DataKey, int64, error) {
+	keys := make([]*codec.DataKey, 0)
+	rev, err := m.storage.GetRevision(keyPrefix+namespace, &keys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(keys) == 0 {
+		keys = []*codec.DataKey{{ID: 0}}
+	}
+	return keys, rev, nil
+}
+
+// RollKey generates a new active data key of namespace,
+// the previous active one is kept for rotation.
+// keys are saved only if not rolled by others meanwhile
+func (m *KeyManager) RollKey(namespace string) (*codec.DataKey, error) {
+	for i := 0; i < maxRollRetries; i++ {
+		keys, rev, err := m.getKeys(namespace)
+		if err != nil {
+			return nil, fmt.Errorf("get keys fail: %v", err)
+		}
+
+		key, err := newDataKey(keys)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+		if len(keys) > codec.MaxDataKeys {
+			keys = keys[len(keys)-codec.MaxDataKeys:]
+		}
+
+		ok, err := m.storage.CompareAndSet(keyPrefix+namespace, rev, keys)
+		if err != nil {
+			return nil, fmt.Errorf("save keys fail: %v", err)
+		}
+
+		if ok {
+			return key, nil
+		}
+		log.Warn("keys of namespace %s rolled concurrently, retry", namespace)
+	}
+	return nil, fmt.Errorf("keys of namespace %s rolled concurrently", namespace)
+}
+
+// newDataKey returns random key with id next to the active one,
+// key 0 reserved for namespace secret and ids in use are skipped
+func newDataKey(keys []*codec.DataKey) (*codec.DataKey, error) {
+	b := make([]byte, dataKeySize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	id := keys[len(keys)-1].ID
+	for {
+		id += 1
+		if id != 0 && !hasDataKey(keys, id) {
+			break
+		}
+	}
+
+	return &codec.DataKey{
+		ID:  id,
+		Key: base64.StdEncoding.EncodeToString(b),
+	}, nil
+}
+
+func hasDataKey(keys []*codec.DataKey, id uint8) bool {
+	for _, key := range keys {
+		if key.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -1,20 +1,32 @@
 package models
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	uuid "github.com/satori/go.uuid"
 )
 
 var (
 	namespacePrefix = "/namespace/"
 )
 
+var ErrNamespaceNotEmpty = errors.New("namespace not empty")
+
 type Namespace struct {
 	Name   string
 	Secret string
+
+	// transport of edges without scheme in listen address
+	Transport string `json:",omitempty"`
+
+	// compression of packets between edges, disabled if empty
+	Compress string `json:",omitempty"`
 }
 
 type NamespaceManager struct {
@@ -27,15 +39,65 @@ func NewNamespaceManager(store *etcdstorage.Etcd) *NamespaceManager {
 	}
 }
 
+// GenerateSecret generates random namespace secret
+func GenerateSecret() string {
+	uniq := uuid.NewV4()
+	return base64.StdEncoding.EncodeToString(uniq.Bytes())
+}
+
 func (m *NamespaceManager) AddNamespace(ns *Namespace) error {
 	key := fmt.Sprintf("%s%s", namespacePrefix, ns.Name)
 	return m.storage.Set(key, ns)
 }
 
-func (m *NamespaceManager) DelNamespace(name string) error {
-	key := fmt.Sprintf("%s%s", namespacePrefix, name)
-	m.storage.Del(key)
-	return nil
+// DelNamespace deletes namespace with its edges, routes, acls,
+// rate limits, reports and data keys. it is refused if any
+// edge, route, acl or rate limit exists unless force is set
+func (m *NamespaceManager) DelNamespace(name string, force bool) error {
+	if !force {
+		children, err := m.children(name)
+		if err != nil {
+			return err
+		}
+
+		if len(children) > 0 {
+			return fmt.Errorf("%w: %s", ErrNamespaceNotEmpty, strings.Join(children, ", "))
+		}
+	}
+
+	keys := []string{namespacePrefix + name, keyPrefix + name}
+	prefixes := make([]string, 0)
+	for _, prefix := range []string{edgePrefix, routePrefix, aclPrefix, rateLimitPrefix, cspPrefix, reportPrefix} {
+		prefixes = append(prefixes, prefix+name+"/")
+	}
+	return m.storage.DelAll(keys, prefixes)
+}
+
+// children returns count of edges, routes, acls
+// and rate limits in namespace, eg: 2 edges
+func (m *NamespaceManager) children(name string) ([]string, error) {
+	kinds := []struct {
+		prefix string
+		name   string
+	}{
+		{edgePrefix, "edges"},
+		{routePrefix, "routes"},
+		{aclPrefix, "acls"},
+		{rateLimitPrefix, "rate limits"},
+	}
+
+	children := make([]string, 0)
+	for _, kind := range kinds {
+		keys, err := m.storage.Keys(kind.prefix + name + "/")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) > 0 {
+			children = append(children, fmt.Sprintf("%d %s", len(keys), kind.name))
+		}
+	}
+	return children, nil
 }
 
 func (m *NamespaceManager) GetNamespace(name string) (*Namespace, error) {
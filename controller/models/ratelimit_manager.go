@@ -0,0 +1,111 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/etcdstorage"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+var (
+	rateLimitPrefix = "/ratelimits/"
+)
+
+type RateLimitManager struct {
+	storage *etcdstorage.Etcd
+}
+
+func NewRateLimitManager(store *etcdstorage.Etcd) *RateLimitManager {
+	return &RateLimitManager{
+		storage: store,
+	}
+}
+
+// Watch calls changefunc with namespace once any rate limit
+// of the namespace is added, modified or deleted
+func (m *RateLimitManager) Watch(changefunc func(namespace string)) {
+	chs := m.storage.Watch(rateLimitPrefix)
+	for c := range chs {
+		for _, evt := range c.Events {
+			log.Info("type: %v", evt.Type)
+			log.Info("new: %v", evt.Kv)
+			sp := strings.Split(string(evt.Kv.Key), "/")
+
+			if len(sp) < 3 {
+				log.Warn("unsupported key value")
+				continue
+			}
+
+			if changefunc != nil {
+				changefunc(sp[2])
+			}
+		}
+	}
+}
+
+// VerifyLimit checks rate limit format
+func (m *RateLimitManager) VerifyLimit(limit *codec.RateLimit) error {
+	return verifyRateLimit(limit)
+}
+
+func (m *RateLimitManager) AddLimit(namespace string, limit *codec.RateLimit) error {
+	key := fmt.Sprintf("%s%s/%s", rateLimitPrefix, namespace, limit.Name)
+	return m.storage.Set(key, limit)
+}
+
+func (m *RateLimitManager) DelLimit(namespace, name string) error {
+	key := fmt.Sprintf("%s%s/%s", rateLimitPrefix, namespace, name)
+	m.storage.Del(key)
+	return nil
+}
+
+func (m *RateLimitManager) GetLimit(namespace, name string) *codec.RateLimit {
+	key := fmt.Sprintf("%s%s/%s", rateLimitPrefix, namespace, name)
+	limit := codec.RateLimit{}
+	err := m.storage.Get(key, &limit)
+	if err != nil {
+		return nil
+	}
+	return &limit
+}
+
+// GetLimits returns rate limits of namespace sorted by name
+func (m *RateLimitManager) GetLimits(namespace string) []*codec.RateLimit {
+	key := fmt.Sprintf("%s%s/", rateLimitPrefix, namespace)
+	res, err := m.storage.List(key)
+	if err != nil {
+		log.Error("list %s fail: %v", key, err)
+		return nil
+	}
+
+	limits := make([]*codec.RateLimit, 0)
+	for _, val := range res {
+		l := codec.RateLimit{}
+		err := json.Unmarshal([]byte(val), &l)
+		if err != nil {
+			log.Error("unmarshal to rate limit fail: %v", err)
+			continue
+		}
+		limits = append(limits, &l)
+	}
+
+	sort.SliceStable(limits, func(i, j int) bool {
+		return limits[i].Name < limits[j].Name
+	})
+	return limits
+}
+
+// GetEdgeLimits returns rate limits enforced by edge name
+func (m *RateLimitManager) GetEdgeLimits(namespace, name string) []*codec.RateLimit {
+	limits := make([]*codec.RateLimit, 0)
+	for _, l := range m.GetLimits(namespace) {
+		if l.AppliesTo(name) {
+			limits = append(limits, l)
+		}
+	}
+	return limits
+}
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/etcdstorage"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/coreos/etcd/clientv3"
+)
+
+var (
+	reportPrefix = "/reports/"
+
+	// reports of edge are removed by etcd once
+	// edge stops reporting for reportTTL
+	reportTTL = time.Hour * 24
+
+	// lease of edge is renewed once per interval
+	reportLeaseRenew = time.Hour
+)
+
+// reports kept in history of each edge
+const maxReportHistory = 120
+
+// EdgeReport is report of edge at a moment
+type EdgeReport struct {
+	Name string
+	*codec.ReportMsg
+}
+
+// HasError reports whether edge reports errors
+func (r *EdgeReport) HasError() bool {
+	return len(r.Error) > 0
+}
+
+type ReportManager struct {
+	storage *etcdstorage.Etcd
+
+	// one lease shared by reports of each edge
+	// key: {namespace}/{edge}
+	mu     sync.Mutex
+	leases map[string]*reportLease
+}
+
+type reportLease struct {
+	id        clientv3.LeaseID
+	renewedAt time.Time
+}
+
+func NewReportManager(store *etcdstorage.Etcd) *ReportManager {
+	return &ReportManager{
+		storage: store,
+		leases:  make(map[string]*reportLease),
+	}
+}
+
+// AddReport saves the latest report of edge and appends it to
+// history keyed by receive time of controller, so clock of edge
+// never reorders history.
+// key: /reports/{namespace}/{edge}/latest
+//
+//	/reports/{namespace}/{edge}/history/{unix nano}
+func (m *ReportManager) AddReport(namespace, name string, report *codec.ReportMsg) error {
+	if report.Timestamp <= 0 {
+		report.Timestamp = time.Now().Unix()
+	}
+
+	lease, err := m.lease(namespace, name)
+	if err != nil {
+		return fmt.Errorf("lease of edge %s fail: %v", name, err)
+	}
+
+	err = m.storage.SetWithLease(latestReportKey(namespace, name), report, lease)
+	if err != nil {
+		return err
+	}
+
+	// zero padding to keep keys sorted by time
+	prefix := historyPrefix(namespace, name)
+	key := fmt.Sprintf("%s%020d", prefix, time.Now().UnixNano())
+	err = m.storage.SetWithLease(key, report, lease)
+	if err != nil {
+		return err
+	}
+
+	// drop the oldest beyond history size
+	keys, err := m.storage.Keys(prefix)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(keys)-maxReportHistory; i++ {
+		m.storage.Del(keys[i])
+	}
+	return nil
+}
+
+// lease returns lease of edge, renewed periodically
+// and granted again if expired
+func (m *ReportManager) lease(namespace, name string) (clientv3.LeaseID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := namespace + "/" + name
+	l := m.leases[key]
+	if l != nil {
+		if time.Since(l.renewedAt) < reportLeaseRenew {
+			return l.id, nil
+		}
+
+		err := m.storage.KeepAliveOnce(l.id)
+		if err == nil {
+			l.renewedAt = time.Now()
+			return l.id, nil
+		}
+		log.Warn("renew lease of edge %s fail: %v", key, err)
+	}
+
+	id, err := m.storage.Grant(reportTTL)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	m.leases[key] = &reportLease{id: id, renewedAt: time.Now()}
+	return id, nil
+}
+
+// DelReports removes reports of edge
+func (m *ReportManager) DelReports(namespace, name string) {
+	m.storage.DelPrefix(fmt.Sprintf("%s%s/%s/", reportPrefix, namespace, name))
+}
+
+// GetReports returns reports of edge in time order
+// the latest count reports are returned if count > 0
+func (m *ReportManager) GetReports(namespace, name string, count int) []*EdgeReport {
+	res, err := m.storage.List(historyPrefix(namespace, name))
+	if err != nil {
+		log.Error("list reports of %s fail: %v", name, err)
+		return nil
+	}
+
+	keys := make([]string, 0, len(res))
+	for key := range res {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if count > 0 && len(keys) > count {
+		keys = keys[len(keys)-count:]
+	}
+
+	reports := make([]*EdgeReport, 0, len(keys))
+	for _, key := range keys {
+		msg := codec.ReportMsg{}
+		err := json.Unmarshal([]byte(res[key]), &msg)
+		if err != nil {
+			log.Error("unmarshal to report fail: %v", err)
+			continue
+		}
+
+		reports = append(reports, &EdgeReport{
+			Name:      name,
+			ReportMsg: &msg,
+		})
+	}
+	return reports
+}
+
+// GetLatestReport returns the latest report of edge
+func (m *ReportManager) GetLatestReport(namespace, name string) *EdgeReport {
+	msg := codec.ReportMsg{}
+	err := m.storage.Get(latestReportKey(namespace, name), &msg)
+	if err != nil {
+		return nil
+	}
+	return &EdgeReport{Name: name, ReportMsg: &msg}
+}
+
+// GetLatestReports returns the latest report of
+// each edge of names, edges never reported are skipped
+func (m *ReportManager) GetLatestReports(namespace string, names []string) []*EdgeReport {
+	reports := make([]*EdgeReport, 0, len(names))
+	for _, name := range names {
+		r := m.GetLatestReport(namespace, name)
+		if r != nil {
+			reports = append(reports, r)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Name < reports[j].Name
+	})
+	return reports
+}
+
+func latestReportKey(namespace, name string) string {
+	return fmt.Sprintf("%s%s/%s/latest", reportPrefix, namespace, name)
+}
+
+func historyPrefix(namespace, name string) string {
+	return fmt.Sprintf("%s%s/%s/history/", reportPrefix, namespace, name)
+}
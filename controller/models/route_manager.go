@@ -70,6 +70,13 @@ func (m *RouteManager) Watch(delfunc, putfunc func(namespace string, route *code
 
 }
 
+// VerifyRoute checks route format and conflicts
+// with edges and other routes of the namespace,
+// conflicts are ignored if force is true
+func (m *RouteManager) VerifyRoute(namespace string, route *codec.Route, edges []*codec.Edge, force bool) error {
+	return verifyRoute(route, edges, m.GetRoutes(namespace), force)
+}
+
 func (m *RouteManager) AddRoute(namespace string, route *codec.Route) error {
 	key := fmt.Sprintf("%s%s/%s", routePrefix, namespace, route.Name)
 	return m.storage.Set(key, route)
@@ -81,8 +88,18 @@ func (m *RouteManager) DelRoute(namespace, name string) error {
 	return nil
 }
 
+func (m *RouteManager) GetRoute(namespace, name string) *codec.Route {
+	key := fmt.Sprintf("%s%s/%s", routePrefix, namespace, name)
+	route := codec.Route{}
+	err := m.storage.Get(key, &route)
+	if err != nil {
+		return nil
+	}
+	return &route
+}
+
 func (m *RouteManager) GetRoutes(namespace string) []*codec.Route {
-	key := fmt.Sprintf("%s%s", routePrefix, namespace)
+	key := fmt.Sprintf("%s%s/", routePrefix, namespace)
 	res, err := m.storage.List(key)
 	if err != nil {
 		log.Error("list %s fail: %v", edgePrefix, err)
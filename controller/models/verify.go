@@ -0,0 +1,369 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/ip"
+)
+
+// Conflict describes an existing edge or route
+// conflicting with the one being added
+type Conflict struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func (c *Conflict) String() string {
+	return fmt.Sprintf("%s %s(%s): %s", c.Kind, c.Name, c.Value, c.Reason)
+}
+
+// ConflictError is returned if any conflict found
+type ConflictError struct {
+	Conflicts []*Conflict
+}
+
+func (e *ConflictError) Error() string {
+	msgs := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		msgs = append(msgs, c.String())
+	}
+	return fmt.Sprintf("conflict with %s", strings.Join(msgs, "; "))
+}
+
+// VerifyCidr checks ipv4 or ipv6 cidr format
+// single host address without prefix length is allowed
+func VerifyCidr(cidr string) error {
+	_, err := ip.ParseCIDR(cidr)
+	return err
+}
+
+// sameCidr reports whether cidr1 and cidr2 are the same network
+func sameCidr(cidr1, cidr2 string) bool {
+	n1, err := ip.ParseCIDR(cidr1)
+	if err != nil {
+		return false
+	}
+
+	n2, err := ip.ParseCIDR(cidr2)
+	if err != nil {
+		return false
+	}
+	return n1.String() == n2.String()
+}
+
+// verifyEdge checks edge format and conflicts with
+// edges and routes of the namespace:
+//  1. edge cidr overlaps other edge cidr
+//  2. edge cidr is the same as route cidr
+//  3. edge listener is used by other edge
+//
+// conflicts of cidr are ignored if force is true, listener is
+// never shared since sessions and endpoints are keyed by it.
+// existing edge with the same name is treated as modification
+func verifyEdge(edge *codec.Edge, edges []*codec.Edge, routes []*codec.Route, force bool) error {
+	err := VerifyName(edge.Name)
+	if err == nil {
+		err = VerifyCidr(edge.Cidr)
+	}
+	if err == nil {
+		err = VerifyListenAddr(edge.ListenAddr)
+	}
+	if err == nil && edge.FEC != nil {
+		err = edge.FEC.Verify()
+	}
+	if err != nil {
+		return err
+	}
+
+	conflicts := make([]*Conflict, 0)
+	for _, e := range edges {
+		if e.Name != edge.Name && listenKey(e.ListenAddr) == listenKey(edge.ListenAddr) {
+			conflicts = append(conflicts, &Conflict{
+				Kind:   "edge",
+				Name:   e.Name,
+				Value:  e.ListenAddr,
+				Reason: "same listener",
+			})
+		}
+	}
+
+	if force {
+		if len(conflicts) > 0 {
+			return &ConflictError{Conflicts: conflicts}
+		}
+		return nil
+	}
+
+	for _, e := range edges {
+		if e.Name == edge.Name {
+			continue
+		}
+
+		if overlap, err := ip.CIDROverlaps(e.Cidr, edge.Cidr); err != nil || overlap {
+			conflicts = append(conflicts, &Conflict{
+				Kind:   "edge",
+				Name:   e.Name,
+				Value:  e.Cidr,
+				Reason: "cidr overlaps",
+			})
+		}
+	}
+
+	for _, r := range routes {
+		if sameCidr(r.CIDR, edge.Cidr) {
+			conflicts = append(conflicts, &Conflict{
+				Kind:   "route",
+				Name:   r.Name,
+				Value:  r.CIDR,
+				Reason: "same cidr",
+			})
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// verifyRoute checks route format and conflicts
+// with edges and other routes of the namespace:
+//  1. route cidr is the same as edge cidr or other route cidr
+//  2. any nexthop is not edge listener
+//
+// overlapped but not the same cidr is allowed,
+// edges use longest prefix match
+func verifyRoute(route *codec.Route, edges []*codec.Edge, routes []*codec.Route, force bool) error {
+	err := VerifyName(route.Name)
+	if err == nil {
+		err = VerifyCidr(route.CIDR)
+	}
+	if err == nil {
+		err = verifyNexthops(route.NextHops())
+	}
+	if err != nil || force {
+		return err
+	}
+
+	conflicts := make([]*Conflict, 0)
+	listeners := make(map[string]bool)
+	for _, e := range edges {
+		listeners[listenKey(e.ListenAddr)] = true
+
+		if sameCidr(e.Cidr, route.CIDR) {
+			conflicts = append(conflicts, &Conflict{
+				Kind:   "edge",
+				Name:   e.Name,
+				Value:  e.Cidr,
+				Reason: "same cidr",
+			})
+		}
+	}
+
+	for _, r := range routes {
+		if r.Name == route.Name {
+			continue
+		}
+
+		if sameCidr(r.CIDR, route.CIDR) {
+			conflicts = append(conflicts, &Conflict{
+				Kind:   "route",
+				Name:   r.Name,
+				Value:  r.CIDR,
+				Reason: "same cidr",
+			})
+		}
+	}
+
+	for _, n := range route.NextHops() {
+		if !listeners[listenKey(n.Addr)] {
+			conflicts = append(conflicts, &Conflict{
+				Kind:   "route",
+				Name:   route.Name,
+				Value:  n.Addr,
+				Reason: "nexthop is not listener of any edge",
+			})
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+func verifyNexthops(nexthops []*codec.Nexthop) error {
+	if len(nexthops) == 0 {
+		return fmt.Errorf("empty nexthop")
+	}
+
+	seen := make(map[string]bool)
+	for _, n := range nexthops {
+		err := VerifyListenAddr(n.Addr)
+		if err != nil {
+			return err
+		}
+
+		key := listenKey(n.Addr)
+		if seen[key] {
+			return fmt.Errorf("duplicate nexthop %s", n.Addr)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// VerifyListenAddr checks edge listener format
+// host:port or [ipv6]:port with optional transport scheme
+func VerifyListenAddr(addr string) error {
+	_, hostport, err := codec.ParseListenAddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listener %s: %v", addr, err)
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return fmt.Errorf("invalid listener %s: %v", addr, err)
+	}
+
+	if len(host) == 0 {
+		return fmt.Errorf("invalid listener %s: empty host", addr)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid listener %s: bad port", addr)
+	}
+	return nil
+}
+
+// listenKey returns host:port of listener with canonical ip,
+// scheme is ignored since all transports of edge share the port
+// eg: udp://1.2.3.4:58423 and 1.2.3.4:58423 are the same
+func listenKey(addr string) string {
+	_, hostport, err := codec.ParseListenAddr(addr)
+	if err != nil {
+		return addr
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// VerifyName checks namespace/edge/route name
+// name is part of etcd key, so "/" is not allowed
+func VerifyName(name string) error {
+	if len(name) == 0 || len(name) > 64 {
+		return fmt.Errorf("invalid name length %d", len(name))
+	}
+
+	if strings.ContainsAny(name, "/ ") {
+		return fmt.Errorf("invalid name %s", name)
+	}
+	return nil
+}
+
+// verifyACLRule checks acl rule format
+func verifyACLRule(rule *codec.ACLRule) error {
+	err := VerifyName(rule.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(rule.Edge) > 0 {
+		err := VerifyName(rule.Edge)
+		if err != nil {
+			return fmt.Errorf("invalid edge: %v", err)
+		}
+	}
+
+	for _, cidr := range []string{rule.Src, rule.Dst} {
+		if len(cidr) == 0 {
+			continue
+		}
+
+		err := VerifyCidr(cidr)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch rule.Proto {
+	case "", codec.ACLProtoTCP, codec.ACLProtoUDP:
+	case codec.ACLProtoICMP:
+		if len(rule.SrcPorts)+len(rule.DstPorts) > 0 {
+			return fmt.Errorf("ports are not allowed for icmp")
+		}
+	default:
+		return fmt.Errorf("invalid proto %s", rule.Proto)
+	}
+
+	for _, ports := range []string{rule.SrcPorts, rule.DstPorts} {
+		_, err := codec.ParsePorts(ports)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch rule.Action {
+	case codec.ACLAllow, codec.ACLDeny:
+	default:
+		return fmt.Errorf("invalid action %s", rule.Action)
+	}
+	return nil
+}
+
+// verifyRateLimit checks rate limit format
+func verifyRateLimit(limit *codec.RateLimit) error {
+	err := VerifyName(limit.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(limit.Edge) > 0 {
+		err := VerifyName(limit.Edge)
+		if err != nil {
+			return fmt.Errorf("invalid edge: %v", err)
+		}
+	}
+
+	if len(limit.Peer) > 0 {
+		err := VerifyName(limit.Peer)
+		if err != nil {
+			return fmt.Errorf("invalid peer: %v", err)
+		}
+	}
+
+	if len(limit.Edge) > 0 && limit.Edge == limit.Peer {
+		return fmt.Errorf("edge %s limits traffic to itself", limit.Edge)
+	}
+
+	if len(limit.Dst) > 0 {
+		err := VerifyCidr(limit.Dst)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit.Rate <= 0 {
+		return fmt.Errorf("invalid rate %d", limit.Rate)
+	}
+
+	if limit.Burst < 0 {
+		return fmt.Errorf("invalid burst %d", limit.Burst)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestListenKey(t *testing.T) {
+	cases := []struct {
+		addr1, addr2 string
+		same         bool
+	}{
+		{"1.2.3.4:58423", "1.2.3.4:58423", true},
+		{"udp://1.2.3.4:58423", "1.2.3.4:58423", true},
+		{"tcp://1.2.3.4:58423", "quic://1.2.3.4:58423", true},
+		{"[2001:db8::1]:58423", "udp://[2001:db8:0::1]:58423", true},
+		{"1.2.3.4:58423", "1.2.3.4:58424", false},
+		{"1.2.3.4:58423", "1.2.3.5:58423", false},
+		{"edge.example.com:58423", "tcp://edge.example.com:58423", true},
+	}
+
+	for _, c := range cases {
+		same := listenKey(c.addr1) == listenKey(c.addr2)
+		if same != c.same {
+			t.Errorf("%s and %s same %v, expect %v", c.addr1, c.addr2, same, c.same)
+		}
+	}
+}
+
+func TestVerifyNexthopsDuplicate(t *testing.T) {
+	err := verifyNexthops(nexthops("1.2.3.4:58423", "udp://1.2.3.4:58423"))
+	if err == nil {
+		t.Fatal("duplicate nexthop accepted")
+	}
+
+	err = verifyNexthops(nexthops("1.2.3.4:58423", "1.2.3.5:58423"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyEdgeSameListener(t *testing.T) {
+	edges := []*codec.Edge{{Name: "edge1", Cidr: "10.0.0.0/16", ListenAddr: "1.2.3.4:58423"}}
+	edge := &codec.Edge{Name: "edge2", Cidr: "10.0.0.0/24", ListenAddr: "udp://1.2.3.4:58423"}
+
+	// force ignores overlapped cidr but not the listener
+	for _, force := range []bool{false, true} {
+		err := verifyEdge(edge, edges, nil, force)
+		if _, ok := err.(*ConflictError); !ok {
+			t.Fatalf("same listener with force %v got %v", force, err)
+		}
+	}
+
+	edge.ListenAddr = "1.2.3.5:58423"
+	if err := verifyEdge(edge, edges, nil, false); err == nil {
+		t.Fatal("overlapped cidr accepted")
+	}
+
+	if err := verifyEdge(edge, edges, nil, true); err != nil {
+		t.Fatalf("overlapped cidr with force got %v", err)
+	}
+
+	// modification of edge itself
+	edge.Name = "edge1"
+	edge.ListenAddr = "1.2.3.4:58423"
+	if err := verifyEdge(edge, edges, nil, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRouteNexthopListener(t *testing.T) {
+	edges := []*codec.Edge{
+		{Name: "edge1", Cidr: "10.0.0.0/16", ListenAddr: "1.2.3.4:58423"},
+		{Name: "edge2", Cidr: "10.1.0.0/16", ListenAddr: "tcp://1.2.3.5:58423"},
+	}
+
+	route := &codec.Route{Name: "route1", CIDR: "192.168.0.0/16",
+		Nexthops: nexthops("udp://1.2.3.4:58423", "1.2.3.5:58423")}
+	err := verifyRoute(route, edges, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route.Nexthops = nexthops("1.2.3.6:58423")
+	err = verifyRoute(route, edges, nil, false)
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("unknown listener got %v", err)
+	}
+}
+
+func nexthops(addrs ...string) []*codec.Nexthop {
+	res := make([]*codec.Nexthop, 0, len(addrs))
+	for _, addr := range addrs {
+		res = append(res, &codec.Nexthop{Addr: addr})
+	}
+	return res
+}
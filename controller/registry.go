@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"net"
 	"sync"
 	"time"
@@ -8,6 +13,7 @@ import (
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/controller/models"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/pki"
 )
 
 // registry server for edges
@@ -26,6 +32,9 @@ type RegistryServer struct {
 	mu   sync.Mutex
 	sess map[string]map[string]*Session
 
+	// online edges by udp probe token
+	tokens map[string]*Session
+
 	// edge manager
 	edgeManager *models.EdgeManager
 
@@ -34,34 +43,95 @@ type RegistryServer struct {
 
 	// namespace manager
 	namespaceMgr *models.NamespaceManager
+
+	// edge report manager
+	reportMgr *models.ReportManager
+
+	// acl manager
+	aclManager *models.ACLManager
+
+	// rate limit manager
+	rateLimitMgr *models.RateLimitManager
+
+	// data key manager
+	keyManager *models.KeyManager
+
+	// optional tls for registry listener
+	tlsConfig *tls.Config
+
+	// relay packets between edges over udp
+	relay bool
 }
 
 type Session struct {
-	edge *codec.Edge
-	conn net.Conn
+	namespace string
+	edge      *codec.Edge
+	conn      net.Conn
+
+	// udp probe token of edge
+	token string
+
+	// codec version used by edge
+	// v1 edges only accept v1 frame
+	version int
+
+	onlineAt time.Time
+}
+
+// SessionInfo is snapshot of online edge session
+type SessionInfo struct {
+	Name         string `json:"name"`
+	ListenAddr   string `json:"listen_addr"`
+	Cidr         string `json:"cidr"`
+	RemoteAddr   string `json:"remote_addr"`
+	PublicAddr   string `json:"public_addr"`
+	CodecVersion int    `json:"codec_version"`
+	OnlineAt     int64  `json:"online_at"`
 }
 
 func NewRegistryServer(addr string,
 	edgeMgr *models.EdgeManager,
 	routeMgr *models.RouteManager,
-	namespaceMgr *models.NamespaceManager) *RegistryServer {
+	namespaceMgr *models.NamespaceManager,
+	reportMgr *models.ReportManager,
+	aclMgr *models.ACLManager,
+	rateLimitMgr *models.RateLimitManager,
+	keyMgr *models.KeyManager) *RegistryServer {
 	return &RegistryServer{
 		addr:         addr,
 		sess:         make(map[string]map[string]*Session),
+		tokens:       make(map[string]*Session),
 		edgeManager:  edgeMgr,
 		routeManager: routeMgr,
 		namespaceMgr: namespaceMgr,
+		reportMgr:    reportMgr,
+		aclManager:   aclMgr,
+		rateLimitMgr: rateLimitMgr,
+		keyManager:   keyMgr,
 	}
 }
 
+func (s *RegistryServer) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+func (s *RegistryServer) SetRelay(relay bool) {
+	s.relay = relay
+}
+
 func (s *RegistryServer) ListenAndServe() error {
 	lis, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
+
+	if s.tlsConfig != nil {
+		lis = tls.NewListener(lis, s.tlsConfig)
+	}
 	defer lis.Close()
 
 	go s.state()
+	go s.serveUDP()
 
 	for {
 		conn, err := lis.Accept()
@@ -76,33 +146,61 @@ func (s *RegistryServer) ListenAndServe() error {
 
 func (s *RegistryServer) onConn(conn net.Conn) {
 	defer conn.Close()
+
+	// edge is not authenticated yet, frame size is capped
+	// until namespace secret is verified
+	hdr, body, err := codec.ReadLimit(conn, codec.PreAuthMaxFrameSize)
+	if err != nil {
+		log.Error("read register fail: %v", err)
+		registerFailures.WithLabelValues(registerReadFail).Inc()
+		return
+	}
+
 	reg := codec.RegisterReq{}
-	err := codec.ReadJSON(conn, &reg)
+	err = json.Unmarshal(body, &reg)
 	if err != nil {
-		log.Error("read json fail: %v", err)
+		log.Error("unmarshal register fail: %v", err)
+		registerFailures.WithLabelValues(registerReadFail).Inc()
 		return
 	}
 
-	log.Info("edge register %+v", reg)
+	version := hdr.Version()
+	log.Info("edge register %+v, codec version %d", reg, version)
 
 	// verify namespace
 	nsInfo, err := s.namespaceMgr.GetNamespace(reg.Namespace)
 	if err != nil {
 		log.Error("get namespace %s fail: %v", reg.Namespace, err)
+		registerFailures.WithLabelValues(registerBadNamespace).Inc()
 		return
 	}
 
 	if nsInfo.Secret != reg.SecretKey {
 		log.Error("verify namespace key fail")
+		registerFailures.WithLabelValues(registerBadSecret).Inc()
 		return
 	}
 
+	// verify edge certificate identity
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			err = pki.VerifyEdgeCert(certs[0], reg.Namespace, reg.Name)
+			if err != nil {
+				log.Error("verify edge certificate fail: %v", err)
+				registerFailures.WithLabelValues(registerBadCert).Inc()
+				return
+			}
+		}
+	}
+
 	log.Info("namespace info: %+v", nsInfo)
 
 	// verify edge
 	edges := s.edgeManager.GetEdges(nsInfo.Name)
 	if len(edges) <= 0 {
 		log.Error("get edges for namespace %s fail", nsInfo.Name)
+		registerFailures.WithLabelValues(registerUnknownEdge).Inc()
 		return
 	}
 
@@ -121,6 +219,7 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 	}
 	if !find {
 		log.Error("verify edge fail, edge not in %s namespace", nsInfo.Name)
+		registerFailures.WithLabelValues(registerUnknownEdge).Inc()
 		return
 	}
 
@@ -133,7 +232,7 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 	log.Info("route list: %+v", routes)
 	otherRoutes := make([]*codec.Route, 0)
 	for i, route := range routes {
-		if route.Nexthop == curEdge.ListenAddr {
+		if route.HasNexthop(curEdge.ListenAddr) {
 			continue
 		}
 		otherRoutes = append(otherRoutes, routes[i])
@@ -148,36 +247,89 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 	}
 	if _, ok := s.sess[sessKey][curEdge.ListenAddr]; ok {
 		log.Warn("edge %s addr %s is running", curEdge.Name, curEdge.ListenAddr)
+		registerFailures.WithLabelValues(registerDuplicateEdge).Inc()
+		s.mu.Unlock()
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		log.Error("generate probe token fail: %v", err)
 		s.mu.Unlock()
 		return
 	}
 
-	s.sess[sessKey][curEdge.ListenAddr] = &Session{
+	sess := &Session{
+		namespace: sessKey,
 		edge: &codec.Edge{
+			Name:       curEdge.Name,
 			ListenAddr: curEdge.ListenAddr,
 			Cidr:       curEdge.Cidr,
+			FEC:        curEdge.FEC,
 		},
-		conn: conn,
+		conn:     conn,
+		token:    token,
+		version:  version,
+		onlineAt: time.Now(),
+	}
+	s.sess[sessKey][curEdge.ListenAddr] = sess
+	s.tokens[token] = sess
+	sessionsGauge.WithLabelValues(sessKey).Set(float64(len(s.sess[sessKey])))
+
+	// public endpoints of online edges
+	for _, e := range otherEdges {
+		if peer, ok := s.sess[sessKey][e.ListenAddr]; ok {
+			e.PublicAddr = peer.edge.PublicAddr
+		}
 	}
 	s.mu.Unlock()
 	defer func() {
 		s.mu.Lock()
 		delete(s.sess[sessKey], curEdge.ListenAddr)
+		delete(s.tokens, token)
+		if len(s.sess[sessKey]) == 0 {
+			delete(s.sess, sessKey)
+			sessionsGauge.DeleteLabelValues(sessKey)
+		} else {
+			sessionsGauge.WithLabelValues(sessKey).Set(float64(len(s.sess[sessKey])))
+		}
 		s.mu.Unlock()
 	}()
 
 	// reply to edge
 	conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	err = codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReply{
-		EdgeList: otherEdges,
-		Routes:   otherRoutes,
+	err = codec.WriteJSONVersion(conn, version, codec.CmdRegister, &codec.RegisterReply{
+		EdgeList:     otherEdges,
+		Routes:       otherRoutes,
+		ObservedAddr: conn.RemoteAddr().String(),
+		ProbeToken:   token,
+		Relay:        s.relay,
+		ListenAddr:   curEdge.ListenAddr,
+		Transport:    nsInfo.Transport,
+		Compress:     nsInfo.Compress,
 	})
 	conn.SetWriteDeadline(time.Time{})
 	if err != nil {
 		log.Error("write json fail: %v", err)
+		registerFailures.WithLabelValues(registerReplyFail).Inc()
+		return
+	}
+
+	// data keys of namespace, active at once
+	// since online edges have installed them.
+	// edge registers again if keys are not sent
+	err = s.keys(sess, 0)
+	if err != nil {
+		registerFailures.WithLabelValues(registerReplyFail).Inc()
 		return
 	}
 
+	// acl rules of edge
+	s.acl(sess)
+
+	// rate limits of edge
+	s.rateLimit(sess)
+
 	// keepalived
 	fail := 0
 	hb := codec.Heartbeat{}
@@ -198,13 +350,14 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 		switch header.Cmd() {
 		case codec.CmdHeartbeat:
 			log.Debug("heartbeat from client: %s", conn.RemoteAddr().String())
-			err = codec.WriteJSON(conn, codec.CmdHeartbeat, &hb)
+			err = codec.WriteJSONVersion(conn, version, codec.CmdHeartbeat, &hb)
 			if err != nil {
 				log.Error("write json fail: %v", err)
 			}
 
 		case codec.CmdReport:
 			log.Debug("receive report from edge: %s %s", curEdge.Name, string(body))
+			s.onReport(nsInfo.Name, curEdge.Name, body)
 
 		case codec.CmdAlarm:
 			log.Info("receive alarm from edge: %s %s", curEdge.Name, string(body))
@@ -217,6 +370,193 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 	}
 }
 
+func (s *RegistryServer) onReport(namespace, name string, body []byte) {
+	report := codec.ReportMsg{}
+	err := json.Unmarshal(body, &report)
+	if err != nil {
+		log.Error("invalid report msg: %v", err)
+		return
+	}
+
+	if len(report.Error) > 0 {
+		log.Warn("edge %s/%s reports errors: %v", namespace, name, report.Error)
+	}
+
+	err = s.reportMgr.AddReport(namespace, name, &report)
+	if err != nil {
+		log.Error("store report fail: %v", err)
+	}
+}
+
+// serveUDP receives udp probe and relay packets from edges
+// the source address of probe is the public endpoint of edge
+func (s *RegistryServer) serveUDP() {
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		log.Error("listen udp %s fail: %v", s.addr, err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1024*64)
+	for {
+		nr, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Error("read udp fail: %v", err)
+			return
+		}
+
+		hdr, body, err := codec.Read(bytes.NewReader(buf[:nr]))
+		if err != nil {
+			log.Debug("invalid udp packet from %s: %v", raddr, err)
+			continue
+		}
+
+		switch hdr.Cmd() {
+		case codec.CmdProbe:
+			probe := codec.ProbeMsg{}
+			err = json.Unmarshal(body, &probe)
+			if err != nil {
+				log.Debug("invalid probe from %s: %v", raddr, err)
+				continue
+			}
+			s.onProbe(probe.Token, raddr.String())
+
+		case codec.CmdRelay:
+			s.onRelay(conn, raddr, body)
+
+		default:
+			log.Debug("unsupported udp cmd %d from %s", hdr.Cmd(), raddr)
+		}
+	}
+}
+
+// onRelay forwards packet to the public endpoint of receiver,
+// sender and receiver must be online in the same namespace.
+// sender is the session of token, the packet must come from its
+// probed public endpoint, and the listen address of the session is
+// stamped as sender of the forwarded packet
+func (s *RegistryServer) onRelay(conn net.PacketConn, raddr net.Addr, body []byte) {
+	if !s.relay {
+		relayPackets.WithLabelValues(relayDisabled).Inc()
+		return
+	}
+
+	msg := codec.RelayMsg{}
+	err := msg.Decode(body)
+	if err != nil {
+		log.Debug("decode relay msg fail: %v", err)
+		relayPackets.WithLabelValues(relayBadToken).Inc()
+		return
+	}
+
+	s.mu.Lock()
+	src := s.tokens[msg.Token]
+	var dst *Session
+	var srcPublic string
+	if src != nil {
+		dst = s.sess[src.namespace][msg.Addr]
+		srcPublic = src.edge.PublicAddr
+	}
+	var srcAddr, dstAddr string
+	if src != nil && dst != nil {
+		srcAddr, dstAddr = src.edge.ListenAddr, dst.edge.PublicAddr
+	}
+	s.mu.Unlock()
+
+	if src == nil {
+		relayPackets.WithLabelValues(relayBadToken).Inc()
+		return
+	}
+
+	if srcPublic != raddr.String() {
+		log.Debug("relay of %s from %s, expect %s", srcAddr, raddr, srcPublic)
+		relayPackets.WithLabelValues(relayBadSource).Inc()
+		return
+	}
+
+	if len(dstAddr) == 0 {
+		relayPackets.WithLabelValues(relayNoPeer).Inc()
+		return
+	}
+
+	to, err := net.ResolveUDPAddr("udp", dstAddr)
+	if err != nil {
+		relayPackets.WithLabelValues(relayNoPeer).Inc()
+		return
+	}
+
+	fwd := codec.RelayMsg{Addr: srcAddr, Payload: msg.Payload}
+	payload, err := fwd.Encode()
+	if err != nil {
+		relayPackets.WithLabelValues(relaySendFail).Inc()
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = codec.Write(buf, codec.CmdRelay, payload)
+	if err == nil {
+		_, err = conn.WriteTo(buf.Bytes(), to)
+	}
+	if err != nil {
+		log.Debug("relay to %s fail: %v", to, err)
+		relayPackets.WithLabelValues(relaySendFail).Inc()
+		return
+	}
+
+	relayPackets.WithLabelValues(relayForwarded).Inc()
+	relayBytes.Add(float64(len(msg.Payload)))
+}
+
+// onProbe updates public endpoint of edge
+// if endpoint changed, the edge and all online edges
+// are told to punch each other at the same time
+func (s *RegistryServer) onProbe(token, publicAddr string) {
+	s.mu.Lock()
+	sess := s.tokens[token]
+	if sess == nil || sess.edge.PublicAddr == publicAddr {
+		s.mu.Unlock()
+		return
+	}
+
+	sess.edge.PublicAddr = publicAddr
+	edge := *sess.edge
+	peers := make([]codec.Edge, 0)
+	for addr, peer := range s.sess[sess.namespace] {
+		if addr != edge.ListenAddr && len(peer.edge.PublicAddr) > 0 {
+			peers = append(peers, *peer.edge)
+		}
+	}
+	s.mu.Unlock()
+
+	log.Info("edge %s/%s public endpoint %s",
+		sess.namespace, edge.Name, publicAddr)
+
+	sess.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	err := codec.WriteJSONVersion(sess.conn, sess.version, codec.CmdEndpoint, &codec.EndpointMsg{
+		PublicAddr: publicAddr,
+	})
+	sess.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Error("write json fail: %v", err)
+		return
+	}
+
+	s.broadcastOnline(sess.namespace, &edge)
+	for i := range peers {
+		go s.online(sess, &peers[i])
+	}
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func (s *RegistryServer) broadcastOnline(namespace string, edge *codec.Edge) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -225,22 +565,26 @@ func (s *RegistryServer) broadcastOnline(namespace string, edge *codec.Edge) {
 			continue
 		}
 
-		go s.online(host.conn, edge)
+		go s.online(host, edge)
 	}
 }
 
-func (s *RegistryServer) online(peer net.Conn, edge *codec.Edge) {
+func (s *RegistryServer) online(sess *Session, edge *codec.Edge) {
+	peer := sess.conn
 	log.Info("[I] send online msg %v to %s",
 		edge, peer.RemoteAddr().String())
 
 	obj := &codec.BroadcastOnlineMsg{
 		ListenAddr: edge.ListenAddr,
 		Cidr:       edge.Cidr,
+		PublicAddr: edge.PublicAddr,
+		FEC:        edge.FEC,
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	err := codec.WriteJSON(peer, codec.CmdAdd, obj)
+	err := codec.WriteJSONVersion(peer, sess.version, codec.CmdAdd, obj)
 	peer.SetWriteDeadline(time.Time{})
+	observeBroadcast("online", err)
 	if err != nil {
 		log.Error("write json fail: %v", err)
 	}
@@ -248,26 +592,28 @@ func (s *RegistryServer) online(peer net.Conn, edge *codec.Edge) {
 
 func (s *RegistryServer) broadcastOffline(namespace string, edge *codec.Edge) {
 	s.mu.Lock()
-	var conn net.Conn
+	var self *Session
 	for addr, host := range s.sess[namespace] {
 		if addr == edge.ListenAddr {
-			conn = host.conn
+			self = host
 			continue
 		}
 
-		go s.offline(host.conn, edge)
+		go s.offline(host, edge)
 	}
 	s.mu.Unlock()
 
 	// exit to stop edge process
-	if conn != nil {
-		conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
-		codec.WriteJSON(conn, codec.CmdExit, nil)
-		conn.SetWriteDeadline(time.Time{})
+	if self != nil {
+		self.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+		err := codec.WriteJSONVersion(self.conn, self.version, codec.CmdExit, nil)
+		self.conn.SetWriteDeadline(time.Time{})
+		observeBroadcast("exit", err)
 	}
 }
 
-func (s *RegistryServer) offline(peer net.Conn, edge *codec.Edge) {
+func (s *RegistryServer) offline(sess *Session, edge *codec.Edge) {
+	peer := sess.conn
 	log.Info("send offline msg %v to %s\n",
 		edge, peer.RemoteAddr().String())
 
@@ -277,8 +623,9 @@ func (s *RegistryServer) offline(peer net.Conn, edge *codec.Edge) {
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	err := codec.WriteJSON(peer, codec.CmdDel, obj)
+	err := codec.WriteJSONVersion(peer, sess.version, codec.CmdDel, obj)
 	peer.SetWriteDeadline(time.Time{})
+	observeBroadcast("offline", err)
 	if err != nil {
 		log.Error("write json fail: %v", err)
 	}
@@ -289,26 +636,30 @@ func (s *RegistryServer) broadcastAddRoute(namespace string, r *codec.Route) {
 	defer s.mu.Unlock()
 
 	for addr, host := range s.sess[namespace] {
-		if addr == r.Nexthop {
+		if r.HasNexthop(addr) {
 			continue
 		}
 
-		go s.addRoute(host.conn, r)
+		go s.addRoute(host, r)
 	}
 }
 
-func (s *RegistryServer) addRoute(peer net.Conn, r *codec.Route) {
+func (s *RegistryServer) addRoute(sess *Session, r *codec.Route) {
+	peer := sess.conn
 	log.Info("send addroute msg %v to %s\n",
 		r, peer.RemoteAddr().String())
 
 	obj := &codec.AddRouteMsg{
-		Cidr:    r.CIDR,
-		Nexthop: r.Nexthop,
+		Cidr:     r.CIDR,
+		Nexthop:  r.Nexthop,
+		Nexthops: r.Nexthops,
+		ECMP:     r.ECMP,
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	err := codec.WriteJSON(peer, codec.CmdAddRoute, obj)
+	err := codec.WriteJSONVersion(peer, sess.version, codec.CmdAddRoute, obj)
 	peer.SetWriteDeadline(time.Time{})
+	observeBroadcast("add_route", err)
 	if err != nil {
 		log.Error("write json fail: %v", err)
 	}
@@ -319,31 +670,146 @@ func (s *RegistryServer) broadcastDelRoute(namespace string, r *codec.Route) {
 	defer s.mu.Unlock()
 
 	for addr, host := range s.sess[namespace] {
-		if addr == r.Nexthop {
+		if r.HasNexthop(addr) {
 			continue
 		}
 
-		go s.delRoute(host.conn, r)
+		go s.delRoute(host, r)
 	}
 }
 
-func (s *RegistryServer) delRoute(peer net.Conn, r *codec.Route) {
+func (s *RegistryServer) delRoute(sess *Session, r *codec.Route) {
+	peer := sess.conn
 	log.Info("send delroute msg %v to %s\n",
 		r, peer.RemoteAddr().String())
 
 	obj := &codec.DelRouteMsg{
-		Cidr:    r.CIDR,
-		Nexthop: r.Nexthop,
+		Cidr:     r.CIDR,
+		Nexthop:  r.Nexthop,
+		Nexthops: r.Nexthops,
+	}
+
+	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	err := codec.WriteJSONVersion(peer, sess.version, codec.CmdDelRoute, obj)
+	peer.SetWriteDeadline(time.Time{})
+	observeBroadcast("del_route", err)
+	if err != nil {
+		log.Error("write json fail: %v", err)
+	}
+}
+
+func (s *RegistryServer) broadcastACL(namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, host := range s.sess[namespace] {
+		go s.acl(host)
+	}
+}
+
+// acl sends all acl rules enforced by edge of sess
+func (s *RegistryServer) acl(sess *Session) {
+	peer := sess.conn
+	rules := s.aclManager.GetEdgeRules(sess.namespace, sess.edge.Name)
+	log.Info("send %d acl rules to %s", len(rules), peer.RemoteAddr().String())
+
+	obj := &codec.ACLMsg{
+		Rules: rules,
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	err := codec.WriteJSON(peer, codec.CmdDelRoute, obj)
+	err := codec.WriteJSONVersion(peer, sess.version, codec.CmdACL, obj)
 	peer.SetWriteDeadline(time.Time{})
+	observeBroadcast("acl", err)
 	if err != nil {
 		log.Error("write json fail: %v", err)
 	}
 }
 
+func (s *RegistryServer) broadcastRateLimit(namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, host := range s.sess[namespace] {
+		go s.rateLimit(host)
+	}
+}
+
+// rateLimit sends all rate limits enforced by edge of sess,
+// peer of limits is resolved to listen address
+func (s *RegistryServer) rateLimit(sess *Session) {
+	peer := sess.conn
+	limits := make([]*codec.RateLimit, 0)
+	for _, l := range s.rateLimitMgr.GetEdgeLimits(sess.namespace, sess.edge.Name) {
+		if l.Peer == sess.edge.Name {
+			continue
+		}
+
+		if len(l.Peer) > 0 {
+			edg := s.edgeManager.GetEdge(sess.namespace, l.Peer)
+			if edg == nil {
+				log.Warn("peer %s of rate limit %s not found", l.Peer, l.Name)
+				continue
+			}
+			l.Peer = edg.ListenAddr
+		}
+		limits = append(limits, l)
+	}
+	log.Info("send %d rate limits to %s", len(limits), peer.RemoteAddr().String())
+
+	obj := &codec.RateLimitMsg{
+		Limits: limits,
+	}
+
+	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	err := codec.WriteJSONVersion(peer, sess.version, codec.CmdRateLimit, obj)
+	peer.SetWriteDeadline(time.Time{})
+	observeBroadcast("ratelimit", err)
+	if err != nil {
+		log.Error("write json fail: %v", err)
+	}
+}
+
+func (s *RegistryServer) broadcastKeys(namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, host := range s.sess[namespace] {
+		go s.keys(host, codec.KeyActivateDelay)
+	}
+}
+
+// keys sends data keys of namespace to edge of sess,
+// the edge seals packets by the last one after delay.
+// nothing is sent if keys are not read, the edge keeps its keys
+func (s *RegistryServer) keys(sess *Session, delay time.Duration) error {
+	peer := sess.conn
+	keys, err := s.keyManager.GetKeys(sess.namespace)
+	if err != nil {
+		log.Error("get keys of namespace %s fail: %v", sess.namespace, err)
+		observeBroadcast("key", err)
+		return err
+	}
+
+	active := keys[len(keys)-1].ID
+	log.Info("send %d keys to %s, active key %d", len(keys), peer.RemoteAddr().String(), active)
+
+	obj := &codec.KeyMsg{
+		Keys:   keys,
+		Active: active,
+		Delay:  delay,
+	}
+
+	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	err = codec.WriteJSONVersion(peer, sess.version, codec.CmdKey, obj)
+	peer.SetWriteDeadline(time.Time{})
+	observeBroadcast("key", err)
+	if err != nil {
+		log.Error("write json fail: %v", err)
+	}
+	return err
+}
+
 func (s *RegistryServer) state() {
 	tick := time.NewTicker(time.Second * 30)
 	defer tick.Stop()
@@ -359,6 +825,26 @@ func (s *RegistryServer) state() {
 	}
 }
 
+// Sessions returns online edges of namespace
+func (s *RegistryServer) Sessions(namespace string) []*SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]*SessionInfo, 0, len(s.sess[namespace]))
+	for _, sess := range s.sess[namespace] {
+		infos = append(infos, &SessionInfo{
+			Name:         sess.edge.Name,
+			ListenAddr:   sess.edge.ListenAddr,
+			Cidr:         sess.edge.Cidr,
+			RemoteAddr:   sess.conn.RemoteAddr().String(),
+			PublicAddr:   sess.edge.PublicAddr,
+			CodecVersion: sess.version,
+			OnlineAt:     sess.onlineAt.Unix(),
+		})
+	}
+	return infos
+}
+
 func (s *RegistryServer) DelEdge(namespace string, edg *codec.Edge) {
 	log.Info("delete edge: %s %v", namespace, edg)
 	s.broadcastOffline(namespace, edg)
@@ -372,6 +858,11 @@ func (s *RegistryServer) DelEdge(namespace string, edg *codec.Edge) {
 
 func (s *RegistryServer) ModifyEdge(namespace string, edg *codec.Edge) {
 	log.Info("modify edge: %s %v", namespace, edg)
+	s.mu.Lock()
+	if sess, ok := s.sess[namespace][edg.ListenAddr]; ok {
+		edg.PublicAddr = sess.edge.PublicAddr
+	}
+	s.mu.Unlock()
 	s.broadcastOnline(namespace, edg)
 }
 
@@ -384,3 +875,18 @@ func (s *RegistryServer) AddRoute(namespace string, route *codec.Route) {
 	log.Info("add route: %s %v", namespace, route)
 	s.broadcastAddRoute(namespace, route)
 }
+
+func (s *RegistryServer) UpdateACL(namespace string) {
+	log.Info("update acl: %s", namespace)
+	s.broadcastACL(namespace)
+}
+
+func (s *RegistryServer) UpdateKeys(namespace string) {
+	log.Info("update keys: %s", namespace)
+	s.broadcastKeys(namespace)
+}
+
+func (s *RegistryServer) UpdateRateLimit(namespace string) {
+	log.Info("update rate limit: %s", namespace)
+	s.broadcastRateLimit(namespace)
+}
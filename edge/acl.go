@@ -0,0 +1,227 @@
+package main
+
+// acl firewall deployed by controller
+// rules are checked for packets from tun to peers(out)
+// and from peers to tun(in), the first matched rule decides,
+// packets matching no rule are allowed.
+// rules with ports never match packets without ports,
+// eg: non tcp/udp packets, except that deny rules with ports match
+// tcp/udp fragments without ports so that fragments never bypass them
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/ip"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// packet directions of acl
+const (
+	aclIn  = "in"
+	aclOut = "out"
+)
+
+type aclRule struct {
+	// hits of in and out packets
+	// first in struct for 64bit atomic alignment
+	hitsIn  uint64
+	hitsOut uint64
+
+	rule *codec.ACLRule
+
+	src   *net.IPNet
+	dst   *net.IPNet
+	proto string
+
+	srcPorts []codec.PortRange
+	dstPorts []codec.PortRange
+
+	allow bool
+
+	countIn  prometheus.Counter
+	countOut prometheus.Counter
+}
+
+func newACLRule(rule *codec.ACLRule) (*aclRule, error) {
+	r := &aclRule{
+		rule:  rule,
+		proto: rule.Proto,
+		allow: rule.Action == codec.ACLAllow,
+	}
+
+	switch rule.Action {
+	case codec.ACLAllow, codec.ACLDeny:
+	default:
+		return nil, fmt.Errorf("invalid action %s", rule.Action)
+	}
+
+	switch rule.Proto {
+	case "", codec.ACLProtoTCP, codec.ACLProtoUDP, codec.ACLProtoICMP:
+	default:
+		return nil, fmt.Errorf("invalid proto %s", rule.Proto)
+	}
+
+	var err error
+	if len(rule.Src) > 0 {
+		r.src, err = ip.ParseCIDR(rule.Src)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rule.Dst) > 0 {
+		r.dst, err = ip.ParseCIDR(rule.Dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.srcPorts, err = codec.ParsePorts(rule.SrcPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.dstPorts, err = codec.ParsePorts(rule.DstPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.countIn = aclHits.WithLabelValues(rule.Name, rule.Action, aclIn)
+	r.countOut = aclHits.WithLabelValues(rule.Name, rule.Action, aclOut)
+	return r, nil
+}
+
+func (r *aclRule) match(p Packet) bool {
+	if r.src != nil && !r.src.Contains(p.SrcIP()) {
+		return false
+	}
+
+	if r.dst != nil && !r.dst.Contains(p.DstIP()) {
+		return false
+	}
+
+	proto := p.Proto()
+	switch r.proto {
+	case codec.ACLProtoTCP:
+		if proto != protoTCP {
+			return false
+		}
+	case codec.ACLProtoUDP:
+		if proto != protoUDP {
+			return false
+		}
+	case codec.ACLProtoICMP:
+		if proto != protoICMP && proto != protoICMPv6 {
+			return false
+		}
+	}
+
+	if len(r.srcPorts) == 0 && len(r.dstPorts) == 0 {
+		return true
+	}
+
+	src, dst, ok := p.Ports()
+	if !ok {
+		// tcp/udp fragment without ports
+		return !r.allow && (proto == protoTCP || proto == protoUDP) && p.Fragmented()
+	}
+	return inPorts(r.srcPorts, src) && inPorts(r.dstPorts, dst)
+}
+
+// inPorts reports whether port is in ranges,
+// empty ranges contain any port
+func inPorts(ranges []codec.PortRange, port uint16) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *aclRule) hit(dir string) {
+	if dir == aclIn {
+		atomic.AddUint64(&r.hitsIn, 1)
+		r.countIn.Inc()
+	} else {
+		atomic.AddUint64(&r.hitsOut, 1)
+		r.countOut.Inc()
+	}
+}
+
+// SetACL replaces acl rules, rules are sorted by controller
+func (s *Server) SetACL(rules []*codec.ACLRule) error {
+	compiled := make([]*aclRule, 0, len(rules))
+	for _, rule := range rules {
+		r, err := newACLRule(rule)
+		if err != nil {
+			return fmt.Errorf("acl %s: %v", rule.Name, err)
+		}
+		compiled = append(compiled, r)
+	}
+
+	old, _ := s.acl.Load().([]*aclRule)
+	s.acl.Store(compiled)
+
+	// drop counters of removed rules
+	for _, r := range old {
+		if !hasACLRule(compiled, r.rule.Name, r.rule.Action) {
+			aclHits.DeleteLabelValues(r.rule.Name, r.rule.Action, aclIn)
+			aclHits.DeleteLabelValues(r.rule.Name, r.rule.Action, aclOut)
+		}
+	}
+
+	log.Info("set %d acl rules", len(compiled))
+	aclRules.Set(float64(len(compiled)))
+	return nil
+}
+
+func hasACLRule(rules []*aclRule, name, action string) bool {
+	for _, r := range rules {
+		if r.rule.Name == name && r.rule.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// allow checks packet against acl rules
+func (s *Server) allow(p Packet, dir string) bool {
+	rules, _ := s.acl.Load().([]*aclRule)
+	for _, r := range rules {
+		if r.match(p) {
+			r.hit(dir)
+			return r.allow
+		}
+	}
+	return true
+}
+
+// ACLStat is acl rule with hits
+type ACLStat struct {
+	*codec.ACLRule
+	HitsIn  uint64 `json:"hits_in"`
+	HitsOut uint64 `json:"hits_out"`
+}
+
+// ACLStats returns acl rules in match order with hits
+func (s *Server) ACLStats() []*ACLStat {
+	rules, _ := s.acl.Load().([]*aclRule)
+	stats := make([]*ACLStat, 0, len(rules))
+	for _, r := range rules {
+		stats = append(stats, &ACLStat{
+			ACLRule: r.rule,
+			HitsIn:  atomic.LoadUint64(&r.hitsIn),
+			HitsOut: atomic.LoadUint64(&r.hitsOut),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// newTestIPv4 returns ipv4 packet of proto with fragment field,
+// transport header carries ports 1000 -> dport
+func newTestIPv4(proto byte, frag uint16, dport uint16) Packet {
+	p := make(Packet, 40)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[6:8], frag)
+	p[9] = proto
+	copy(p[12:16], net.ParseIP("10.0.0.1").To4())
+	copy(p[16:20], net.ParseIP("10.1.0.1").To4())
+	binary.BigEndian.PutUint16(p[20:22], 1000)
+	binary.BigEndian.PutUint16(p[22:24], dport)
+	return p
+}
+
+// newTestIPv6 returns ipv6 packet of proto behind extension headers,
+// every extension header is 8 bytes, fragment header carries frag
+func newTestIPv6(proto byte, exts []byte, frag uint16, dport uint16) Packet {
+	p := make(Packet, 40+len(exts)*8+20)
+	p[0] = 0x60
+	copy(p[8:24], net.ParseIP("fd00::1"))
+	copy(p[24:40], net.ParseIP("fd01::1"))
+
+	next := &p[6]
+	off := 40
+	for _, ext := range exts {
+		*next = ext
+		next = &p[off]
+		if ext == extFragment {
+			binary.BigEndian.PutUint16(p[off+2:off+4], frag)
+		}
+		off += 8
+	}
+	*next = proto
+
+	binary.BigEndian.PutUint16(p[off:off+2], 1000)
+	binary.BigEndian.PutUint16(p[off+2:off+4], dport)
+	return p
+}
+
+func newTestACLServer(t *testing.T, rules ...*codec.ACLRule) *Server {
+	s := &Server{}
+	err := s.SetACL(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestACLFragment(t *testing.T) {
+	s := newTestACLServer(t,
+		&codec.ACLRule{Name: "deny-ssh", Proto: codec.ACLProtoTCP, DstPorts: "22", Action: codec.ACLDeny})
+
+	cases := []struct {
+		name  string
+		p     Packet
+		allow bool
+	}{
+		{"unfragmented", newTestIPv4(protoTCP, 0, 22), false},
+		{"other port", newTestIPv4(protoTCP, 0, 80), true},
+		{"dont fragment", newTestIPv4(protoTCP, 0x4000, 22), false},
+
+		// more fragments, offset 0
+		{"first fragment", newTestIPv4(protoTCP, 0x2000, 22), false},
+		{"first fragment of other port", newTestIPv4(protoTCP, 0x2000, 80), true},
+
+		// ports of non-first fragments are unknown
+		{"non-first fragment", newTestIPv4(protoTCP, 0x2001, 0), false},
+		{"last fragment", newTestIPv4(protoTCP, 0x0001, 0), false},
+		{"non-first fragment of udp", newTestIPv4(protoUDP, 0x2001, 0), true},
+	}
+
+	for _, c := range cases {
+		if allow := s.allow(c.p, aclOut); allow != c.allow {
+			t.Errorf("%s allow %v, expect %v", c.name, allow, c.allow)
+		}
+	}
+}
+
+func TestACLFragmentAllowRule(t *testing.T) {
+	// allow rule with ports never matches packets without ports
+	s := newTestACLServer(t,
+		&codec.ACLRule{Name: "allow-web", Proto: codec.ACLProtoTCP, DstPorts: "80", Action: codec.ACLAllow},
+		&codec.ACLRule{Name: "deny-all", Action: codec.ACLDeny})
+
+	if !s.allow(newTestIPv4(protoTCP, 0x2000, 80), aclOut) {
+		t.Error("first fragment of allowed port denied")
+	}
+
+	if s.allow(newTestIPv4(protoTCP, 0x2001, 0), aclOut) {
+		t.Error("non-first fragment allowed by rule with ports")
+	}
+}
+
+func TestACLIPv6ExtensionHeaders(t *testing.T) {
+	s := newTestACLServer(t,
+		&codec.ACLRule{Name: "deny-ssh", Proto: codec.ACLProtoTCP, DstPorts: "22", Action: codec.ACLDeny})
+
+	cases := []struct {
+		name  string
+		p     Packet
+		allow bool
+	}{
+		{"no extension header", newTestIPv6(protoTCP, nil, 0, 22), false},
+		{"hop by hop", newTestIPv6(protoTCP, []byte{extHopByHop}, 0, 22), false},
+		{"hop by hop and dst options", newTestIPv6(protoTCP, []byte{extHopByHop, extDstOpts}, 0, 22), false},
+		{"hop by hop of other port", newTestIPv6(protoTCP, []byte{extHopByHop}, 0, 80), true},
+		{"udp behind dst options", newTestIPv6(protoUDP, []byte{extDstOpts}, 0, 22), true},
+
+		// fragment header, offset in bits 3-15 and more fragments in bit 0
+		{"first fragment", newTestIPv6(protoTCP, []byte{extFragment}, 0x0001, 22), false},
+		{"first fragment of other port", newTestIPv6(protoTCP, []byte{extFragment}, 0x0001, 80), true},
+		{"non-first fragment", newTestIPv6(protoTCP, []byte{extDstOpts, extFragment}, 0x0008, 0), false},
+	}
+
+	for _, c := range cases {
+		if allow := s.allow(c.p, aclOut); allow != c.allow {
+			t.Errorf("%s allow %v, expect %v", c.name, allow, c.allow)
+		}
+	}
+}
+
+func TestPacketProto(t *testing.T) {
+	p := newTestIPv6(protoICMPv6, []byte{extHopByHop, extRouting, extDstOpts}, 0, 0)
+	if p.Proto() != protoICMPv6 {
+		t.Fatalf("proto %d behind extension headers, expect %d", p.Proto(), protoICMPv6)
+	}
+
+	// truncated extension header
+	p = newTestIPv6(protoTCP, []byte{extHopByHop}, 0, 22)[:44]
+	if _, _, ok := p.Ports(); ok {
+		t.Fatal("ports of truncated packet")
+	}
+}
@@ -1,48 +1,140 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
-	"strings"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/edge/vpc"
+	"github.com/ICKelin/cframe/pkg/ip"
 	log "github.com/ICKelin/cframe/pkg/logs"
 )
 
 type Server struct {
 	registry *Registry
 
-	// secret
-	key string
+	// aead envelope derived from data keys of namespace
+	crypto *Crypto
 
 	// server listen udp address
+	// conn is the first one of conns, used for control packets
 	laddr string
+	conn  *net.UDPConn
+	conns []*net.UDPConn
+
+	// packets to be sent by writer of each udp socket
+	sendQueues []chan *datagram
 
 	// peers connection
+	// key: peer cidr
+	mu        sync.Mutex
 	peerConns map[string]*peerConn
 
+	// longest prefix match table built from peerConns
+	routes *routeTable
+
+	// peer endpoints for nat traversal
+	// key: peer listen address
+	epMu       sync.RWMutex
+	endpoints  map[string]*endpoint
+	publicAddr string
+
+	// counters of endpoints for inbound packets, *peerIndex
+	// rebuilt with epMu held once endpoints changed
+	peers atomic.Value
+
+	// controller relay, nil if disabled
+	relayAddr  *net.UDPAddr
+	relayToken string
+
+	// transport of namespace and listen address of current edge
+	// lock order: epMu, trMu
+	trMu       sync.Mutex
+	transport  string
+	listenAddr string
+
+	// stream transports, see transport.go
+	// key: transport name
+	transports map[string]transport
+	tlsConfig  *tls.Config
+	streamPin  string
+
+	// round robin tun queue of streams
+	streamSeq uint32
+
+	// fec decoders of peers, see fec.go
+	// key: peer listen address if relayed, otherwise udp address
+	fecMu       sync.Mutex
+	fecDecoders map[string]*fecDecoder
+
+	// acl rules, []*aclRule
+	acl atomic.Value
+
+	// compression of packets sent to peers, string
+	// see compress.go
+	compress atomic.Value
+
+	// rate limits in match order, []*rateLimiter
+	// see shaper.go
+	limiters atomic.Value
+
 	// tun device wrap
 	iface *Interface
 
+	// mtu of tun, path mtu of peers is not larger than it
+	mtu int
+
+	// tap mode, ethernet frames are bridged between peers
+	tap    bool
+	bridge *bridge
+
 	vpcInstance vpc.IVPC
 }
 
 type peerConn struct {
-	addr string
-	// conn *net.UDPConn
-	// conn *kcp.UDPSession
-	// conn net.Conn
-	cidr string
+	cidr  string
+	ipnet *net.IPNet
+
+	// next hops sorted by priority
+	nexthops []*nexthop
+
+	// hash flows across alive next hops of the same priority
+	ecmp bool
+}
+
+type nexthop struct {
+	// peer listen address
+	addr     string
+	host     net.IP
+	priority int
+
+	// 1 if peer is down, set by prober, see updateNexthops
+	down int32
+}
+
+func (n *nexthop) alive() bool {
+	return atomic.LoadInt32(&n.down) == 0
 }
 
-func NewServer(laddr, key string, iface *Interface) *Server {
-	return &Server{
-		laddr:     laddr,
-		key:       key,
-		peerConns: make(map[string]*peerConn),
-		iface:     iface,
+func NewServer(laddr string, crypto *Crypto, iface *Interface) *Server {
+	s := &Server{
+		laddr:       laddr,
+		crypto:      crypto,
+		peerConns:   make(map[string]*peerConn),
+		endpoints:   make(map[string]*endpoint),
+		fecDecoders: make(map[string]*fecDecoder),
+		routes:      newRouteTable(),
+		iface:       iface,
+		mtu:         defaultMTU,
+		tap:         iface != nil && iface.IsTAP(),
+		bridge:      newBridge(),
 	}
+	s.transports = newTransports(s)
+	return s
 }
 
 func (s *Server) SetRegistry(r *Registry) {
@@ -55,154 +147,161 @@ func (s *Server) SetVPCInstance(vpcInstance vpc.IVPC) {
 	}
 }
 
+// Close removes routes added by server and close tun device
+func (s *Server) Close() {
+	s.iface.Close()
+}
+
 func (s *Server) ListenAndServe() error {
-	laddr, err := net.ResolveUDPAddr("udp", s.laddr)
-	if err != nil {
-		return err
-	}
-	lconn, err := net.ListenUDP("udp", laddr)
+	err := s.Listen()
 	if err != nil {
 		return err
 	}
-	defer lconn.Close()
 
-	go s.readLocal(lconn)
-	s.readRemote(lconn)
+	s.Serve()
 	return nil
 }
 
-func (s *Server) readRemote(lconn *net.UDPConn) {
-	rawbytes := make([]byte, 1024*64)
-	key := s.key
-	klen := len(key)
-	for {
-		nr, _, err := lconn.ReadFromUDP(rawbytes)
-		if err != nil {
-			log.Error("read full fail: %v", err)
-			continue
-		}
-
-		buf := rawbytes[:nr]
+// Listen creates udp sockets for peers, one for each tun queue,
+// and tls certificate of stream transports.
+// it should be called before registry runs
+// since udp probe is sent from the socket
+func (s *Server) Listen() error {
+	_, laddr, err := codec.ParseListenAddr(s.laddr)
+	if err != nil {
+		return err
+	}
 
-		if nr < klen {
-			log.Error("pkt to small")
-			continue
-		}
+	conns, err := listenUDP(laddr, s.iface.Queues())
+	if err != nil {
+		return err
+	}
 
-		// decode key
-		rkey := buf[:klen]
-		if string(rkey) != key {
-			log.Error("access forbidden!!")
-			continue
-		}
+	s.conn = conns[0]
+	s.conns = conns
+	s.sendQueues = make([]chan *datagram, len(conns))
+	for i := range s.sendQueues {
+		s.sendQueues[i] = make(chan *datagram, sendQueueSize)
+	}
+	return s.initTransports()
+}
 
-		pkt := buf[klen:nr]
-		p := Packet(pkt)
-		if p.Invalid() {
-			log.Error("invalid ipv4 packet")
-			continue
+func (s *Server) Serve() {
+	defer func() {
+		for _, conn := range s.conns {
+			conn.Close()
 		}
+	}()
+
+	go s.probePeers()
+	go s.flushFEC()
+	if s.tap {
+		go s.bridge.age()
+	} else {
+		go s.probeMTU()
+	}
 
-		src := p.Src()
-		dst := p.Dst()
-		log.Debug("tuple %s => %s", src, dst)
-
-		AddTrafficIn(int64(nr))
-		s.iface.Write(pkt)
+	for q := 0; q < s.iface.Queues(); q++ {
+		go s.readLocal(q)
 	}
-}
 
-func (s *Server) readLocal(sock *net.UDPConn) {
-	for {
-		pkt, err := s.iface.Read()
-		if err != nil {
-			log.Error("read iface error: %v", err)
-			continue
+	for i, conn := range s.conns {
+		go s.writeRemote(conn, s.sendQueues[i])
+		if i > 0 {
+			go s.readRemote(conn, i)
 		}
+	}
+	s.readRemote(s.conn, 0)
+}
 
-		p := Packet(pkt)
-		if p.Invalid() {
-			log.Error("invalid ipv4 packet")
-			continue
+func (s *Server) route(p Packet) (string, error) {
+	for n := s.routes.Lookup(p.DstIP()); n != nil; n = n.up {
+		addr := s.nexthop(n.peer, p)
+		if len(addr) > 0 {
+			return addr, nil
 		}
+	}
 
-		AddTrafficOut(int64(len(pkt)))
-		src := p.Src()
-		dst := p.Dst()
-		log.Debug("tuple %s => %s", src, dst)
+	return "", fmt.Errorf("no route")
+}
 
-		peer, err := s.route(dst)
-		if err != nil {
-			log.Error("[E] not route to host: ", dst)
-			continue
+// nexthop selects next hop of peerConn for packet p
+//  1. next hops whose host is dst are ignored
+//  2. alive next hops with the best priority are candidates,
+//     if none alive, next hops with the best priority are used
+//  3. candidates are hashed by flow if ecmp
+//     otherwise the first one is used
+func (s *Server) nexthop(pc *peerConn, p Packet) string {
+	dst := p.DstIP()
+	if len(pc.nexthops) == 1 {
+		if pc.nexthops[0].host.Equal(dst) {
+			return ""
 		}
+		return pc.nexthops[0].addr
+	}
 
-		raddr, err := net.ResolveUDPAddr("udp", peer)
-		if err != nil {
-			log.Error("parse %s fail: %v", peer, err)
+	// next hops are sorted by priority, candidates are alive ones
+	// of the best priority, or all of the best priority if none alive
+	first, count, alive := -1, 0, false
+	for i, n := range pc.nexthops {
+		if n.host.Equal(dst) {
 			continue
 		}
 
-		// encode key
-		buf := make([]byte, 0, len(pkt)+len(s.key))
-		buf = append(buf, []byte(s.key)...)
-		buf = append(buf, pkt...)
-		_, e := sock.WriteToUDP(buf, raddr)
-		if e != nil {
-			log.Error("%v", e)
+		up := n.alive()
+		switch {
+		case first < 0 || (up && !alive):
+			first, count, alive = i, 1, up
+		case up == alive && n.priority == pc.nexthops[first].priority:
+			count += 1
 		}
 	}
-}
 
-func (s *Server) route(dst string) (string, error) {
-	for _, p := range s.peerConns {
-		_, ipnet, err := net.ParseCIDR(p.cidr)
-		if err != nil {
-			log.Error("parse cidr fail: %v", err)
-			continue
-		}
+	if count == 0 {
+		return ""
+	}
 
-		sp := strings.Split(p.cidr, "/")
-		if len(sp) != 2 {
-			log.Error("parse cidr fail: %v", err)
-			continue
-		}
+	k := 0
+	if pc.ecmp {
+		k = int(p.FlowHash() % uint32(count))
+	}
 
-		dstCidr := fmt.Sprintf("%s/%s", dst, sp[1])
-		_, dstNet, err := net.ParseCIDR(dstCidr)
-		if err != nil {
-			log.Error("parse cidr fail: %v", err)
+	for _, n := range pc.nexthops[first:] {
+		if n.host.Equal(dst) || n.alive() != alive || n.priority != pc.nexthops[first].priority {
 			continue
 		}
 
-		if ipnet.String() == dstNet.String() {
-			// ignore peer ip address
-			ip, _, _ := net.SplitHostPort(p.addr)
-			if ip == dst {
-				continue
-			}
-
-			return p.addr, nil
+		if k == 0 {
+			return n.addr
 		}
+		k -= 1
 	}
 
-	return "", fmt.Errorf("no route")
+	// liveness changed meanwhile
+	return pc.nexthops[first].addr
 }
 
-func (s *Server) addRoute(peer *codec.Edge) error {
-	log.Info("adding peer: %v", peer)
+func (s *Server) addRoute(cidr string, nexthops []*codec.Nexthop, ecmp bool) error {
+	log.Info("adding route %s via %s", cidr, codec.FormatNexthops(nexthops))
 
-	ipmask := strings.Split(peer.Cidr, "/")
-	cidrtype := "-net"
-	if len(ipmask) == 1 || ipmask[1] == "32" {
-		cidrtype = "-host"
+	if len(nexthops) == 0 {
+		err := fmt.Errorf("route %s without nexthop", cidr)
+		AddErrorLog(err)
+		return err
+	}
+
+	ipnet, err := ip.ParseCIDR(cidr)
+	if err != nil {
+		log.Error("parse cidr %s fail: %v", cidr, err)
+		AddErrorLog(err)
+		return err
 	}
 
 	// add vpc route
 	if s.vpcInstance != nil {
 		// add vpc route entry
 		// route to current instance
-		err := s.vpcInstance.CreateRoute(peer.Cidr)
+		err := s.vpcInstance.CreateRoute(cidr)
 		if err != nil {
 			log.Error("create vpc route fail: %v", err)
 			AddErrorLog(err)
@@ -211,78 +310,121 @@ func (s *Server) addRoute(peer *codec.Edge) error {
 	}
 
 	// add local static route
-	execCmd("route", []string{"del", cidrtype,
-		peer.Cidr, "dev", s.iface.tun.Name()})
-
-	out, err := execCmd("route", []string{"add", cidrtype,
-		peer.Cidr, "dev", s.iface.tun.Name()})
+	err = s.iface.AddRoute(ipnet)
 	if err != nil {
-		log.Error("route add %s %s dev %s, %s %v\n",
-			peer.Cidr, cidrtype, s.iface.tun.Name(), out, err)
+		log.Error("add route %s dev %s fail: %v",
+			ipnet, s.iface.tun.Name(), err)
 		AddErrorLog(err)
 		return err
 	}
 
 	// add memory route
-	if cidrtype == "-host" {
-		peer.Cidr = fmt.Sprintf("%s/32", ipmask[0])
+	// key by network address so that 10.0.0.1/24
+	// and 10.0.0.0/24 are the same route
+	key := ipnet.String()
+	pc := &peerConn{
+		cidr:  key,
+		ipnet: ipnet,
+		ecmp:  ecmp,
 	}
-
-	s.peerConns[peer.Cidr] = &peerConn{
-		addr: peer.ListenAddr,
-		cidr: peer.Cidr,
+	for _, n := range nexthops {
+		host, _, _ := net.SplitHostPort(n.Addr)
+		pc.nexthops = append(pc.nexthops, &nexthop{
+			addr:     n.Addr,
+			host:     net.ParseIP(host),
+			priority: n.Priority,
+		})
 	}
+	sort.SliceStable(pc.nexthops, func(i, j int) bool {
+		return pc.nexthops[i].priority < pc.nexthops[j].priority
+	})
+
+	s.mu.Lock()
+	s.peerConns[key] = pc
+	s.routes.Rebuild(s.peerConns)
+	routeTableSize.Set(float64(len(s.peerConns)))
+	s.mu.Unlock()
+	s.updateNexthops()
 
-	log.Info("added peer %v OK", peer)
+	log.Info("added route %s OK", key)
 	log.Info("==========================\n")
 	return nil
 }
 
-func (s *Server) delRoute(peer *codec.Edge) {
-	log.Info("del peer: %v", peer)
-	ipmask := strings.Split(peer.Cidr, "/")
-	cidrtype := "-net"
-	if len(ipmask) == 1 || ipmask[1] == "32" {
-		cidrtype = "-host"
+func (s *Server) delRoute(cidr string) {
+	log.Info("del route: %s", cidr)
+	ipnet, err := ip.ParseCIDR(cidr)
+	if err != nil {
+		log.Error("parse cidr %s fail: %v", cidr, err)
+		return
 	}
-	out, err := execCmd("route", []string{"del", cidrtype,
-		peer.Cidr, "dev", s.iface.tun.Name()})
-	log.Info("route del %s %s dev %s, %s %v",
-		cidrtype, peer.Cidr, s.iface.tun.Name(), out, err)
 
-	if cidrtype == "-host" {
-		peer.Cidr = fmt.Sprintf("%s/32", ipmask[0])
+	err = s.iface.DelRoute(ipnet)
+	if err != nil {
+		log.Error("del route %s dev %s fail: %v",
+			ipnet, s.iface.tun.Name(), err)
+		AddErrorLog(err)
 	}
 
-	delete(s.peerConns, peer.Cidr)
-	log.Info("del peer %s OK", peer)
+	s.mu.Lock()
+	delete(s.peerConns, ipnet.String())
+	s.routes.Rebuild(s.peerConns)
+	routeTableSize.Set(float64(len(s.peerConns)))
+	s.mu.Unlock()
+	log.Info("del route %s OK", cidr)
 	log.Info("==========================\n")
 }
 
 func (s *Server) AddPeers(peers []*codec.Edge) {
 	for _, p := range peers {
-		s.addRoute(p)
+		s.AddPeer(p)
 	}
 }
 
 func (s *Server) AddPeer(peer *codec.Edge) {
-	s.addRoute(peer)
+	// peers are bridged instead of routed in tap mode
+	if s.tap {
+		s.bridge.addPeer(peer.ListenAddr)
+		s.setEndpoint(peer.ListenAddr, peer.PublicAddr)
+		s.setFEC(peer.ListenAddr, peer.FEC)
+		return
+	}
+
+	s.addRoute(peer.Cidr, []*codec.Nexthop{{Addr: peer.ListenAddr}}, false)
+	s.setEndpoint(peer.ListenAddr, peer.PublicAddr)
+	s.setFEC(peer.ListenAddr, peer.FEC)
 }
 
 func (s *Server) DelPeer(peer *codec.Edge) {
-	s.delRoute(peer)
+	if s.tap {
+		s.bridge.delPeer(peer.ListenAddr)
+		s.delEndpoint(peer.ListenAddr)
+		return
+	}
+
+	s.delRoute(peer.Cidr)
+	s.delEndpoint(peer.ListenAddr)
 }
 
 func (s *Server) AddRoute(msg *codec.AddRouteMsg) {
-	s.addRoute(&codec.Edge{
-		Cidr:       msg.Cidr,
-		ListenAddr: msg.Nexthop,
-	})
+	if s.tap {
+		log.Warn("ignore route %s in tap mode", msg.Cidr)
+		return
+	}
+
+	nexthops := msg.NextHops()
+	s.addRoute(msg.Cidr, nexthops, msg.ECMP)
+
+	// probe next hops for failover
+	for _, n := range nexthops {
+		s.setEndpoint(n.Addr, "")
+	}
 }
 
 func (s *Server) DelRoute(msg *codec.DelRouteMsg) {
-	s.delRoute(&codec.Edge{
-		Cidr:       msg.Cidr,
-		ListenAddr: msg.Nexthop,
-	})
+	if s.tap {
+		return
+	}
+
+	s.delRoute(msg.Cidr)
 }
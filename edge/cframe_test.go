@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestPeerConn(ecmp bool, addrs ...string) *peerConn {
+	pc := &peerConn{ecmp: ecmp}
+	for i, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		pc.nexthops = append(pc.nexthops, &nexthop{
+			addr:     addr,
+			host:     net.ParseIP(host),
+			priority: i / 2,
+		})
+	}
+	return pc
+}
+
+// newTestPacket returns ipv4 udp packet from src to dst
+func newTestPacket(src, dst string, sport int) Packet {
+	p := make(Packet, 28)
+	p[0] = 0x45
+	p[9] = 17
+	copy(p[12:16], net.ParseIP(src).To4())
+	copy(p[16:20], net.ParseIP(dst).To4())
+	p[20], p[21] = byte(sport>>8), byte(sport)
+	return p
+}
+
+func setDown(pc *peerConn, addrs ...string) {
+	for _, n := range pc.nexthops {
+		atomic.StoreInt32(&n.down, 0)
+		for _, addr := range addrs {
+			if n.addr == addr {
+				atomic.StoreInt32(&n.down, 1)
+			}
+		}
+	}
+}
+
+func TestNexthopFailover(t *testing.T) {
+	s := &Server{}
+	// priority 0: a, b; priority 1: c, d
+	pc := newTestPeerConn(false, "1.0.0.1:1", "1.0.0.2:1", "1.0.0.3:1", "1.0.0.4:1")
+	p := newTestPacket("10.0.0.1", "10.1.0.1", 1000)
+
+	cases := []struct {
+		down   []string
+		expect string
+	}{
+		{nil, "1.0.0.1:1"},
+		{[]string{"1.0.0.1:1"}, "1.0.0.2:1"},
+		{[]string{"1.0.0.1:1", "1.0.0.2:1"}, "1.0.0.3:1"},
+		{[]string{"1.0.0.1:1", "1.0.0.2:1", "1.0.0.3:1"}, "1.0.0.4:1"},
+
+		// all down, fallback to the best priority
+		{[]string{"1.0.0.1:1", "1.0.0.2:1", "1.0.0.3:1", "1.0.0.4:1"}, "1.0.0.1:1"},
+	}
+
+	for _, c := range cases {
+		setDown(pc, c.down...)
+		if addr := s.nexthop(pc, p); addr != c.expect {
+			t.Errorf("down %v got %s, expect %s", c.down, addr, c.expect)
+		}
+	}
+
+	// next hop is the destination itself
+	setDown(pc)
+	if addr := s.nexthop(pc, newTestPacket("10.0.0.1", "1.0.0.1", 1000)); addr != "1.0.0.2:1" {
+		t.Errorf("packet to next hop got %s, expect 1.0.0.2:1", addr)
+	}
+}
+
+func TestNexthopECMP(t *testing.T) {
+	s := &Server{}
+	pc := newTestPeerConn(true, "1.0.0.1:1", "1.0.0.2:1", "1.0.0.3:1", "1.0.0.4:1")
+
+	used := func() map[string]bool {
+		used := make(map[string]bool)
+		for port := 0; port < 256; port++ {
+			used[s.nexthop(pc, newTestPacket("10.0.0.1", "10.1.0.1", port))] = true
+		}
+		return used
+	}
+
+	if u := used(); len(u) != 2 || !u["1.0.0.1:1"] || !u["1.0.0.2:1"] {
+		t.Fatalf("flows hashed to %v, expect next hops of priority 0", u)
+	}
+
+	setDown(pc, "1.0.0.1:1")
+	if u := used(); len(u) != 1 || !u["1.0.0.2:1"] {
+		t.Fatalf("flows hashed to %v, expect alive next hop of priority 0", u)
+	}
+
+	setDown(pc, "1.0.0.1:1", "1.0.0.2:1")
+	if u := used(); len(u) != 2 || !u["1.0.0.3:1"] || !u["1.0.0.4:1"] {
+		t.Fatalf("flows hashed to %v, expect next hops of priority 1", u)
+	}
+}
+
+func TestNexthopAllocs(t *testing.T) {
+	s := &Server{}
+	pc := newTestPeerConn(true, "1.0.0.1:1", "1.0.0.2:1", "1.0.0.3:1")
+	setDown(pc, "1.0.0.1:1")
+	p := newTestPacket("10.0.0.1", "10.1.0.1", 1000)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		s.nexthop(pc, p)
+	})
+
+	if allocs != 0 {
+		t.Fatalf("nexthop allocates %v times", allocs)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+// payload compression between edges
+// packets are compressed before sealed if compression is
+// enabled in namespace. compressed packets are flagged by
+// version of envelope, so packets that do not shrink are
+// sent raw and edges open both whatever they send.
+
+import (
+	"fmt"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// packets smaller than it are sent raw
+const compressMinSize = 64
+
+type compressor interface {
+	// compress writes src to dst and returns bytes written,
+	// 0 if src does not shrink
+	compress(dst, src []byte) int
+
+	// decompress writes src to dst and returns bytes written
+	decompress(dst, src []byte) (int, error)
+}
+
+// key: version of envelope
+var compressors = map[byte]compressor{
+	cryptoVersionLZ4:  lz4Compressor{},
+	cryptoVersionZstd: newZstdCompressor(),
+}
+
+// version of envelope of compression
+var compressVersions = map[string]byte{
+	codec.CompressLZ4:  cryptoVersionLZ4,
+	codec.CompressZstd: cryptoVersionZstd,
+}
+
+type lz4Compressor struct{}
+
+func (lz4Compressor) compress(dst, src []byte) int {
+	n, err := lz4.CompressBlock(src, dst, nil)
+	if err != nil || n >= len(src) {
+		return 0
+	}
+	return n
+}
+
+func (lz4Compressor) decompress(dst, src []byte) (int, error) {
+	return lz4.UncompressBlock(src, dst)
+}
+
+// zstd encoder and decoder are safe for concurrent
+// EncodeAll and DecodeAll
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	// packets are authenticated by envelope, no crc required
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithEncoderCRC(false),
+		zstd.WithLowerEncoderMem(true))
+	if err != nil {
+		panic(err)
+	}
+
+	decoder, err := zstd.NewReader(nil,
+		zstd.WithDecoderMaxMemory(bufSize),
+		zstd.IgnoreChecksum(true))
+	if err != nil {
+		panic(err)
+	}
+	return &zstdCompressor{encoder: encoder, decoder: decoder}
+}
+
+func (c *zstdCompressor) compress(dst, src []byte) int {
+	out := c.encoder.EncodeAll(src, dst[:0])
+	if len(out) >= len(src) || len(out) > len(dst) {
+		return 0
+	}
+	return len(out)
+}
+
+func (c *zstdCompressor) decompress(dst, src []byte) (int, error) {
+	out, err := c.decoder.DecodeAll(src, dst[:0])
+	if err != nil {
+		return 0, err
+	}
+	if len(out) > len(dst) {
+		return 0, fmt.Errorf("decompressed packet too large")
+	}
+	return len(out), nil
+}
+
+// SetCompress sets compression of packets sent to peers,
+// disabled if empty
+func (s *Server) SetCompress(compress string) {
+	if len(compress) > 0 && compressVersions[compress] == 0 {
+		log.Error("unsupported compress %s, disabled", compress)
+		compress = ""
+	}
+
+	if len(compress) > 0 {
+		log.Info("compress packets to peers with %s", compress)
+	}
+	s.compress.Store(compress)
+}
+
+// compressPacket compresses packet of nr bytes at buf[cryptoHeaderLen:]
+// returns buffer and size of packet to be sealed with version.
+// buf is returned to pool if packet is compressed
+func (s *Server) compressPacket(buf *[]byte, nr int) (*[]byte, int, byte) {
+	compress, _ := s.compress.Load().(string)
+	if len(compress) == 0 || nr < compressMinSize {
+		return buf, nr, cryptoVersion
+	}
+
+	version := compressVersions[compress]
+	out := getBuf()
+	n := compressors[version].compress((*out)[cryptoHeaderLen:bufSize-s.crypto.Overhead()],
+		(*buf)[cryptoHeaderLen:cryptoHeaderLen+nr])
+	if n == 0 {
+		putBuf(out)
+		incompressiblePackets.Inc()
+		AddCompress(int64(nr), int64(nr))
+		compressInBytes.Add(float64(nr))
+		compressOutBytes.Add(float64(nr))
+		return buf, nr, cryptoVersion
+	}
+
+	putBuf(buf)
+	AddCompress(int64(nr), int64(n))
+	compressInBytes.Add(float64(nr))
+	compressOutBytes.Add(float64(n))
+	return out, n, version
+}
+
+// decompress returns packet opened from envelope of version,
+// buffer holding decompressed packet is returned to pool
+// by caller if not nil
+func decompress(version byte, pkt []byte) ([]byte, *[]byte, error) {
+	c := compressors[version]
+	if c == nil {
+		return pkt, nil, nil
+	}
+
+	buf := getBuf()
+	n, err := c.decompress(*buf, pkt)
+	if err != nil {
+		putBuf(buf)
+		return nil, nil, err
+	}
+	return (*buf)[:n], buf, nil
+}
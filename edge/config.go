@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// controller closes connection of edge without any
+// message in 30 seconds, heartbeat must be sent in time
+const maxHeartbeatInterval = 29
+
+// Config of edge, settings are loaded from defaults,
+// config file, env vars and flags, the later overrides
+type Config struct {
+	// controllers are tried in order until connected
+	// controller is single one of older config
+	Controllers []string `toml:"controllers"`
+	Controller  string   `toml:"controller"`
+	Namespace   string   `toml:"namespace"`
+	Secret      string   `toml:"secret"`
+	Name        string   `toml:"name"`
+	ListenAddr  string   `toml:"listen_addr"`
+
+	// prometheus metrics, disabled if empty
+	MetricsAddr string `toml:"metrics_addr"`
+
+	// local status api
+	StatusSock string `toml:"status_sock"`
+
+	Tun   Tun           `toml:"tun"`
+	TLS   TLS           `toml:"tls"`
+	Stats StatsInterval `toml:"stats"`
+	Log   Log           `toml:"log"`
+}
+
+// Tun for data plane
+type Tun struct {
+	// cframe.N is used if empty
+	Name string `toml:"name"`
+
+	// tun routes ip packets, tap bridges ethernet frames
+	Mode string `toml:"mode"`
+
+	// tun queues and udp sockets for packet pipeline
+	Queues int `toml:"queues"`
+
+	// path mtu of peers is probed up to it
+	MTU int `toml:"mtu"`
+
+	// optional tun address
+	Address string `toml:"address"`
+
+	// routing table and metric for cframe routes
+	RouteTable  int `toml:"route_table"`
+	RouteMetric int `toml:"route_metric"`
+}
+
+// TLS to controller
+// enabled if enable is set or any of ca, pin and cert is set
+type TLS struct {
+	Enable bool   `toml:"enable"`
+	CA     string `toml:"ca"`
+	Pin    string `toml:"pin"`
+	Cert   string `toml:"cert"`
+	Key    string `toml:"key"`
+
+	// host of controller is used if empty
+	ServerName string `toml:"server_name"`
+}
+
+// StatsInterval of heartbeat and report in seconds
+type StatsInterval struct {
+	HeartbeatInterval int `toml:"heartbeat_interval"`
+	ReportInterval    int `toml:"report_interval"`
+}
+
+type Log struct {
+	Level string `toml:"level"`
+	Path  string `toml:"path"`
+	Days  int64  `toml:"days"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Namespace:  "default",
+		ListenAddr: ":58423",
+		StatusSock: defaultStatusSock,
+		Tun: Tun{
+			Mode:        modeTUN,
+			Queues:      1,
+			MTU:         defaultMTU,
+			RouteTable:  defaultRouteTable,
+			RouteMetric: defaultRouteMetric,
+		},
+		Stats: StatsInterval{
+			HeartbeatInterval: 10,
+			ReportInterval:    30,
+		},
+		Log: Log{
+			Level: "info",
+			Path:  "edge.log",
+			Days:  3,
+		},
+	}
+}
+
+// ParseConfig returns default config if path is empty
+func ParseConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if len(path) == 0 {
+		return cfg, nil
+	}
+
+	cnt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = toml.Unmarshal(cnt, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Controllers) == 0 && len(cfg.Controller) > 0 {
+		cfg.Controllers = []string{cfg.Controller}
+	}
+	return cfg, nil
+}
+
+// setting is a config field set by env var and flag of the same name,
+// name is path of toml key joined by "_", eg: tun_mtu for mtu of [tun]
+type setting struct {
+	name  string
+	usage string
+	value interface{}
+}
+
+func (st *setting) set(v string) error {
+	switch p := st.value.(type) {
+	case *string:
+		*p = v
+	case *[]string:
+		*p = splitList(v)
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", st.name, v)
+		}
+		*p = n
+	case *int64:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", st.name, v)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", st.name, v)
+		}
+		*p = b
+	}
+	return nil
+}
+
+func (c *Config) settings() []*setting {
+	return []*setting{
+		{"controllers", "controller addresses, separated by comma", &c.Controllers},
+		{"namespace", "namespace", &c.Namespace},
+		{"secret", "secret of namespace", &c.Secret},
+		{"name", "edge name", &c.Name},
+		{"listen_addr", "listen address of data plane", &c.ListenAddr},
+		{"metrics_addr", "prometheus metrics address", &c.MetricsAddr},
+		{"status_sock", "local status api socket", &c.StatusSock},
+
+		{"tun_name", "tun device name", &c.Tun.Name},
+		{"tun_mode", "tun or tap", &c.Tun.Mode},
+		{"tun_queues", "tun queues and udp sockets", &c.Tun.Queues},
+		{"tun_mtu", "tun mtu", &c.Tun.MTU},
+		{"tun_address", "tun address", &c.Tun.Address},
+		{"tun_route_table", "routing table of cframe routes", &c.Tun.RouteTable},
+		{"tun_route_metric", "metric of cframe routes", &c.Tun.RouteMetric},
+
+		{"tls_enable", "tls to controller", &c.TLS.Enable},
+		{"tls_ca", "ca of controller", &c.TLS.CA},
+		{"tls_pin", "pin of controller certificate", &c.TLS.Pin},
+		{"tls_cert", "client certificate", &c.TLS.Cert},
+		{"tls_key", "client key", &c.TLS.Key},
+		{"tls_server_name", "server name of controller", &c.TLS.ServerName},
+
+		{"stats_heartbeat_interval", "heartbeat interval in seconds", &c.Stats.HeartbeatInterval},
+		{"stats_report_interval", "report interval in seconds", &c.Stats.ReportInterval},
+
+		{"log_level", "log level", &c.Log.Level},
+		{"log_path", "log path", &c.Log.Path},
+		{"log_days", "days of logs kept", &c.Log.Days},
+	}
+}
+
+// env vars of older edge, key: env var, value: setting
+var legacyEnv = map[string]string{
+	"controller": "controllers",
+	"listen":     "listen_addr",
+	"LOG_LEVEL":  "log_level",
+}
+
+// flagValue keeps flag set in command line,
+// applied after config file and env vars
+type flagValue struct {
+	value string
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+
+// LoadConfig loads config file of -c, overrides it by env vars
+// and flags set in command line
+func LoadConfig(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flgConf := fs.String("c", "", "config file path")
+	for _, st := range defaultConfig().settings() {
+		fs.Var(&flagValue{}, st.name, st.usage)
+	}
+
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := ParseConfig(*flgConf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cfg.loadEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settings := make(map[string]*setting)
+	for _, st := range cfg.settings() {
+		settings[st.name] = st
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if st := settings[f.Name]; st != nil && err == nil {
+			err = st.set(f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadEnv overrides config by env vars for container use
+func (c *Config) loadEnv() error {
+	settings := make(map[string]*setting)
+	for _, st := range c.settings() {
+		settings[st.name] = st
+	}
+
+	for env, name := range legacyEnv {
+		if v := os.Getenv(env); len(v) > 0 {
+			err := settings[name].set(v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, st := range settings {
+		if v := os.Getenv(name); len(v) > 0 {
+			err := st.set(v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks required settings and ranges
+func (c *Config) Verify() error {
+	if len(c.Controllers) == 0 {
+		return fmt.Errorf("no controller configured")
+	}
+
+	if len(c.Secret) == 0 {
+		return fmt.Errorf("invalid secret")
+	}
+
+	if len(c.Namespace) == 0 {
+		c.Namespace = "default"
+	}
+
+	if c.Tun.Mode != modeTUN && c.Tun.Mode != modeTAP {
+		return fmt.Errorf("unsupported mode %s", c.Tun.Mode)
+	}
+
+	if c.Tun.Queues <= 0 {
+		return fmt.Errorf("invalid queues %d", c.Tun.Queues)
+	}
+
+	if c.Tun.MTU < minPMTU || c.Tun.MTU > maxMTU {
+		return fmt.Errorf("invalid mtu %d", c.Tun.MTU)
+	}
+
+	if c.Stats.HeartbeatInterval <= 0 || c.Stats.HeartbeatInterval > maxHeartbeatInterval {
+		return fmt.Errorf("heartbeat interval should be 1-%d seconds", maxHeartbeatInterval)
+	}
+
+	if c.Stats.ReportInterval <= 0 {
+		return fmt.Errorf("invalid report interval %d", c.Stats.ReportInterval)
+	}
+	return nil
+}
+
+// TLSEnabled reports whether tls to controller is enabled
+func (c *Config) TLSEnabled() bool {
+	return c.TLS.Enable || len(c.TLS.CA)+len(c.TLS.Pin)+len(c.TLS.Cert) > 0
+}
+
+func (c *Config) String() string {
+	// do not log secrets
+	cfg := *c
+	cfg.Secret = "***"
+	b, _ := json.MarshalIndent(&cfg, "", "\t")
+	return string(b)
+}
+
+// splitList splits comma separated list
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
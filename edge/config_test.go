@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeTestConfig(t, `
+namespace = "file"
+name = "file"
+listen_addr = ":1000"
+secret = "file"
+
+[tun]
+mtu = 1300
+queues = 2
+
+[log]
+level = "debug"
+`)
+
+	// env overrides file, flags override env
+	t.Setenv("name", "env")
+	t.Setenv("listen_addr", ":2000")
+	t.Setenv("tun_mtu", "1200")
+	t.Setenv("log_level", "warn")
+
+	cfg, args, err := LoadConfig([]string{"edge", "-c", path,
+		"-listen_addr", ":3000", "-tun_mtu", "1100", "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(args) != 1 || args[0] != "status" {
+		t.Fatalf("args %v, expect [status]", args)
+	}
+
+	def := defaultConfig()
+	cases := []struct {
+		name        string
+		got, expect interface{}
+	}{
+		// defaults
+		{"status_sock", cfg.StatusSock, def.StatusSock},
+		{"tun_route_table", cfg.Tun.RouteTable, def.Tun.RouteTable},
+		{"log_path", cfg.Log.Path, def.Log.Path},
+
+		// file
+		{"namespace", cfg.Namespace, "file"},
+		{"secret", cfg.Secret, "file"},
+		{"tun_queues", cfg.Tun.Queues, 2},
+
+		// env
+		{"name", cfg.Name, "env"},
+		{"log_level", cfg.Log.Level, "warn"},
+
+		// flags
+		{"listen_addr", cfg.ListenAddr, ":3000"},
+		{"tun_mtu", cfg.Tun.MTU, 1100},
+	}
+
+	for _, c := range cases {
+		if c.got != c.expect {
+			t.Errorf("%s got %v, expect %v", c.name, c.got, c.expect)
+		}
+	}
+}
+
+func settingValue(st *setting) string {
+	return fmt.Sprint(reflect.ValueOf(st.value).Elem().Interface())
+}
+
+func TestLoadConfigNames(t *testing.T) {
+	// every setting is set by flag of its name
+	for _, st := range defaultConfig().settings() {
+		value := "7"
+		if st.name == "tls_enable" {
+			value = "true"
+		}
+
+		cfg, _, err := LoadConfig([]string{"edge", "-" + st.name, value})
+		if err != nil {
+			t.Fatalf("flag %s fail: %v", st.name, err)
+		}
+
+		def := defaultConfig()
+		for i, v := range cfg.settings() {
+			changed := settingValue(v) != settingValue(def.settings()[i])
+			if changed != (v.name == st.name) {
+				t.Errorf("flag %s changed %s", st.name, v.name)
+			}
+		}
+	}
+}
+
+func TestLoadConfigLegacyEnv(t *testing.T) {
+	t.Setenv("controller", "10.0.0.1:58422,10.0.0.2:58422")
+	t.Setenv("listen", ":4000")
+	t.Setenv("LOG_LEVEL", "error")
+
+	cfg, _, err := LoadConfig([]string{"edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Controllers) != 2 || cfg.ListenAddr != ":4000" || cfg.Log.Level != "error" {
+		t.Fatalf("legacy env not loaded: %v %s %s", cfg.Controllers, cfg.ListenAddr, cfg.Log.Level)
+	}
+
+	// new name wins
+	t.Setenv("listen_addr", ":5000")
+	cfg, _, err = LoadConfig([]string{"edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ListenAddr != ":5000" {
+		t.Fatalf("listen_addr %s, expect :5000", cfg.ListenAddr)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, _, err := LoadConfig([]string{"edge", "-tun_mtu", "abc"})
+	if err == nil {
+		t.Fatal("invalid flag accepted")
+	}
+
+	t.Setenv("tun_queues", "abc")
+	_, _, err = LoadConfig([]string{"edge"})
+	if err == nil {
+		t.Fatal("invalid env accepted")
+	}
+}
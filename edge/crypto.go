@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// datagram envelope between edges
+// | 1byte ver | 1byte key id | 8bytes session | 8bytes counter | ciphertext | 16bytes tag |
+//
+// every edge process picks a random session id on startup,
+// the aead key of a session is derived from data key of
+// namespace and session id, so nonce(counter) never repeats
+// under one key even though all edges of a namespace share
+// the same data key. header is authenticated as additional data.
+//
+// data key 0 is derived from namespace secret, controller rolls
+// data key of namespace and edges accept packets sealed by any
+// of the keys deployed while sealing by the active one.
+const (
+	cryptoVersion   = 0x01
+	cryptoHeaderLen = 1 + 1 + 8 + 8
+
+	// tag of aes-gcm
+	cryptoTagLen = 16
+
+	// padded path mtu probes, see pmtu.go
+	cryptoVersionProbe = 0x03
+
+	// compressed packets, see compress.go
+	cryptoVersionLZ4  = 0x04
+	cryptoVersionZstd = 0x05
+
+	// replay window size in packets
+	replayWindowSize = 1024
+
+	// sessions idle longer than this are dropped
+	sessionIdleTimeout = time.Minute * 10
+	maxSessions        = 1024
+)
+
+type Crypto struct {
+	secret []byte
+
+	// master keys of data keys
+	// key: key id
+	keyMu   sync.RWMutex
+	masters map[uint8][]byte
+
+	// pending activation of data key, see SetKeys
+	activateGen uint64
+
+	// local session for outgoing packets
+	// sendMaster is master key of sendKeyID, id may be
+	// reused by controller with another key
+	sendMu      sync.Mutex
+	sendKeyID   uint8
+	sendMaster  []byte
+	sendSession uint64
+	sendCounter uint64
+	sendAEAD    cipher.AEAD
+
+	// remote sessions for incoming packets
+	recvMu       sync.Mutex
+	recvSessions map[sessionKey]*recvSession
+
+	// top counter of evicted sessions, packets at or below
+	// it are replays once the window of session is lost.
+	// marks of removed keys are dropped by SetKeys
+	evicted map[sessionKey]uint64
+}
+
+type sessionKey struct {
+	keyID   uint8
+	session uint64
+}
+
+type recvSession struct {
+	aead     cipher.AEAD
+	window   replayWindow
+	lastSeen time.Time
+}
+
+func NewCrypto(secret string) (*Crypto, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+
+	c := &Crypto{
+		secret:       []byte(secret),
+		masters:      map[uint8][]byte{0: masterKey([]byte(secret))},
+		recvSessions: make(map[sessionKey]*recvSession),
+		evicted:      make(map[sessionKey]uint64),
+	}
+
+	c.sendMu.Lock()
+	err := c.rekey()
+	c.sendMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Overhead returns bytes added to every packet by Seal
+func (c *Crypto) Overhead() int {
+	return cryptoHeaderLen + cryptoTagLen
+}
+
+// Seal encrypts pkt and returns the datagram
+// to be sent to peer edge
+func (c *Crypto) Seal(pkt []byte) ([]byte, error) {
+	buf := make([]byte, cryptoHeaderLen+len(pkt), cryptoHeaderLen+len(pkt)+cryptoTagLen)
+	copy(buf[cryptoHeaderLen:], pkt)
+	return c.SealInPlace(buf)
+}
+
+// SealProbe encrypts path mtu probe
+func (c *Crypto) SealProbe(pkt []byte) ([]byte, error) {
+	buf := make([]byte, cryptoHeaderLen+len(pkt), cryptoHeaderLen+len(pkt)+cryptoTagLen)
+	copy(buf[cryptoHeaderLen:], pkt)
+	return c.seal(cryptoVersionProbe, buf)
+}
+
+// SealInPlace encrypts packet at buf[cryptoHeaderLen:]
+// header room is reserved by caller and cap of buf
+// should hold the tag, so no allocation in data path
+func (c *Crypto) SealInPlace(buf []byte) ([]byte, error) {
+	return c.seal(cryptoVersion, buf)
+}
+
+// SealInPlaceVersion is SealInPlace with version
+// flagging compressed packet
+func (c *Crypto) SealInPlaceVersion(version byte, buf []byte) ([]byte, error) {
+	return c.seal(version, buf)
+}
+
+func (c *Crypto) seal(version byte, buf []byte) ([]byte, error) {
+	if len(buf) < cryptoHeaderLen {
+		return nil, fmt.Errorf("no header room")
+	}
+
+	c.sendMu.Lock()
+	if c.sendCounter == ^uint64(0) {
+		err := c.rekey()
+		if err != nil {
+			c.sendMu.Unlock()
+			return nil, err
+		}
+	}
+	c.sendCounter += 1
+	keyID, session, counter, aead := c.sendKeyID, c.sendSession, c.sendCounter, c.sendAEAD
+	c.sendMu.Unlock()
+
+	buf[0] = version
+	buf[1] = keyID
+	binary.BigEndian.PutUint64(buf[2:10], session)
+	binary.BigEndian.PutUint64(buf[10:18], counter)
+
+	hdr, pkt := buf[:cryptoHeaderLen], buf[cryptoHeaderLen:]
+	return aead.Seal(hdr, nonce(counter), pkt, hdr), nil
+}
+
+// Open verifies and decrypts datagram from peer edge in place
+// returns plaintext ip packet which shares memory with buf
+func (c *Crypto) Open(buf []byte) ([]byte, error) {
+	if len(buf) < cryptoHeaderLen+cryptoTagLen {
+		return nil, fmt.Errorf("pkt too small")
+	}
+
+	switch buf[0] {
+	case cryptoVersion, cryptoVersionProbe, cryptoVersionLZ4, cryptoVersionZstd:
+	default:
+		return nil, fmt.Errorf("unsupported version %d", buf[0])
+	}
+
+	key := sessionKey{
+		keyID:   buf[1],
+		session: binary.BigEndian.Uint64(buf[2:10]),
+	}
+	counter := binary.BigEndian.Uint64(buf[10:18])
+
+	c.recvMu.Lock()
+	sess := c.recvSessions[key]
+	replayed := sess != nil && !sess.window.Check(counter)
+	if sess == nil {
+		top, ok := c.evicted[key]
+		replayed = ok && counter <= top
+	}
+	c.recvMu.Unlock()
+	if replayed {
+		return nil, fmt.Errorf("replayed packet, session %x counter %d", key.session, counter)
+	}
+
+	var aead cipher.AEAD
+	if sess != nil {
+		aead = sess.aead
+	} else {
+		var err error
+		aead, err = c.newAEAD(key.keyID, key.session)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// decrypt without lock, readers run in parallel
+	hdr, ciphertext := buf[:cryptoHeaderLen], buf[cryptoHeaderLen:]
+	pkt, err := aead.Open(ciphertext[:0], nonce(counter), ciphertext, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+
+	// only authenticated packets create session
+	// or move the replay window
+	sess = c.recvSessions[key]
+	if sess == nil {
+		c.pruneSessions()
+		sess = &recvSession{aead: aead}
+		if top, ok := c.evicted[key]; ok {
+			sess.window.Reset(top)
+			delete(c.evicted, key)
+		}
+		c.recvSessions[key] = sess
+	}
+
+	// check again since the same counter may be
+	// opened by another reader meanwhile
+	if !sess.window.Check(counter) {
+		return nil, fmt.Errorf("replayed packet, session %x counter %d", key.session, counter)
+	}
+	sess.window.Update(counter)
+	sess.lastSeen = time.Now()
+	return pkt, nil
+}
+
+// SetKeys replaces data keys, nil key is derived from
+// namespace secret. packets are sealed by key active
+// after delay so that peers install keys meanwhile
+func (c *Crypto) SetKeys(keys map[uint8][]byte, active uint8, delay time.Duration) error {
+	if _, ok := keys[active]; !ok {
+		return fmt.Errorf("active key %d not found", active)
+	}
+
+	masters := make(map[uint8][]byte, len(keys))
+	for id, key := range keys {
+		if key == nil {
+			key = c.secret
+		}
+		masters[id] = masterKey(key)
+	}
+
+	c.keyMu.Lock()
+	old := c.masters
+	c.masters = masters
+	c.activateGen += 1
+	gen := c.activateGen
+	c.keyMu.Unlock()
+
+	// sessions of removed or replaced keys
+	c.recvMu.Lock()
+	for key := range c.recvSessions {
+		if !hmac.Equal(old[key.keyID], masters[key.keyID]) {
+			delete(c.recvSessions, key)
+		}
+	}
+	for key := range c.evicted {
+		if !hmac.Equal(old[key.keyID], masters[key.keyID]) {
+			delete(c.evicted, key)
+		}
+	}
+	c.recvMu.Unlock()
+
+	// the sending one is removed or replaced, no way to wait
+	c.sendMu.Lock()
+	ok := hmac.Equal(c.sendMaster, masters[c.sendKeyID])
+	c.sendMu.Unlock()
+	if !ok || delay <= 0 {
+		return c.activate(active, gen)
+	}
+
+	time.AfterFunc(delay, func() {
+		err := c.activate(active, gen)
+		if err != nil {
+			log.Error("activate key %d fail: %v", active, err)
+		}
+	})
+	return nil
+}
+
+// activate seals packets by key id unless keys
+// are replaced after activation of gen is scheduled
+func (c *Crypto) activate(id uint8, gen uint64) error {
+	c.keyMu.RLock()
+	stale := gen != c.activateGen
+	master := c.masters[id]
+	c.keyMu.RUnlock()
+	if stale {
+		return nil
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendKeyID == id && hmac.Equal(c.sendMaster, master) {
+		return nil
+	}
+
+	old := c.sendKeyID
+	c.sendKeyID = id
+	err := c.rekey()
+	if err != nil {
+		c.sendKeyID = old
+		return err
+	}
+	log.Info("seal packets by key %d", id)
+	return nil
+}
+
+// KeyID returns id of data key sealing packets
+func (c *Crypto) KeyID() uint8 {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.sendKeyID
+}
+
+// rekey starts a new session of send key,
+// caller must hold sendMu
+func (c *Crypto) rekey() error {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+
+	c.keyMu.RLock()
+	master := c.masters[c.sendKeyID]
+	c.keyMu.RUnlock()
+	if master == nil {
+		return fmt.Errorf("unknown key %d", c.sendKeyID)
+	}
+
+	session := binary.BigEndian.Uint64(b)
+	aead, err := newAEAD(master, session)
+	if err != nil {
+		return err
+	}
+
+	c.sendMaster = master
+	c.sendSession = session
+	c.sendCounter = 0
+	c.sendAEAD = aead
+	return nil
+}
+
+func (c *Crypto) newAEAD(keyID uint8, session uint64) (cipher.AEAD, error) {
+	c.keyMu.RLock()
+	master := c.masters[keyID]
+	c.keyMu.RUnlock()
+	if master == nil {
+		return nil, fmt.Errorf("unknown key %d", keyID)
+	}
+	return newAEAD(master, session)
+}
+
+func newAEAD(master []byte, session uint64) (cipher.AEAD, error) {
+	info := make([]byte, 8)
+	binary.BigEndian.PutUint64(info, session)
+
+	block, err := aes.NewCipher(deriveKey(master, info))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pruneSessions drops idle sessions,
+// caller must hold recvMu
+func (c *Crypto) pruneSessions() {
+	if len(c.recvSessions) < maxSessions {
+		return
+	}
+
+	var oldestID sessionKey
+	var oldest time.Time
+	for id, sess := range c.recvSessions {
+		if time.Since(sess.lastSeen) > sessionIdleTimeout {
+			c.evict(id)
+			continue
+		}
+
+		if oldest.IsZero() || sess.lastSeen.Before(oldest) {
+			oldestID, oldest = id, sess.lastSeen
+		}
+	}
+
+	if len(c.recvSessions) >= maxSessions {
+		c.evict(oldestID)
+	}
+}
+
+// evict drops session and keeps its top counter,
+// caller must hold recvMu
+func (c *Crypto) evict(id sessionKey) {
+	c.evicted[id] = c.recvSessions[id].window.top
+	delete(c.recvSessions, id)
+}
+
+func masterKey(key []byte) []byte {
+	return deriveKey(key, []byte("cframe edge master key"))
+}
+
+func deriveKey(secret, info []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	return mac.Sum(nil)
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+// replayWindow is a sliding window of received counters
+// counter 0 is never used by Seal
+type replayWindow struct {
+	top    uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+func (w *replayWindow) Check(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+
+	if counter > w.top {
+		return true
+	}
+
+	if w.top-counter >= replayWindowSize {
+		return false
+	}
+
+	idx := counter % replayWindowSize
+	return w.bitmap[idx/64]&(1<<(idx%64)) == 0
+}
+
+// Reset marks counters up to top as received
+func (w *replayWindow) Reset(top uint64) {
+	w.top = top
+	for i := range w.bitmap {
+		w.bitmap[i] = ^uint64(0)
+	}
+}
+
+func (w *replayWindow) Update(counter uint64) {
+	if counter > w.top {
+		diff := counter - w.top
+		if diff >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := w.top + 1; i < counter; i++ {
+				idx := i % replayWindowSize
+				w.bitmap[idx/64] &^= 1 << (idx % 64)
+			}
+		}
+		w.top = counter
+	}
+
+	idx := counter % replayWindowSize
+	w.bitmap[idx/64] |= 1 << (idx % 64)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func newTestCrypto(t *testing.T) *Crypto {
+	c, err := NewCrypto("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCryptoSealOpen(t *testing.T) {
+	sender, receiver := newTestCrypto(t), newTestCrypto(t)
+
+	pkt := []byte("hello cframe")
+	sealed, err := sender.Seal(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sealed) != len(pkt)+sender.Overhead() {
+		t.Fatalf("sealed %d bytes, expect %d", len(sealed), len(pkt)+sender.Overhead())
+	}
+
+	opened, err := receiver.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(opened, pkt) {
+		t.Fatalf("opened %q, expect %q", opened, pkt)
+	}
+}
+
+func TestCryptoOpenWrongSecret(t *testing.T) {
+	sender := newTestCrypto(t)
+	receiver, err := NewCrypto("another secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := sender.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = receiver.Open(sealed)
+	if err == nil {
+		t.Fatal("packet of another secret opened")
+	}
+}
+
+func TestCryptoReplay(t *testing.T) {
+	sender, receiver := newTestCrypto(t), newTestCrypto(t)
+
+	sealed, err := sender.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := append([]byte(nil), sealed...)
+
+	_, err = receiver.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = receiver.Open(dup)
+	if err == nil {
+		t.Fatal("duplicate counter accepted")
+	}
+}
+
+func TestCryptoReorder(t *testing.T) {
+	sender, receiver := newTestCrypto(t), newTestCrypto(t)
+
+	pkts := make([][]byte, 0)
+	for i := 0; i < 10; i++ {
+		sealed, err := sender.Seal([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, sealed)
+	}
+
+	// newest first, the others are inside window
+	for i := len(pkts) - 1; i >= 0; i-- {
+		opened, err := receiver.Open(pkts[i])
+		if err != nil {
+			t.Fatalf("open reordered packet %d fail: %v", i, err)
+		}
+
+		if opened[0] != byte(i) {
+			t.Fatalf("opened %d, expect %d", opened[0], i)
+		}
+	}
+}
+
+func TestCryptoOutOfWindow(t *testing.T) {
+	sender, receiver := newTestCrypto(t), newTestCrypto(t)
+
+	pkts := make([][]byte, 0)
+	for i := 0; i <= replayWindowSize; i++ {
+		sealed, err := sender.Seal([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, sealed)
+	}
+
+	// top is replayWindowSize+1
+	_, err := receiver.Open(pkts[replayWindowSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// counter 2, top-1023 is the oldest one inside window
+	_, err = receiver.Open(pkts[1])
+	if err != nil {
+		t.Fatalf("counter inside window rejected: %v", err)
+	}
+
+	// counter 1, top-1024 is out of window
+	_, err = receiver.Open(pkts[0])
+	if err == nil {
+		t.Fatal("counter out of window accepted")
+	}
+}
+
+func TestCryptoTampered(t *testing.T) {
+	sender := newTestCrypto(t)
+
+	cases := map[string]func(buf []byte){
+		// version is authenticated, lz4 is supported
+		"version": func(buf []byte) { buf[0] = cryptoVersionLZ4 },
+		"key id":  func(buf []byte) { buf[1] ^= 1 },
+		"session": func(buf []byte) { buf[2] ^= 1 },
+		"counter": func(buf []byte) { buf[17] ^= 1 },
+		"payload": func(buf []byte) { buf[cryptoHeaderLen] ^= 1 },
+		"tag":     func(buf []byte) { buf[len(buf)-1] ^= 1 },
+	}
+
+	for name, tamper := range cases {
+		receiver := newTestCrypto(t)
+		sealed, err := sender.Seal([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tamper(sealed)
+		_, err = receiver.Open(sealed)
+		if err == nil {
+			t.Fatalf("packet with tampered %s opened", name)
+		}
+	}
+}
+
+func TestCryptoOpenShort(t *testing.T) {
+	receiver := newTestCrypto(t)
+	_, err := receiver.Open(make([]byte, cryptoHeaderLen+cryptoTagLen-1))
+	if err == nil {
+		t.Fatal("short packet opened")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := replayWindow{}
+	if w.Check(0) {
+		t.Fatal("counter 0 accepted")
+	}
+
+	w.Update(5)
+	if w.Check(5) {
+		t.Fatal("duplicate counter accepted")
+	}
+
+	if !w.Check(3) {
+		t.Fatal("reordered counter rejected")
+	}
+
+	// jump far ahead clears window
+	w.Update(5 + replayWindowSize*2)
+	if w.Check(5) {
+		t.Fatal("counter out of window accepted")
+	}
+
+	if !w.Check(5 + replayWindowSize*2 - replayWindowSize + 1) {
+		t.Fatal("oldest counter inside window rejected")
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	c := newTestCrypto(t)
+
+	now := time.Now()
+	for i := 0; i < maxSessions; i++ {
+		c.recvSessions[sessionKey{session: uint64(i)}] = &recvSession{
+			lastSeen: now.Add(time.Duration(i) * time.Second),
+		}
+	}
+
+	// session 0 is the oldest one
+	c.pruneSessions()
+	if len(c.recvSessions) != maxSessions-1 {
+		t.Fatalf("%d sessions after prune, expect %d", len(c.recvSessions), maxSessions-1)
+	}
+
+	if _, ok := c.recvSessions[sessionKey{session: 0}]; ok {
+		t.Fatal("oldest session not evicted")
+	}
+
+	// idle sessions are all dropped
+	c.recvSessions[sessionKey{session: 0}] = &recvSession{lastSeen: now}
+	for i := 1; i < 10; i++ {
+		c.recvSessions[sessionKey{session: uint64(i)}].lastSeen = now.Add(-sessionIdleTimeout * 2)
+	}
+
+	c.pruneSessions()
+	if len(c.recvSessions) != maxSessions-9 {
+		t.Fatalf("%d sessions after prune, expect %d", len(c.recvSessions), maxSessions-9)
+	}
+
+	// nothing to prune under limit
+	c.pruneSessions()
+	if len(c.recvSessions) != maxSessions-9 {
+		t.Fatalf("%d sessions after prune, expect %d", len(c.recvSessions), maxSessions-9)
+	}
+}
+
+func TestCryptoReplayAfterEviction(t *testing.T) {
+	sender, receiver := newTestCrypto(t), newTestCrypto(t)
+
+	pkts := make([][]byte, 0)
+	for i := 0; i < 3; i++ {
+		sealed, err := sender.Seal([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, sealed)
+	}
+	dup := append([]byte(nil), pkts[0]...)
+
+	_, err := receiver.Open(pkts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// session of sender is idle and evicted once sessions are full
+	for _, sess := range receiver.recvSessions {
+		sess.lastSeen = time.Now().Add(-sessionIdleTimeout * 2)
+	}
+	for i := 1; i < maxSessions; i++ {
+		receiver.recvSessions[sessionKey{session: uint64(i)}] = &recvSession{lastSeen: time.Now()}
+	}
+
+	another, err := newTestCrypto(t).Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiver.Open(another)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receiver.evicted) != 1 {
+		t.Fatalf("%d sessions evicted, expect 1", len(receiver.evicted))
+	}
+
+	_, err = receiver.Open(append([]byte(nil), dup...))
+	if err == nil {
+		t.Fatal("packet replayed after eviction accepted")
+	}
+
+	// newer packets create session again, older ones are still replays
+	_, err = receiver.Open(pkts[2])
+	if err != nil {
+		t.Fatalf("packet after eviction rejected: %v", err)
+	}
+
+	_, err = receiver.Open(dup)
+	if err == nil {
+		t.Fatal("packet replayed after session recreated accepted")
+	}
+
+	_, err = receiver.Open(pkts[1])
+	if err != nil {
+		t.Fatalf("reordered packet after eviction rejected: %v", err)
+	}
+}
+
+func setTestKeys(t *testing.T, c *Crypto, keys map[uint8][]byte, active uint8, delay time.Duration) {
+	err := c.SetKeys(keys, active, delay)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptoRotation(t *testing.T) {
+	sender, receiver := newTestCrypto(t), newTestCrypto(t)
+	keys := map[uint8][]byte{0: nil, 1: []byte("data key 1")}
+	setTestKeys(t, sender, keys, 1, 0)
+
+	if sender.KeyID() != 1 {
+		t.Fatalf("seal by key %d, expect 1", sender.KeyID())
+	}
+
+	sealed, err := sender.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// receiver without key 1
+	_, err = receiver.Open(append([]byte(nil), sealed...))
+	if err == nil {
+		t.Fatal("packet of unknown key opened")
+	}
+
+	setTestKeys(t, receiver, keys, 1, 0)
+	_, err = receiver.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// key 0 is removed
+	setTestKeys(t, sender, map[uint8][]byte{1: []byte("data key 1")}, 1, 0)
+	setTestKeys(t, receiver, map[uint8][]byte{1: []byte("data key 1")}, 1, 0)
+	old, err := newTestCrypto(t).Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = receiver.Open(old)
+	if err == nil {
+		t.Fatal("packet of removed key opened")
+	}
+}
+
+func TestCryptoOverlap(t *testing.T) {
+	sender, receiver := newTestCrypto(t), newTestCrypto(t)
+	keys := map[uint8][]byte{0: nil, 1: []byte("data key 1")}
+
+	// peers install keys before sender activates key 1
+	delay := time.Millisecond * 100
+	setTestKeys(t, sender, keys, 1, delay)
+	setTestKeys(t, receiver, keys, 1, delay)
+	if sender.KeyID() != 0 {
+		t.Fatalf("seal by key %d before delay, expect 0", sender.KeyID())
+	}
+
+	before, err := sender.Seal([]byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(delay * 3)
+	if sender.KeyID() != 1 {
+		t.Fatalf("seal by key %d after delay, expect 1", sender.KeyID())
+	}
+
+	after, err := sender.Seal([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// packets of both keys are opened in overlap window
+	_, err = receiver.Open(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = receiver.Open(before)
+	if err != nil {
+		t.Fatalf("packet of previous key rejected: %v", err)
+	}
+}
+
+func TestCryptoOverlapReplaced(t *testing.T) {
+	sender := newTestCrypto(t)
+
+	// keys replaced before scheduled activation
+	setTestKeys(t, sender, map[uint8][]byte{0: nil, 1: []byte("data key 1")}, 1, time.Millisecond*50)
+	setTestKeys(t, sender, map[uint8][]byte{0: nil, 2: []byte("data key 2")}, 0, 0)
+	time.Sleep(time.Millisecond * 150)
+
+	if sender.KeyID() != 0 {
+		t.Fatalf("seal by key %d, expect 0", sender.KeyID())
+	}
+}
+
+func TestCryptoKeyIDReused(t *testing.T) {
+	sender := newTestCrypto(t)
+	setTestKeys(t, sender, map[uint8][]byte{0: nil, 1: []byte("data key 1")}, 1, 0)
+
+	// controller reuses id 1 with another key
+	keys := map[uint8][]byte{1: []byte("data key 1 again")}
+	setTestKeys(t, sender, keys, 1, time.Hour)
+
+	sealed, err := sender.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := newTestCrypto(t)
+	setTestKeys(t, receiver, map[uint8][]byte{0: nil, 1: []byte("data key 1")}, 0, 0)
+	_, err = receiver.Open(append([]byte(nil), sealed...))
+	if err == nil {
+		t.Fatal("packet sealed by replaced key")
+	}
+
+	setTestKeys(t, receiver, keys, 1, 0)
+	_, err = receiver.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+// reed-solomon forward error correction on udp path
+//  1. sealed packets to peer with fec are data shards of groups,
+//     parity shards are sent once the group is complete or
+//     a partial group is older than fecFlushTimeout
+//  2. data shards are delivered once received, missing data
+//     shards are recovered once enough shards of the group received
+//  3. fec of peer is configured by controller, packets sent to
+//     the peer are encoded with it and any edge can decode them
+//     since parity shards carry the shards of group
+//
+// | 1byte fecVersion | 4bytes group | 1byte index | 1byte data | 1byte parity | shard |
+// data and parity are 0 in data shards, the shard is sealed packet.
+// parity is computed over | 2bytes length | sealed packet |
+// of data shards padded to the longest one
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// never crypto, codec or mux version
+	fecVersion = 0x20
+
+	fecHeaderLen = 8
+
+	// bytes added to sealed packet in parity shards
+	fecOverhead = fecHeaderLen + 2
+
+	fecFlushTimeout = time.Millisecond * 10
+
+	// groups kept for recovery of each peer
+	fecMaxGroups    = 256
+	fecGroupTimeout = time.Second
+)
+
+type fecHeader struct {
+	group  uint32
+	index  int
+	data   int
+	parity int
+}
+
+func putFECHeader(buf []byte, h fecHeader) {
+	buf[0] = fecVersion
+	binary.BigEndian.PutUint32(buf[1:5], h.group)
+	buf[5] = byte(h.index)
+	buf[6] = byte(h.data)
+	buf[7] = byte(h.parity)
+}
+
+func parseFEC(buf []byte) (fecHeader, []byte, error) {
+	if len(buf) <= fecHeaderLen {
+		return fecHeader{}, nil, fmt.Errorf("short fec shard")
+	}
+
+	h := fecHeader{
+		group:  binary.BigEndian.Uint32(buf[1:5]),
+		index:  int(buf[5]),
+		data:   int(buf[6]),
+		parity: int(buf[7]),
+	}
+
+	if h.index >= codec.FECMaxShards || h.data+h.parity > codec.FECMaxShards ||
+		(h.data > 0 && (h.parity == 0 || h.index < h.data || h.index >= h.data+h.parity)) {
+		return fecHeader{}, nil, fmt.Errorf("invalid fec shard %d of %d:%d", h.index, h.data, h.parity)
+	}
+	return h, buf[fecHeaderLen:], nil
+}
+
+// fecEncoder groups packets sent to a peer
+type fecEncoder struct {
+	cfg *codec.FECConfig
+
+	mu      sync.Mutex
+	group   uint32
+	count   int
+	maxLen  int
+	startAt time.Time
+
+	// length prefixed packets of current group, reused
+	shards [][]byte
+
+	// key: data shards, partial group has less
+	encoders map[int]reedsolomon.Encoder
+}
+
+func newFECEncoder(cfg *codec.FECConfig) *fecEncoder {
+	return &fecEncoder{
+		cfg: cfg,
+		// groups of last run may be still kept by peer
+		group:    rand.Uint32(),
+		shards:   make([][]byte, cfg.DataShards),
+		encoders: make(map[int]reedsolomon.Encoder),
+	}
+}
+
+// add takes sealed packet at shard[fecHeaderLen:] as data shard
+// and writes its header, parity shards are returned
+// once the group is complete
+func (e *fecEncoder) add(shard []byte) []*datagram {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.count == 0 {
+		e.startAt = time.Now()
+	}
+
+	putFECHeader(shard, fecHeader{group: e.group, index: e.count})
+	pkt := shard[fecHeaderLen:]
+	b := append(e.shards[e.count][:0], byte(len(pkt)>>8), byte(len(pkt)))
+	b = append(b, pkt...)
+	e.shards[e.count] = b
+	if len(b) > e.maxLen {
+		e.maxLen = len(b)
+	}
+
+	e.count += 1
+	if e.count < e.cfg.DataShards {
+		return nil
+	}
+	return e.encode()
+}
+
+// flush returns parity shards of partial group older than timeout
+func (e *fecEncoder) flush(timeout time.Duration) []*datagram {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.count == 0 || time.Since(e.startAt) < timeout {
+		return nil
+	}
+	return e.encode()
+}
+
+// encode returns parity shards of current group
+// and starts the next one, caller must hold mu
+func (e *fecEncoder) encode() []*datagram {
+	data, parity, size := e.count, e.cfg.ParityShards, e.maxLen
+	h := fecHeader{group: e.group, data: data, parity: parity}
+	e.group += 1
+	e.count = 0
+	e.maxLen = 0
+
+	enc := e.encoders[data]
+	if enc == nil {
+		var err error
+		enc, err = reedsolomon.New(data, parity)
+		if err != nil {
+			log.Error("create fec encoder %d:%d fail: %v", data, parity, err)
+			return nil
+		}
+		e.encoders[data] = enc
+	}
+
+	shards := make([][]byte, data+parity)
+	for i := 0; i < data; i++ {
+		shards[i] = pad(e.shards[i], size)
+		e.shards[i] = shards[i]
+	}
+
+	out := make([]*datagram, parity)
+	for i := range out {
+		buf := getBuf()
+		h.index = data + i
+		putFECHeader(*buf, h)
+		shards[data+i] = (*buf)[fecHeaderLen : fecHeaderLen+size]
+		out[i] = &datagram{buf: buf, data: (*buf)[:fecHeaderLen+size]}
+	}
+
+	err := enc.Encode(shards)
+	if err != nil {
+		log.Error("fec encode fail: %v", err)
+		for _, d := range out {
+			putBuf(d.buf)
+		}
+		return nil
+	}
+	return out
+}
+
+// pad extends b to size with zeros
+func pad(b []byte, size int) []byte {
+	n := len(b)
+	if cap(b) < size {
+		nb := make([]byte, n, size)
+		copy(nb, b)
+		b = nb
+	}
+
+	b = b[:size]
+	for i := n; i < size; i++ {
+		b[i] = 0
+	}
+	return b
+}
+
+type fecGroup struct {
+	// length prefixed data shards and parity shards
+	shards [][]byte
+
+	// shards received or recovered
+	have uint64
+
+	// shards of group, 0 until any parity shard received
+	data   int
+	parity int
+
+	count   int
+	done    bool
+	startAt time.Time
+}
+
+// fecDecoder recovers packets from a peer
+type fecDecoder struct {
+	mu     sync.Mutex
+	groups map[uint32]*fecGroup
+
+	// key: data and parity shards
+	decoders map[[2]int]reedsolomon.Encoder
+
+	// since edge started
+	recovered uint64
+	lost      uint64
+}
+
+func newFECDecoder() *fecDecoder {
+	return &fecDecoder{
+		groups:   make(map[uint32]*fecGroup),
+		decoders: make(map[[2]int]reedsolomon.Encoder),
+	}
+}
+
+// add adds shard of group, it reports whether the shard is data
+// shard to be delivered and returns data shards recovered
+func (d *fecDecoder) add(h fecHeader, shard []byte) (bool, [][]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g := d.groups[h.group]
+	if g == nil {
+		if len(d.groups) >= fecMaxGroups {
+			d.expire(true)
+		}
+
+		g = &fecGroup{
+			shards:  make([][]byte, codec.FECMaxShards),
+			startAt: time.Now(),
+		}
+		d.groups[h.group] = g
+	}
+
+	bit := uint64(1) << uint(h.index)
+	if g.have&bit != 0 {
+		return false, nil
+	}
+	g.have |= bit
+
+	isData := h.data == 0
+	if g.done {
+		return isData, nil
+	}
+
+	if isData {
+		b := make([]byte, 2+len(shard))
+		binary.BigEndian.PutUint16(b, uint16(len(shard)))
+		copy(b[2:], shard)
+		g.shards[h.index] = b
+	} else {
+		g.shards[h.index] = append([]byte(nil), shard...)
+		g.data, g.parity = h.data, h.parity
+	}
+
+	g.count += 1
+	if g.data == 0 || g.count < g.data {
+		return isData, nil
+	}
+
+	recovered := d.recover(g)
+	g.done = true
+	g.shards = nil
+	return isData, recovered
+}
+
+// recover reconstructs missing data shards of g
+func (d *fecDecoder) recover(g *fecGroup) [][]byte {
+	size, missing := 0, 0
+	for i := g.data; i < g.data+g.parity; i++ {
+		if g.shards[i] != nil {
+			size = len(g.shards[i])
+			break
+		}
+	}
+
+	shards := make([][]byte, g.data+g.parity)
+	for i := range shards {
+		b := g.shards[i]
+		if b == nil {
+			if i < g.data {
+				missing += 1
+			}
+			continue
+		}
+
+		if len(b) > size {
+			log.Debug("fec shard %d larger than parity", i)
+			return nil
+		}
+		shards[i] = pad(b, size)
+	}
+
+	if missing == 0 {
+		return nil
+	}
+
+	key := [2]int{g.data, g.parity}
+	dec := d.decoders[key]
+	if dec == nil {
+		var err error
+		dec, err = reedsolomon.New(g.data, g.parity)
+		if err != nil {
+			log.Error("create fec decoder %d:%d fail: %v", g.data, g.parity, err)
+			return nil
+		}
+		d.decoders[key] = dec
+	}
+
+	err := dec.ReconstructData(shards)
+	if err != nil {
+		log.Debug("fec reconstruct fail: %v", err)
+		return nil
+	}
+
+	recovered := make([][]byte, 0, missing)
+	for i := 0; i < g.data; i++ {
+		if g.shards[i] != nil {
+			continue
+		}
+
+		n := int(binary.BigEndian.Uint16(shards[i]))
+		if 2+n > len(shards[i]) {
+			continue
+		}
+		g.have |= uint64(1) << uint(i)
+		recovered = append(recovered, shards[i][2:2+n])
+	}
+
+	d.recovered += uint64(len(recovered))
+	fecRecovered.Add(float64(len(recovered)))
+	AddFECRecovered(int64(len(recovered)))
+	return recovered
+}
+
+// expire removes groups older than fecGroupTimeout, the oldest
+// one is removed if none and force. missing data shards of
+// removed groups are lost, caller must hold mu
+func (d *fecDecoder) expire(force bool) {
+	var oldest uint32
+	var oldestAt time.Time
+	removed := false
+	for id, g := range d.groups {
+		if time.Since(g.startAt) >= fecGroupTimeout {
+			d.remove(id, g)
+			removed = true
+			continue
+		}
+
+		if oldestAt.IsZero() || g.startAt.Before(oldestAt) {
+			oldest, oldestAt = id, g.startAt
+		}
+	}
+
+	if force && !removed && !oldestAt.IsZero() {
+		d.remove(oldest, d.groups[oldest])
+	}
+}
+
+func (d *fecDecoder) remove(id uint32, g *fecGroup) {
+	delete(d.groups, id)
+	if g.done || g.data == 0 {
+		return
+	}
+
+	lost := 0
+	for i := 0; i < g.data; i++ {
+		if g.have&(uint64(1)<<uint(i)) == 0 {
+			lost += 1
+		}
+	}
+
+	d.lost += uint64(lost)
+	fecLost.Add(float64(lost))
+	AddFECLost(int64(lost))
+}
+
+// setFEC sets fec of packets sent to peer listenAddr,
+// path mtu is searched again with fec overhead
+func (s *Server) setFEC(listenAddr string, cfg *codec.FECConfig) {
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	ep := s.endpoints[listenAddr]
+	if ep == nil {
+		return
+	}
+
+	old := (*codec.FECConfig)(nil)
+	if ep.fec != nil {
+		old = ep.fec.cfg
+	}
+	if old.String() == cfg.String() {
+		return
+	}
+
+	if cfg == nil || cfg.Verify() != nil {
+		log.Info("fec of peer %s is disabled", listenAddr)
+		ep.fec = nil
+	} else {
+		log.Info("fec of peer %s is %s", listenAddr, cfg)
+		ep.fec = newFECEncoder(cfg)
+	}
+	ep.mtu = pmtuState{seq: ep.mtu.seq}
+}
+
+// forwardFEC sends sealed packet data in buf as data shard
+// and parity shards if the group is complete.
+// buf is owned by forwardFEC
+func (s *Server) forwardFEC(buf *[]byte, data []byte, p path, peer string, sendQueue chan *datagram) {
+	n := copy((*buf)[fecHeaderLen:], data)
+	shard := (*buf)[:fecHeaderLen+n]
+	parity := p.fec.add(shard)
+
+	s.sendPath(p, peer, &datagram{buf: buf, data: shard}, sendQueue)
+	for _, d := range parity {
+		s.sendPath(p, peer, d, sendQueue)
+	}
+}
+
+// inboundFEC delivers data shard and data shards recovered
+func (s *Server) inboundFEC(buf []byte, raddr *net.UDPAddr, from string, q int) {
+	h, shard, err := parseFEC(buf)
+	if err != nil {
+		log.Error("%v", err)
+		droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+		return
+	}
+
+	key := from
+	if len(key) == 0 {
+		key = raddr.String()
+	}
+
+	s.fecMu.Lock()
+	dec := s.fecDecoders[key]
+	if dec == nil {
+		dec = newFECDecoder()
+		s.fecDecoders[key] = dec
+	}
+	s.fecMu.Unlock()
+
+	deliver, recovered := dec.add(h, shard)
+	if deliver {
+		s.deliver(shard, raddr, from, q)
+	}
+
+	for _, pkt := range recovered {
+		s.deliver(pkt, raddr, from, q)
+	}
+}
+
+type fecFlush struct {
+	peer   string
+	parity []*datagram
+}
+
+// flushFEC sends parity shards of partial groups
+// and expires groups of decoders
+func (s *Server) flushFEC() {
+	tick := time.NewTicker(fecFlushTimeout)
+	defer tick.Stop()
+	lastExpire := time.Now()
+	for range tick.C {
+		flushes := make([]fecFlush, 0)
+		s.epMu.RLock()
+		for _, ep := range s.endpoints {
+			if ep.fec == nil {
+				continue
+			}
+
+			if parity := ep.fec.flush(fecFlushTimeout); len(parity) > 0 {
+				flushes = append(flushes, fecFlush{ep.listenAddr, parity})
+			}
+		}
+		s.epMu.RUnlock()
+
+		for _, f := range flushes {
+			p, err := s.endpoint(f.peer)
+			for _, d := range f.parity {
+				if err != nil || p.stream != nil {
+					putBuf(d.buf)
+					continue
+				}
+				s.sendPath(p, f.peer, d, s.sendQueues[0])
+			}
+		}
+
+		if time.Since(lastExpire) < fecGroupTimeout {
+			continue
+		}
+		lastExpire = time.Now()
+
+		s.fecMu.Lock()
+		for key, dec := range s.fecDecoders {
+			dec.mu.Lock()
+			dec.expire(false)
+			idle := len(dec.groups) == 0 && dec.recovered+dec.lost == 0
+			dec.mu.Unlock()
+			if idle {
+				delete(s.fecDecoders, key)
+			}
+		}
+		s.fecMu.Unlock()
+	}
+}
+
+// fecStats returns packets recovered and lost
+// from peer listenAddr at addr
+func (s *Server) fecStats(listenAddr string, addr *net.UDPAddr) (uint64, uint64) {
+	keys := []string{listenAddr}
+	if addr != nil {
+		keys = append(keys, addr.String())
+	}
+
+	var recovered, lost uint64
+	s.fecMu.Lock()
+	defer s.fecMu.Unlock()
+	for _, key := range keys {
+		if dec := s.fecDecoders[key]; dec != nil {
+			dec.mu.Lock()
+			recovered += dec.recovered
+			lost += dec.lost
+			dec.mu.Unlock()
+		}
+	}
+	return recovered, lost
+}
@@ -1,24 +1,93 @@
 package main
 
-import "fmt"
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+
+	// ipv6 extension headers walked for transport header
+	extHopByHop   = 0
+	extRouting    = 43
+	extFragment   = 44
+	extAuth       = 51
+	extDstOpts    = 60
+	maxExtHeaders = 8
+)
+
+// ethernet types
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	etherHeaderLen = 14
+)
 
 type Frame []byte
 type Packet []byte
 
 func (f Frame) Invalid() bool {
-	return len(f) < 14
+	return len(f) < etherHeaderLen
 }
 
 func (f Frame) IsIPV4() bool {
 	if f.Invalid() {
 		return false
 	}
-	proto := int(f[12])<<8 + int(f[13])
-	return proto == 0x0800
+	return f.EtherType() == etherTypeIPv4
+}
+
+// IsIP reports whether payload is ipv4 or ipv6 packet
+func (f Frame) IsIP() bool {
+	if f.Invalid() {
+		return false
+	}
+
+	t := f.EtherType()
+	return t == etherTypeIPv4 || t == etherTypeIPv6
+}
+
+func (f Frame) EtherType() int {
+	return int(binary.BigEndian.Uint16(f[12:14]))
+}
+
+// DstMAC and SrcMAC share memory with f
+func (f Frame) DstMAC() net.HardwareAddr {
+	return net.HardwareAddr(f[0:6])
+}
+
+func (f Frame) SrcMAC() net.HardwareAddr {
+	return net.HardwareAddr(f[6:12])
+}
+
+// IsMulticast reports whether dst mac is broadcast or multicast
+func (f Frame) IsMulticast() bool {
+	return f[0]&0x01 != 0
+}
+
+func (f Frame) Payload() []byte {
+	return f[etherHeaderLen:]
 }
 
 func (p Packet) Invalid() bool {
-	return len(p) < 20
+	if len(p) < 1 {
+		return true
+	}
+
+	switch p.Version() {
+	case 4:
+		return len(p) < 20
+	case 6:
+		return len(p) < 40
+	default:
+		return true
+	}
 }
 
 func (p Packet) Version() int {
@@ -26,9 +95,146 @@ func (p Packet) Version() int {
 }
 
 func (p Packet) Dst() string {
-	return fmt.Sprintf("%d.%d.%d.%d", p[16], p[17], p[18], p[19])
+	return p.DstIP().String()
 }
 
 func (p Packet) Src() string {
-	return fmt.Sprintf("%d.%d.%d.%d", p[12], p[13], p[14], p[15])
+	return p.SrcIP().String()
+}
+
+// DstIP returns 4 bytes for ipv4 and 16 bytes for ipv6
+// the returned ip shares memory with p
+func (p Packet) DstIP() net.IP {
+	if p.Version() == 6 {
+		return net.IP(p[24:40])
+	}
+	return net.IP(p[16:20])
+}
+
+// DSCP returns differentiated services code point
+func (p Packet) DSCP() int {
+	if p.Version() == 6 {
+		return int((p[0]&0x0f)<<2 | p[1]>>6)
+	}
+	return int(p[1] >> 2)
+}
+
+// Proto returns transport protocol number,
+// ipv6 extension headers are skipped
+func (p Packet) Proto() int {
+	proto, _, _ := p.transport()
+	return proto
+}
+
+// Fragmented reports whether packet is a fragment,
+// the first one included
+func (p Packet) Fragmented() bool {
+	_, _, frag := p.transport()
+	return frag
+}
+
+// transport returns transport protocol and offset of its header,
+// offset is -1 for non-first fragments and truncated headers
+func (p Packet) transport() (proto, off int, frag bool) {
+	if p.Version() == 4 {
+		flags := binary.BigEndian.Uint16(p[6:8])
+		off = int(p[0]&0x0f) * 4
+		if flags&0x1fff != 0 {
+			off = -1
+		}
+		return int(p[9]), off, flags&0x3fff != 0
+	}
+
+	proto, off = int(p[6]), 40
+	for i := 0; i < maxExtHeaders; i++ {
+		switch proto {
+		case extHopByHop, extRouting, extDstOpts, extAuth, extFragment:
+		default:
+			return proto, off, frag
+		}
+
+		if len(p) < off+8 {
+			return proto, -1, frag
+		}
+
+		next := int(p[off])
+		switch proto {
+		case extFragment:
+			frag = true
+			if binary.BigEndian.Uint16(p[off+2:off+4])&0xfff8 != 0 {
+				return next, -1, frag
+			}
+			off += 8
+		case extAuth:
+			off += (int(p[off+1]) + 2) * 4
+		default:
+			off += (int(p[off+1]) + 1) * 8
+		}
+		proto = next
+	}
+	return proto, -1, frag
+}
+
+// FlowHash returns fnv-1a hash of src, dst, protocol
+// and tcp/udp ports, packets of the same flow have the same hash.
+// ports are ignored for fragments
+func (p Packet) FlowHash() uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	h := uint32(offset32)
+	hash := func(b []byte) {
+		for _, c := range b {
+			h ^= uint32(c)
+			h *= prime32
+		}
+	}
+
+	// all fragments of a packet are of the same flow
+	proto, off, frag := p.transport()
+	hash(p.SrcIP())
+	hash(p.DstIP())
+	hash([]byte{byte(proto)})
+
+	if !frag && (proto == protoTCP || proto == protoUDP) && off >= 0 && len(p) >= off+4 {
+		hash(p[off : off+4])
+	}
+	return h
+}
+
+// Ports returns tcp/udp src and dst port,
+// ok is false for other protocols, non-first fragments
+// and truncated packets
+func (p Packet) Ports() (src, dst uint16, ok bool) {
+	off := p.transportOffset()
+	if off < 0 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(p[off : off+2]),
+		binary.BigEndian.Uint16(p[off+2 : off+4]), true
+}
+
+// transportOffset returns offset of tcp/udp header
+// which has at least 4 bytes for ports, -1 if none
+func (p Packet) transportOffset() int {
+	proto, off, _ := p.transport()
+	if proto != protoTCP && proto != protoUDP {
+		return -1
+	}
+
+	if off < 0 || len(p) < off+4 {
+		return -1
+	}
+	return off
+}
+
+// SrcIP returns 4 bytes for ipv4 and 16 bytes for ipv6
+// the returned ip shares memory with p
+func (p Packet) SrcIP() net.IP {
+	if p.Version() == 6 {
+		return net.IP(p[8:24])
+	}
+	return net.IP(p[12:16])
 }
@@ -0,0 +1,379 @@
+package main
+
+// layer 2 bridging in tap mode
+//  1. ethernet frames are sent to the peer learned from
+//     src mac of frames received from peers
+//  2. broadcast, multicast and unknown unicast frames are
+//     flooded to all peers of namespace, frames from peers
+//     are never flooded again since peers are full mesh
+//  3. arp requests for hosts learned from peers are
+//     answered locally instead of flooding
+//  4. learned entries are aged out after bridgeAgeing
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+const (
+	bridgeAgeing = time.Minute * 5
+
+	arpLen        = 28
+	arpOpRequest  = 1
+	arpOpReply    = 2
+	arpHTypeEther = 1
+)
+
+type macEntry struct {
+	// unix nano of last frame, updated atomically
+	seen int64
+
+	// peer listen address
+	peer string
+
+	// address frames received from, nil if relayed
+	addr *net.UDPAddr
+}
+
+func (e *macEntry) fresh() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&e.seen))) < bridgeAgeing
+}
+
+type arpEntry struct {
+	mac  net.HardwareAddr
+	seen time.Time
+}
+
+type bridge struct {
+	mu sync.RWMutex
+
+	// listen addresses of peers, replaced on change
+	// so that readers can use it without lock
+	peers []string
+
+	// key: mac address of remote hosts
+	macs map[[6]byte]*macEntry
+
+	// key: ipv4 address of remote hosts
+	arps map[[4]byte]*arpEntry
+}
+
+func newBridge() *bridge {
+	return &bridge{
+		macs: make(map[[6]byte]*macEntry),
+		arps: make(map[[4]byte]*arpEntry),
+	}
+}
+
+func (b *bridge) addPeer(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range b.peers {
+		if p == addr {
+			return
+		}
+	}
+
+	peers := append([]string{addr}, b.peers...)
+	sort.Strings(peers)
+	b.peers = peers
+}
+
+func (b *bridge) delPeer(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	peers := make([]string, 0, len(b.peers))
+	for _, p := range b.peers {
+		if p != addr {
+			peers = append(peers, p)
+		}
+	}
+	b.peers = peers
+
+	for mac, e := range b.macs {
+		if e.peer == addr {
+			delete(b.macs, mac)
+		}
+	}
+}
+
+func (b *bridge) peerList() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.peers
+}
+
+// lookup returns peer of mac, empty if unknown
+func (b *bridge) lookup(mac net.HardwareAddr) string {
+	var key [6]byte
+	copy(key[:], mac)
+
+	b.mu.RLock()
+	e := b.macs[key]
+	b.mu.RUnlock()
+	if e == nil || !e.fresh() {
+		return ""
+	}
+	return e.peer
+}
+
+// touch refreshes entry of mac if it is learned from
+// the same peer, it returns false if mac should be learned
+func (b *bridge) touch(mac net.HardwareAddr, addr *net.UDPAddr, relayFrom string) bool {
+	var key [6]byte
+	copy(key[:], mac)
+
+	b.mu.RLock()
+	e := b.macs[key]
+	b.mu.RUnlock()
+	if e == nil {
+		return false
+	}
+
+	same := false
+	if len(relayFrom) > 0 {
+		same = e.addr == nil && e.peer == relayFrom
+	} else {
+		same = e.addr != nil && e.addr.IP.Equal(addr.IP) && e.addr.Port == addr.Port
+	}
+
+	if same {
+		atomic.StoreInt64(&e.seen, time.Now().UnixNano())
+	}
+	return same
+}
+
+func (b *bridge) learn(mac net.HardwareAddr, peer string, addr *net.UDPAddr) {
+	var key [6]byte
+	copy(key[:], mac)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old := b.macs[key]; old != nil && old.peer != peer {
+		log.Info("mac %s moved from %s to %s", mac, old.peer, peer)
+	}
+	b.macs[key] = &macEntry{
+		seen: time.Now().UnixNano(),
+		peer: peer,
+		addr: addr,
+	}
+	bridgeMACs.Set(float64(len(b.macs)))
+}
+
+func (b *bridge) learnARP(ip net.IP, mac net.HardwareAddr) {
+	var key [4]byte
+	copy(key[:], ip.To4())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.arps[key] = &arpEntry{
+		mac:  append(net.HardwareAddr{}, mac...),
+		seen: time.Now(),
+	}
+}
+
+func (b *bridge) lookupARP(ip net.IP) net.HardwareAddr {
+	var key [4]byte
+	copy(key[:], ip.To4())
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e := b.arps[key]
+	if e == nil || time.Since(e.seen) >= bridgeAgeing {
+		return nil
+	}
+	return e.mac
+}
+
+// age removes entries not refreshed in bridgeAgeing
+func (b *bridge) age() {
+	tick := time.NewTicker(bridgeAgeing / 5)
+	defer tick.Stop()
+	for range tick.C {
+		b.mu.Lock()
+		for mac, e := range b.macs {
+			if !e.fresh() {
+				delete(b.macs, mac)
+			}
+		}
+
+		for ip, e := range b.arps {
+			if time.Since(e.seen) >= bridgeAgeing {
+				delete(b.arps, ip)
+			}
+		}
+		bridgeMACs.Set(float64(len(b.macs)))
+		b.mu.Unlock()
+	}
+}
+
+// outboundFrame forwards ethernet frame of nr bytes
+// at buf[cryptoHeaderLen:] read from tap queue q.
+// buf is owned by outboundFrame
+func (s *Server) outboundFrame(buf *[]byte, nr, q int, sendQueue chan *datagram) {
+	f := Frame((*buf)[cryptoHeaderLen : cryptoHeaderLen+nr])
+	if f.Invalid() {
+		droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+		putBuf(buf)
+		return
+	}
+
+	if f.IsIP() {
+		p := Packet(f.Payload())
+		if !p.Invalid() && !s.allow(p, aclOut) {
+			log.Debug("acl deny %s => %s", p.Src(), p.Dst())
+			droppedPackets.WithLabelValues(dropACLDeny).Inc()
+			putBuf(buf)
+			return
+		}
+	}
+
+	if s.proxyARP(f, q) {
+		putBuf(buf)
+		return
+	}
+
+	AddTrafficOut(int64(nr))
+
+	if !f.IsMulticast() {
+		if peer := s.bridge.lookup(f.DstMAC()); len(peer) > 0 {
+			s.shape(buf, nr, q, peer, sendQueue)
+			return
+		}
+	}
+
+	// flood to all peers
+	peers := s.bridge.peerList()
+	if len(peers) == 0 {
+		droppedPackets.WithLabelValues(dropNoRoute).Inc()
+		putBuf(buf)
+		return
+	}
+
+	floodFrames.Inc()
+	for _, peer := range peers[:len(peers)-1] {
+		dup := getBuf()
+		copy((*dup)[cryptoHeaderLen:], f)
+		s.shape(dup, nr, q, peer, sendQueue)
+	}
+	s.shape(buf, nr, q, peers[len(peers)-1], sendQueue)
+}
+
+// inboundFrame checks ethernet frame from peers
+// and learns src mac and arp of remote hosts
+func (s *Server) inboundFrame(f Frame, raddr *net.UDPAddr, relayFrom string, q int) error {
+	if f.Invalid() {
+		droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+		return errInvalidPacket
+	}
+
+	if f.IsIP() {
+		p := Packet(f.Payload())
+		if !p.Invalid() && !s.allow(p, aclIn) {
+			log.Debug("acl deny %s => %s", p.Src(), p.Dst())
+			droppedPackets.WithLabelValues(dropACLDeny).Inc()
+			return errACLDeny
+		}
+	}
+
+	src := f.SrcMAC()
+	if src[0]&0x01 == 0 && !s.bridge.touch(src, raddr, relayFrom) {
+		peer, addr := relayFrom, (*net.UDPAddr)(nil)
+		if len(peer) == 0 {
+			peer, addr = s.peerOf(raddr), raddr
+		}
+
+		if len(peer) > 0 {
+			s.bridge.learn(src, peer, addr)
+		}
+	}
+
+	if ip, mac, ok := parseARP(f); ok {
+		s.bridge.learnARP(ip, mac)
+	}
+	return nil
+}
+
+// peerOf returns listen address of peer at raddr
+func (s *Server) peerOf(raddr *net.UDPAddr) string {
+	s.epMu.RLock()
+	defer s.epMu.RUnlock()
+	for _, ep := range s.endpoints {
+		if ep.addr != nil && ep.addr.IP.Equal(raddr.IP) && ep.addr.Port == raddr.Port {
+			return ep.listenAddr
+		}
+	}
+	return ""
+}
+
+// proxyARP answers arp request for remote host
+// learned from peers, it returns true if answered
+func (s *Server) proxyARP(f Frame, q int) bool {
+	if f.EtherType() != etherTypeARP || len(f.Payload()) < arpLen {
+		return false
+	}
+
+	arp := f.Payload()
+	if binary.BigEndian.Uint16(arp[6:8]) != arpOpRequest {
+		return false
+	}
+
+	_, _, ok := parseARP(f)
+	spa, tpa := net.IP(arp[14:18]), net.IP(arp[24:28])
+	if !ok || spa.Equal(tpa) {
+		return false
+	}
+
+	mac := s.bridge.lookupARP(tpa)
+	if mac == nil {
+		return false
+	}
+
+	reply := make([]byte, etherHeaderLen+arpLen)
+	copy(reply[0:6], f.SrcMAC())
+	copy(reply[6:12], mac)
+	binary.BigEndian.PutUint16(reply[12:14], etherTypeARP)
+
+	r := reply[etherHeaderLen:]
+	copy(r[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(r[6:8], arpOpReply)
+	copy(r[8:14], mac)
+	copy(r[14:18], tpa)
+	copy(r[18:24], arp[8:14])
+	copy(r[24:28], spa)
+
+	_, err := s.iface.WriteQueue(q, reply)
+	if err != nil {
+		log.Error("write arp reply fail: %v", err)
+		return false
+	}
+
+	arpProxied.Inc()
+	return true
+}
+
+// parseARP returns sender ip and mac of ipv4 arp frame
+func parseARP(f Frame) (net.IP, net.HardwareAddr, bool) {
+	if f.EtherType() != etherTypeARP || len(f.Payload()) < arpLen {
+		return nil, nil, false
+	}
+
+	arp := f.Payload()
+	if binary.BigEndian.Uint16(arp[0:2]) != arpHTypeEther ||
+		binary.BigEndian.Uint16(arp[2:4]) != etherTypeIPv4 ||
+		arp[4] != 6 || arp[5] != 4 {
+		return nil, nil, false
+	}
+
+	ip := net.IP(arp[14:18])
+	if ip.IsUnspecified() {
+		return nil, nil, false
+	}
+	return ip, net.HardwareAddr(arp[8:14]), true
+}
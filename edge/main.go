@@ -3,69 +3,150 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/pki"
 )
 
 func main() {
-	logLevel := os.Getenv("LOG_LEVEL")
-	if len(logLevel) == 0 {
-		logLevel = "info"
+	cfg, args, err := LoadConfig(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// edge status|peers|routes: print state of running edge
+	if len(args) > 0 {
+		commands := map[string]func(string) error{
+			"status": printStatus,
+			"peers":  printPeers,
+			"routes": printRoutes,
+		}
+
+		cmd, ok := commands[args[0]]
+		if !ok {
+			fmt.Printf("usage: %s [-c config] [status|peers|routes]\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		err := cmd(cfg.StatusSock)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
 	}
-	log.Init("edge.log", logLevel, 3)
 
-	iface, err := NewInterface()
+	err = cfg.Verify()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	log.Init(cfg.Log.Path, cfg.Log.Level, cfg.Log.Days)
+	log.Debug("%v", cfg)
+
+	iface, err := NewInterface(cfg.Tun.Mode, cfg.Tun.Name, cfg.Tun.Queues)
 	if err != nil {
 		log.Error("[E] new interface fail: ", err)
 		return
 	}
 
 	defer iface.Close()
+
+	iface.SetRouteTable(cfg.Tun.RouteTable, cfg.Tun.RouteMetric)
+
+	// remove stale routes left by previous process
+	n, err := iface.FlushRoutes()
+	if err != nil {
+		log.Error("flush stale routes fail: %v", err)
+	}
+	log.Info("flush %d stale cframe routes", n)
+
+	err = iface.AddRule()
+	if err != nil {
+		log.Error("add rule fail: %v", err)
+		return
+	}
+
 	err = iface.Up()
 	if err != nil {
 		log.Error("up interface fail: %v", err)
 		return
 	}
 
-	err = iface.SetMTU(1400)
+	err = iface.SetMTU(cfg.Tun.MTU)
 	if err != nil {
 		log.Error("set mtu fail: %v", err)
 	}
 
-	// create cframe udp server
-	// just hard code listen address once without env var
-	lisAddr := ":58423"
-	lis := os.Getenv("listen")
-	if len(lis) > 0 {
-		lisAddr = lis
+	if len(cfg.Tun.Address) > 0 {
+		err = iface.SetAddr(cfg.Tun.Address)
+		if err != nil {
+			log.Error("set address fail: %v", err)
+		}
 	}
 
-	// create registry to get connect to controller
-	// just hard code controller address once without env var
-	ctrlAddr := "demo.notr.tech:58422"
-	ctrl := os.Getenv("controller")
-	if len(ctrl) > 0 {
-		ctrlAddr = ctrl
+	crypto, err := NewCrypto(cfg.Secret)
+	if err != nil {
+		log.Error("init crypto fail: %v", err)
+		return
 	}
 
-	// it is our secret
-	// read from env firstly
-	// if empty, use configuration
-	secret := os.Getenv("secret")
-	if len(secret) <= 0 {
-		log.Error("invalid secret")
-		return
+	lisAddr := cfg.ListenAddr
+	s := NewServer(lisAddr, crypto, iface)
+	s.SetMTU(cfg.Tun.MTU)
+
+	if len(cfg.MetricsAddr) > 0 {
+		go func() {
+			err := ServeMetrics(cfg.MetricsAddr)
+			if err != nil {
+				log.Error("serve metrics fail: %v", err)
+			}
+		}()
 	}
 
-	ns := os.Getenv("namespace")
-	if len(ns) <= 0 {
-		log.Info("use default namespace")
-		ns = "default"
+	// clean up routes on exit
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Info("receive signal, exit")
+		s.Close()
+		os.Exit(0)
+	}()
+
+	reg := NewRegistry(cfg.Controllers, cfg.Namespace, cfg.Secret, cfg.Name, s)
+	reg.SetIntervals(time.Duration(cfg.Stats.HeartbeatInterval)*time.Second,
+		time.Duration(cfg.Stats.ReportInterval)*time.Second)
+
+	go func() {
+		err := ServeStatus(cfg.StatusSock, s, reg)
+		if err != nil {
+			log.Error("serve status fail: %v", err)
+		}
+	}()
+
+	if cfg.TLSEnabled() {
+		tlsConfig, err := pki.NewClientTLSConfig(cfg.TLS.ServerName,
+			cfg.TLS.CA, cfg.TLS.Pin, cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			log.Error("load tls config fail: %v", err)
+			return
+		}
+		reg.SetTLSConfig(tlsConfig)
 	}
 
-	s := NewServer(lisAddr, secret, iface)
+	// udp socket is required by registry probe
+	err = s.Listen()
+	if err != nil {
+		log.Error("listen %s fail: %v", lisAddr, err)
+		return
+	}
 
-	reg := NewRegistry(ctrlAddr, ns, secret, os.Getenv("name"), s)
 	go func() {
 		err := reg.Run()
 		if err != nil {
@@ -74,5 +155,5 @@ func main() {
 		}
 	}()
 
-	s.ListenAndServe()
+	s.Serve()
 }
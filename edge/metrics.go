@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// drop reasons
+const (
+	dropBadKey        = "bad_key"
+	dropInvalidPacket = "invalid_packet"
+	dropNoRoute       = "no_route"
+	dropSendFail      = "send_fail"
+	dropACLDeny       = "acl_deny"
+	dropTooBig        = "too_big"
+	dropRateLimit     = "rate_limit"
+)
+
+// punch results
+const (
+	punchSuccessResult = "success"
+	punchTimeoutResult = "timeout"
+)
+
+// peer paths
+const (
+	pathDirect = "direct"
+	pathRelay  = "relay"
+)
+
+// peer label is listen address of peer edge, series
+// of peer are deleted when its endpoint is deleted
+var (
+	peerBytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "peer_bytes_in_total",
+		Help:      "bytes received from peer edge",
+	}, []string{"peer"})
+
+	peerBytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "peer_bytes_out_total",
+		Help:      "bytes sent to peer edge",
+	}, []string{"peer"})
+
+	peerPacketsIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "peer_packets_in_total",
+		Help:      "packets received from peer edge",
+	}, []string{"peer"})
+
+	peerPacketsOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "peer_packets_out_total",
+		Help:      "packets sent to peer edge",
+	}, []string{"peer"})
+
+	droppedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "dropped_packets_total",
+		Help:      "dropped packets by reason",
+	}, []string{"reason"})
+
+	routeTableSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cframe_edge",
+		Name:      "route_table_size",
+		Help:      "count of routes in peer route table",
+	})
+
+	registryReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "registry_reconnects_total",
+		Help:      "reconnects to controller",
+	})
+
+	heartbeatRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cframe_edge",
+		Name:      "heartbeat_rtt_seconds",
+		Help:      "heartbeat round trip time to controller",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	punchResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "punch_total",
+		Help:      "hole punching results",
+	}, []string{"result"})
+
+	peerRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cframe_edge",
+		Name:      "peer_rtt_seconds",
+		Help:      "average probe round trip time to peer edge",
+	}, []string{"peer"})
+
+	peerLoss = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cframe_edge",
+		Name:      "peer_loss_ratio",
+		Help:      "probe loss ratio to peer edge",
+	}, []string{"peer"})
+
+	pathSwitches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "path_switches_total",
+		Help:      "peers switched to direct or relay path",
+	}, []string{"path"})
+
+	aclHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "acl_hits_total",
+		Help:      "packets matched acl rule",
+	}, []string{"rule", "action", "direction"})
+
+	aclRules = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cframe_edge",
+		Name:      "acl_rules",
+		Help:      "count of acl rules",
+	})
+
+	bridgeMACs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cframe_edge",
+		Name:      "bridge_macs",
+		Help:      "count of mac addresses learned from peers in tap mode",
+	})
+
+	floodFrames = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "flood_frames_total",
+		Help:      "broadcast, multicast and unknown unicast frames flooded to peers",
+	})
+
+	arpProxied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "arp_proxied_total",
+		Help:      "arp requests answered locally for remote hosts",
+	})
+
+	fragmentedPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "fragmented_packets_total",
+		Help:      "ipv4 packets fragmented to fit path mtu of peer",
+	})
+
+	clampedSYNs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "mss_clamped_total",
+		Help:      "tcp syn with mss lowered to fit path mtu of peer",
+	})
+
+	fecRecovered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "fec_recovered_packets_total",
+		Help:      "packets from peers recovered by fec",
+	})
+
+	fecLost = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "fec_lost_packets_total",
+		Help:      "packets from peers lost even with fec",
+	})
+
+	compressInBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "compress_in_bytes_total",
+		Help:      "bytes of packets to peers before compression",
+	})
+
+	compressOutBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "compress_out_bytes_total",
+		Help:      "bytes of packets to peers after compression",
+	})
+
+	incompressiblePackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "incompressible_packets_total",
+		Help:      "packets to peers sent raw since compression does not help",
+	})
+
+	rateLimitBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "rate_limit_bytes_total",
+		Help:      "bytes of packets passed rate limit",
+	}, []string{"limit"})
+
+	rateLimitDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cframe_edge",
+		Name:      "rate_limit_dropped_total",
+		Help:      "packets dropped since queue of rate limit is full",
+	}, []string{"limit", "band"})
+)
+
+func init() {
+	prometheus.MustRegister(peerBytesIn, peerBytesOut,
+		peerPacketsIn, peerPacketsOut, droppedPackets,
+		routeTableSize, registryReconnects, heartbeatRTT,
+		punchResults, pathSwitches, peerRTT, peerLoss,
+		aclHits, aclRules, bridgeMACs, floodFrames, arpProxied,
+		fragmentedPackets, clampedSYNs, fecRecovered, fecLost,
+		compressInBytes, compressOutBytes, incompressiblePackets,
+		rateLimitBytes, rateLimitDropped)
+}
+
+// peerCounters are traffic counters of peer labelled by listen
+// address, cached by endpoint and stream so that labels are
+// not looked up per packet. nil counters count nothing
+type peerCounters struct {
+	bytesIn    prometheus.Counter
+	packetsIn  prometheus.Counter
+	bytesOut   prometheus.Counter
+	packetsOut prometheus.Counter
+}
+
+func newPeerCounters(peer string) *peerCounters {
+	return &peerCounters{
+		bytesIn:    peerBytesIn.WithLabelValues(peer),
+		packetsIn:  peerPacketsIn.WithLabelValues(peer),
+		bytesOut:   peerBytesOut.WithLabelValues(peer),
+		packetsOut: peerPacketsOut.WithLabelValues(peer),
+	}
+}
+
+// deletePeerMetrics removes all series of peer
+func deletePeerMetrics(peer string) {
+	peerBytesIn.DeleteLabelValues(peer)
+	peerPacketsIn.DeleteLabelValues(peer)
+	peerBytesOut.DeleteLabelValues(peer)
+	peerPacketsOut.DeleteLabelValues(peer)
+	peerRTT.DeleteLabelValues(peer)
+	peerLoss.DeleteLabelValues(peer)
+}
+
+func (c *peerCounters) addIn(n int) {
+	if c != nil {
+		c.bytesIn.Add(float64(n))
+		c.packetsIn.Inc()
+	}
+}
+
+func (c *peerCounters) addOut(n int) {
+	if c != nil {
+		c.bytesOut.Add(float64(n))
+		c.packetsOut.Inc()
+	}
+}
+
+// ServeMetrics serves prometheus metrics on addr
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
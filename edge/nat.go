@@ -0,0 +1,482 @@
+package main
+
+// nat traversal between edges
+//  1. edge probes controller over udp from the peer socket,
+//     controller learns public endpoint of edge from source address
+//  2. controller distributes public endpoint in online msg
+//     to both edges at the same time
+//  3. both edges send punch packets to public endpoint of each other,
+//     the first authenticated punch or ack received opens the path
+//  4. if nothing received in punchTimeout, packets are relayed
+//     by controller if it is enabled, otherwise still sent to
+//     the listen address of peer
+//  5. punch packets are sent to peers periodically as direct probes,
+//     peer is switched to relay if no reply in peerTimeout
+//     and switched back once any reply received, see probe.go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+const (
+	punchInterval = time.Millisecond * 200
+	punchTimeout  = time.Second * 10
+
+	// direct probe to peers, also keeps nat mappings alive
+	peerProbeInterval = time.Second * 5
+	peerTimeout       = time.Second * 15
+
+	// probe controller quickly until public endpoint learned
+	// then keep nat mapping alive
+	probeInterval  = time.Second * 3
+	probeKeepalive = time.Second * 20
+)
+
+// control packets are carried in crypto envelope
+// the first byte of plaintext is 0, never a valid ip version,
+// and it is shorter than any ip packet or ethernet frame
+// seq is echoed in reply for rtt and loss, 0 if not measured
+// | 1byte 0x00 | 1byte type | 8bytes seq |
+const (
+	ctrlPunch    = 0x01
+	ctrlPunchAck = 0x02
+
+	// probe and echo via relay
+	ctrlProbe = 0x03
+	ctrlEcho  = 0x04
+
+	// path mtu probe and ack, see pmtu.go
+	ctrlMTUProbe = 0x05
+	ctrlMTUAck   = 0x06
+
+	ctrlLen = 10
+)
+
+// endpoint of peer edge
+type endpoint struct {
+	// static listen address, identity of peer
+	listenAddr string
+
+	// transport of listen address, see transport.go
+	transport string
+
+	// public udp endpoint observed by controller
+	publicAddr string
+
+	// address that packets sent to
+	addr *net.UDPAddr
+
+	// punch succeed, addr is public endpoint
+	punched bool
+
+	// last time punch or ack received directly
+	lastSeen time.Time
+
+	// packets are relayed by controller
+	relay bool
+
+	// stream connected to peer, packets are sent
+	// via stream instead of udp if not nil
+	stream  *stream
+	dialing bool
+	dialAt  time.Time
+
+	// fec of udp packets, nil if disabled
+	fec *fecEncoder
+
+	// health of active path
+	stats probeStats
+
+	// probes replied in peerTimeout
+	up bool
+
+	// path mtu of direct path
+	mtu pmtuState
+
+	counters *peerCounters
+}
+
+func (s *Server) newEndpoint(listenAddr string) *endpoint {
+	transport, _ := s.transportOf(listenAddr)
+	return &endpoint{
+		listenAddr: listenAddr,
+		transport:  transport,
+		lastSeen:   time.Now(),
+		up:         true,
+		counters:   newPeerCounters(listenAddr),
+	}
+}
+
+// path of packets to peer
+type path struct {
+	addr     *net.UDPAddr
+	relay    bool
+	stream   *stream
+	fec      *fecEncoder
+	mtu      int
+	counters *peerCounters
+}
+
+// peerIndex finds counters of peer of inbound packets
+// by udp address or listen address without lock
+type peerIndex struct {
+	byAddr   map[netip.AddrPort]*peerCounters
+	byListen map[string]*peerCounters
+}
+
+// indexPeers rebuilds index of endpoints,
+// caller must hold epMu
+func (s *Server) indexPeers() {
+	idx := &peerIndex{
+		byAddr:   make(map[netip.AddrPort]*peerCounters),
+		byListen: make(map[string]*peerCounters),
+	}
+
+	for _, ep := range s.endpoints {
+		idx.byListen[ep.listenAddr] = ep.counters
+		if ep.addr != nil {
+			idx.byAddr[addrPort(ep.addr)] = ep.counters
+		}
+		if ap, err := netip.ParseAddrPort(ep.publicAddr); err == nil {
+			idx.byAddr[netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())] = ep.counters
+		}
+	}
+	s.peers.Store(idx)
+}
+
+// peerCountersOf returns counters of peer of inbound packet,
+// from is listen address of peer if relayed or via stream
+func (s *Server) peerCountersOf(raddr *net.UDPAddr, from string) *peerCounters {
+	idx, _ := s.peers.Load().(*peerIndex)
+	if idx == nil {
+		return nil
+	}
+
+	if len(from) > 0 {
+		return idx.byListen[from]
+	}
+	return idx.byAddr[addrPort(raddr)]
+}
+
+func addrPort(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func isCtrl(pkt []byte) bool {
+	return len(pkt) >= 2 && len(pkt) < etherHeaderLen && pkt[0] == 0
+}
+
+func ctrlSeq(pkt []byte) uint64 {
+	if len(pkt) < ctrlLen {
+		return 0
+	}
+	return binary.BigEndian.Uint64(pkt[2:ctrlLen])
+}
+
+// SetPublicAddr sets public endpoint of current edge
+func (s *Server) SetPublicAddr(addr string) {
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	s.publicAddr = addr
+}
+
+func (s *Server) PublicAddr() string {
+	s.epMu.RLock()
+	defer s.epMu.RUnlock()
+	return s.publicAddr
+}
+
+// send sends sealed packet to peer listenAddr
+// directly, via stream or relayed by controller
+func (s *Server) send(listenAddr string, buf []byte) error {
+	p, err := s.endpoint(listenAddr)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case p.stream != nil:
+		p.stream.send(&datagram{data: buf})
+		return nil
+	case p.relay:
+		return s.sendRelay(listenAddr, buf)
+	}
+
+	_, err = s.conn.WriteToUDP(buf, p.addr)
+	return err
+}
+
+// endpoint returns path to peer listenAddr, stream of peer
+// is dialed if not connected and errStreamDialing is returned
+func (s *Server) endpoint(listenAddr string) (path, error) {
+	s.epMu.RLock()
+	ep := s.endpoints[listenAddr]
+	if ep != nil && (ep.addr != nil || ep.relay || ep.stream != nil) {
+		p := path{ep.addr, ep.relay, ep.stream, ep.fec, s.mtuOf(ep), ep.counters}
+		s.epMu.RUnlock()
+		return p, nil
+	}
+	s.epMu.RUnlock()
+
+	transport, hostport := s.transportOf(listenAddr)
+	if transport != codec.TransportUDP {
+		s.epMu.Lock()
+		defer s.epMu.Unlock()
+		ep = s.endpoints[listenAddr]
+		if ep == nil {
+			ep = s.newEndpoint(listenAddr)
+			s.endpoints[listenAddr] = ep
+			s.indexPeers()
+		}
+
+		if ep.stream != nil {
+			return path{stream: ep.stream, mtu: s.mtuOf(ep), counters: ep.counters}, nil
+		}
+		s.redial(ep)
+		return path{}, errStreamDialing
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return path{}, err
+	}
+
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	ep = s.endpoints[listenAddr]
+	if ep == nil {
+		ep = s.newEndpoint(listenAddr)
+		s.endpoints[listenAddr] = ep
+	}
+	if ep.addr == nil {
+		ep.addr = raddr
+		s.indexPeers()
+	}
+	return path{ep.addr, ep.relay, ep.stream, ep.fec, s.mtuOf(ep), ep.counters}, nil
+}
+
+// setEndpoint updates public endpoint of peer
+// and start punching if it changed
+func (s *Server) setEndpoint(listenAddr, publicAddr string) {
+	// resolve listen address for direct probes
+	// or dial stream of peer
+	_, err := s.endpoint(listenAddr)
+	if err != nil && err != errStreamDialing {
+		log.Error("resolve %s fail: %v", listenAddr, err)
+	}
+
+	if len(publicAddr) == 0 {
+		return
+	}
+
+	s.epMu.Lock()
+	ep := s.endpoints[listenAddr]
+	if ep == nil {
+		ep = s.newEndpoint(listenAddr)
+		s.endpoints[listenAddr] = ep
+		s.indexPeers()
+	}
+
+	// nat traversal is for udp only
+	if ep.transport != codec.TransportUDP {
+		s.epMu.Unlock()
+		return
+	}
+
+	if ep.publicAddr == publicAddr && ep.punched {
+		s.epMu.Unlock()
+		return
+	}
+	ep.publicAddr = publicAddr
+	ep.punched = false
+	s.indexPeers()
+	s.epMu.Unlock()
+
+	go s.punch(listenAddr, publicAddr)
+}
+
+func (s *Server) delEndpoint(listenAddr string) {
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	if ep := s.endpoints[listenAddr]; ep != nil && ep.stream != nil {
+		ep.stream.close()
+	}
+	delete(s.endpoints, listenAddr)
+	s.indexPeers()
+	deletePeerMetrics(listenAddr)
+}
+
+// punch sends punch packets to public endpoint of peer
+// until any punch packet received from it or timeout
+func (s *Server) punch(listenAddr, publicAddr string) {
+	raddr, err := net.ResolveUDPAddr("udp", publicAddr)
+	if err != nil {
+		log.Error("resolve %s fail: %v", publicAddr, err)
+		return
+	}
+
+	log.Info("punching peer %s via %s", listenAddr, publicAddr)
+	deadline := time.Now().Add(punchTimeout)
+	for time.Now().Before(deadline) {
+		s.epMu.RLock()
+		ep := s.endpoints[listenAddr]
+		done := ep == nil || ep.publicAddr != publicAddr || ep.punched
+		s.epMu.RUnlock()
+		if done {
+			return
+		}
+
+		err := s.sendCtrl(ctrlPunch, raddr, 0)
+		if err != nil {
+			log.Error("send punch to %s fail: %v", raddr, err)
+		}
+		time.Sleep(punchInterval)
+	}
+
+	punchResults.WithLabelValues(punchTimeoutResult).Inc()
+
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	ep := s.endpoints[listenAddr]
+	if ep == nil || ep.punched {
+		return
+	}
+
+	if len(s.relayToken) > 0 && !ep.relay {
+		log.Warn("punch peer %s via %s timeout, switch to relay",
+			listenAddr, publicAddr)
+		ep.relay = true
+		pathSwitches.WithLabelValues(pathRelay).Inc()
+		return
+	}
+
+	log.Warn("punch peer %s via %s timeout, fallback to listen address",
+		listenAddr, publicAddr)
+}
+
+// onCtrl handles control packets from peers
+// from is listen address of peer if relayed or via stream
+func (s *Server) onCtrl(pkt []byte, raddr *net.UDPAddr, from string) {
+	seq := ctrlSeq(pkt)
+	if len(from) > 0 {
+		s.onRelayCtrl(pkt[1], from, seq)
+		return
+	}
+
+	switch pkt[1] {
+	case ctrlPunch:
+		s.seen(raddr, false, 0)
+		err := s.sendCtrl(ctrlPunchAck, raddr, seq)
+		if err != nil {
+			log.Error("send punch ack to %s fail: %v", raddr, err)
+		}
+
+	case ctrlPunchAck:
+		s.seen(raddr, true, seq)
+
+	case ctrlMTUAck:
+		s.onMTUAck(raddr, seq)
+
+	default:
+		log.Debug("unknown control packet %d from %s", pkt[1], raddr)
+	}
+}
+
+// seen switches peer at raddr to public endpoint if punching,
+// ack proves round trip so peer is marked alive
+// and switched back from relay
+func (s *Server) seen(raddr *net.UDPAddr, ack bool, seq uint64) {
+	addr := raddr.String()
+
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	for _, ep := range s.endpoints {
+		direct := ep.addr != nil && ep.addr.String() == addr
+		if ep.publicAddr != addr && !direct {
+			continue
+		}
+
+		if ep.publicAddr == addr && !ep.punched {
+			log.Info("punch peer %s via %s OK", ep.listenAddr, addr)
+			punchResults.WithLabelValues(punchSuccessResult).Inc()
+			ep.addr = raddr
+			ep.punched = true
+			s.indexPeers()
+
+			// search path mtu of new path
+			ep.mtu = pmtuState{seq: ep.mtu.seq}
+		}
+
+		if !ack {
+			continue
+		}
+
+		ep.lastSeen = time.Now()
+		ep.stats.reply(seq)
+		if ep.relay {
+			log.Info("peer %s is reachable via %s, switch to direct", ep.listenAddr, addr)
+			ep.relay = false
+			pathSwitches.WithLabelValues(pathDirect).Inc()
+		}
+	}
+}
+
+func (s *Server) sendCtrl(typ byte, raddr *net.UDPAddr, seq uint64) error {
+	buf, err := s.sealCtrl(typ, seq)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.WriteToUDP(buf, raddr)
+	return err
+}
+
+func (s *Server) sealCtrl(typ byte, seq uint64) ([]byte, error) {
+	pkt := make([]byte, ctrlLen)
+	pkt[1] = typ
+	binary.BigEndian.PutUint64(pkt[2:], seq)
+	return s.crypto.Seal(pkt)
+}
+
+// probe sends udp probe to controller srv from peer socket
+// until done closed
+func (r *Registry) probe(srv, token string, done chan struct{}) {
+	raddr, err := net.ResolveUDPAddr("udp", srv)
+	if err != nil {
+		log.Error("resolve %s fail: %v", srv, err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = codec.WriteJSON(buf, codec.CmdProbe, &codec.ProbeMsg{Token: token})
+	if err != nil {
+		log.Error("encode probe fail: %v", err)
+		return
+	}
+
+	for {
+		_, err := r.server.conn.WriteToUDP(buf.Bytes(), raddr)
+		if err != nil {
+			log.Error("send probe to %s fail: %v", raddr, err)
+		}
+
+		interval := probeKeepalive
+		if len(r.server.PublicAddr()) == 0 {
+			interval = probeInterval
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
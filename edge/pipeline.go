@@ -0,0 +1,439 @@
+package main
+
+// packet pipeline between tun and peers
+//  1. each tun queue is read by one goroutine,
+//     packets are routed and sealed in place then queued
+//     to the writer of a udp socket, packets matched by
+//     rate limits are queued by dscp priority, see shaper.go
+//  2. each udp socket(SO_REUSEPORT) has one writer that sends
+//     queued packets in batch(sendmmsg) and one reader that
+//     receives packets in batch(recvmmsg)
+//  3. buffers are taken from bufPool and returned once sent
+//     or written to tun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// holds any udp datagram
+	bufSize = 1 << 16
+
+	// packets per recvmmsg/sendmmsg
+	batchSize = 32
+
+	// packets queued to each writer
+	sendQueueSize = batchSize * 4
+
+	// socket buffer of udp sockets
+	sockBufSize = 4 << 20
+)
+
+var (
+	errInvalidPacket = errors.New("invalid ip packet")
+	errACLDeny       = errors.New("denied by acl")
+)
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, bufSize)
+		return &buf
+	},
+}
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(buf *[]byte) {
+	bufPool.Put(buf)
+}
+
+// batchConn is implemented by ipv4.PacketConn and ipv6.PacketConn
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	if laddr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+
+	// unspecified address is dual stack
+	return ipv6.NewPacketConn(conn)
+}
+
+// datagram is a sealed packet queued to writer
+type datagram struct {
+	buf      *[]byte
+	data     []byte
+	addr     *net.UDPAddr
+	counters *peerCounters
+}
+
+// listenUDP creates udp sockets sharing laddr,
+// SO_REUSEPORT is set if more than one socket.
+// DF is set for path mtu probes, see pmtu.go
+func listenUDP(laddr string, count int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		var operr error
+		err := c.Control(func(fd uintptr) {
+			// fails for sockets of the other family
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+
+			if count > 1 {
+				operr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return operr
+	}
+
+	conns := make([]*net.UDPConn, 0, count)
+	for i := 0; i < count; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", laddr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		lconn := conn.(*net.UDPConn)
+		lconn.SetReadBuffer(sockBufSize)
+		lconn.SetWriteBuffer(sockBufSize)
+		conns = append(conns, lconn)
+
+		// the others share port of the first one
+		if i == 0 {
+			laddr = lconn.LocalAddr().String()
+		}
+	}
+	return conns, nil
+}
+
+// readLocal reads packets from tun queue q
+// and queues them to writer of udp socket
+func (s *Server) readLocal(q int) {
+	sendQueue := s.sendQueues[q%len(s.sendQueues)]
+	maxRead := bufSize - s.crypto.Overhead() - fecOverhead
+	for {
+		buf := getBuf()
+		nr, err := s.iface.ReadQueue(q, (*buf)[cryptoHeaderLen:maxRead])
+		if err != nil {
+			log.Error("read iface error: %v", err)
+			putBuf(buf)
+			continue
+		}
+
+		if s.tap {
+			s.outboundFrame(buf, nr, q, sendQueue)
+			continue
+		}
+
+		peer, err := s.outbound(buf, nr)
+		if err != nil {
+			putBuf(buf)
+			continue
+		}
+		s.shape(buf, nr, q, peer, sendQueue)
+	}
+}
+
+// outbound returns peer of ip packet of nr bytes
+// at buf[cryptoHeaderLen:]
+func (s *Server) outbound(buf *[]byte, nr int) (string, error) {
+	pkt := (*buf)[cryptoHeaderLen : cryptoHeaderLen+nr]
+	p := Packet(pkt)
+	if p.Invalid() {
+		log.Error("invalid ip packet")
+		droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+		return "", errInvalidPacket
+	}
+
+	if !s.allow(p, aclOut) {
+		log.Debug("acl deny %s => %s", p.Src(), p.Dst())
+		droppedPackets.WithLabelValues(dropACLDeny).Inc()
+		return "", errACLDeny
+	}
+
+	AddTrafficOut(int64(nr))
+	log.Debug("tuple %s => %s", p.Src(), p.Dst())
+
+	peer, err := s.route(p)
+	if err != nil {
+		log.Error("[E] not route to host: ", p.Dst())
+		droppedPackets.WithLabelValues(dropNoRoute).Inc()
+		return "", err
+	}
+	return peer, nil
+}
+
+// forward seals packet of nr bytes at buf[cryptoHeaderLen:]
+// read from tun queue q and queues it to writer or stream,
+// or sends it via relay. buf is owned by forward
+func (s *Server) forward(buf *[]byte, nr, q int, peer string, sendQueue chan *datagram) {
+	path, err := s.endpoint(peer)
+	if err != nil {
+		if err != errStreamDialing {
+			log.Error("%v", err)
+		}
+		droppedPackets.WithLabelValues(dropSendFail).Inc()
+		putBuf(buf)
+		return
+	}
+
+	if !s.tap {
+		if nr > path.mtu {
+			s.oversize(buf, nr, path.mtu, q, peer, sendQueue)
+			return
+		}
+		clampMSS(Packet((*buf)[cryptoHeaderLen:cryptoHeaderLen+nr]), path.mtu)
+	}
+
+	buf, nr, version := s.compressPacket(buf, nr)
+	data, err := s.crypto.SealInPlaceVersion(version, (*buf)[:cryptoHeaderLen+nr])
+	if err != nil {
+		log.Error("seal packet fail: %v", err)
+		droppedPackets.WithLabelValues(dropSendFail).Inc()
+		putBuf(buf)
+		return
+	}
+
+	switch {
+	case path.stream != nil:
+		path.stream.send(&datagram{buf: buf, data: data})
+	case path.fec != nil:
+		s.forwardFEC(buf, data, path, peer, sendQueue)
+	default:
+		s.sendPath(path, peer, &datagram{buf: buf, data: data}, sendQueue)
+	}
+}
+
+// sendPath queues datagram d to writer or sends it via relay
+// according to path p of peer. d.buf is owned by sendPath
+func (s *Server) sendPath(p path, peer string, d *datagram, sendQueue chan *datagram) {
+	if !p.relay {
+		d.addr, d.counters = p.addr, p.counters
+		sendQueue <- d
+		return
+	}
+
+	err := s.sendRelay(peer, d.data)
+	putBuf(d.buf)
+	if err != nil {
+		log.Error("%v", err)
+		droppedPackets.WithLabelValues(dropSendFail).Inc()
+		return
+	}
+
+	p.counters.addOut(len(d.data))
+}
+
+// writeRemote sends queued datagrams in batch
+func (s *Server) writeRemote(conn *net.UDPConn, sendQueue chan *datagram) {
+	bconn := newBatchConn(conn)
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+
+	batch := make([]*datagram, 0, batchSize)
+	for d := range sendQueue {
+		batch = append(batch[:0], d)
+
+		// take what is queued without waiting
+	drain:
+		for len(batch) < batchSize {
+			select {
+			case d := <-sendQueue:
+				batch = append(batch, d)
+			default:
+				break drain
+			}
+		}
+
+		for i, d := range batch {
+			msgs[i].Buffers[0] = d.data
+			msgs[i].Addr = d.addr
+		}
+
+		sent := 0
+		for sent < len(batch) {
+			n, err := bconn.WriteBatch(msgs[sent:len(batch)], 0)
+			if err != nil {
+				// skip the failed one
+				log.Error("send to %s fail: %v", batch[sent].addr, err)
+				droppedPackets.WithLabelValues(dropSendFail).Inc()
+				n = 1
+			} else {
+				for _, d := range batch[sent : sent+n] {
+					d.counters.addOut(len(d.data))
+				}
+			}
+			sent += n
+		}
+
+		for i, d := range batch {
+			msgs[i].Buffers[0] = nil
+			msgs[i].Addr = nil
+			putBuf(d.buf)
+		}
+	}
+}
+
+// readRemote receives datagrams from peers in batch
+// and writes packets to tun queue q
+func (s *Server) readRemote(conn *net.UDPConn, q int) {
+	bconn := newBatchConn(conn)
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{*getBuf()}
+	}
+
+	for {
+		nr, err := bconn.ReadBatch(msgs, 0)
+		if err != nil {
+			log.Error("read full fail: %v", err)
+			continue
+		}
+
+		for i := 0; i < nr; i++ {
+			raddr, ok := msgs[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			s.inbound(msgs[i].Buffers[0][:msgs[i].N], raddr, q)
+		}
+	}
+}
+
+// inbound handles datagram buf received from raddr
+func (s *Server) inbound(buf []byte, raddr *net.UDPAddr, q int) {
+	if s.demux(buf, raddr) {
+		return
+	}
+
+	from := ""
+	if s.isRelay(buf, raddr) {
+		var err error
+		buf, from, err = openRelay(buf)
+		if err != nil {
+			log.Error("invalid relay packet: %v", err)
+			droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+			return
+		}
+
+		if !s.isPeer(from) {
+			droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+			return
+		}
+	}
+
+	if len(buf) > 0 && buf[0] == fecVersion {
+		s.inboundFEC(buf, raddr, from, q)
+		return
+	}
+
+	s.deliver(buf, raddr, from, q)
+}
+
+// deliver opens sealed packet buf and writes it to tun queue q
+// from is listen address of peer if relayed or via stream,
+// raddr is nil if via stream
+func (s *Server) deliver(buf []byte, raddr *net.UDPAddr, from string, q int) {
+	nr := len(buf)
+	var version byte
+	if len(buf) > 0 {
+		version = buf[0]
+	}
+
+	pkt, err := s.crypto.Open(buf)
+	if err != nil {
+		src := from
+		if raddr != nil {
+			src = raddr.String()
+		}
+		log.Error("access forbidden from %s: %v", src, err)
+		droppedPackets.WithLabelValues(dropBadKey).Inc()
+		return
+	}
+
+	if version == cryptoVersionProbe {
+		if len(from) == 0 {
+			s.onMTUProbe(pkt, raddr)
+		}
+		return
+	}
+
+	pkt, dbuf, err := decompress(version, pkt)
+	if err != nil {
+		log.Error("decompress packet fail: %v", err)
+		droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+		return
+	}
+	if dbuf != nil {
+		defer putBuf(dbuf)
+	}
+
+	if isCtrl(pkt) {
+		s.onCtrl(pkt, raddr, from)
+		return
+	}
+
+	if s.tap {
+		err = s.inboundFrame(Frame(pkt), raddr, from, q)
+	} else {
+		err = s.inboundPacket(Packet(pkt), raddr, from)
+	}
+	if err != nil {
+		return
+	}
+
+	AddTrafficIn(int64(nr))
+	s.peerCountersOf(raddr, from).addIn(nr)
+
+	_, err = s.iface.WriteQueue(q, pkt)
+	if err != nil {
+		log.Error("write iface error: %v", err)
+		droppedPackets.WithLabelValues(dropSendFail).Inc()
+	}
+}
+
+// inboundPacket checks ip packet from peers
+// and clamps mss of tcp syn to path mtu
+func (s *Server) inboundPacket(p Packet, raddr *net.UDPAddr, relayFrom string) error {
+	if p.Invalid() {
+		log.Error("invalid ip packet")
+		droppedPackets.WithLabelValues(dropInvalidPacket).Inc()
+		return errInvalidPacket
+	}
+
+	if !s.allow(p, aclIn) {
+		log.Debug("acl deny %s => %s", p.Src(), p.Dst())
+		droppedPackets.WithLabelValues(dropACLDeny).Inc()
+		return errACLDeny
+	}
+
+	if tcpSYN(p) != nil {
+		clampMSS(p, s.mtuFrom(raddr, relayFrom))
+	}
+
+	log.Debug("tuple %s => %s", p.Src(), p.Dst())
+	return nil
+}
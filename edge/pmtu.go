@@ -0,0 +1,455 @@
+package main
+
+// path mtu of peers, in tun mode only
+//  1. udp sockets set DF without using kernel path mtu cache,
+//     so oversized datagrams are dropped instead of fragmented
+//  2. padded probes are sent to direct peers, the largest acked
+//     size in binary search between minPMTU and tun mtu
+//     is the path mtu, the search restarts every pmtuResearch
+//  3. ip packets larger than path mtu of peer are fragmented
+//     if ipv4 without DF, otherwise icmp fragmentation needed
+//     or packet too big is written back to tun
+//  4. mss of tcp syn in both directions is clamped to path mtu
+//  5. relayed peers use tun mtu
+//
+// sizes are of plaintext, the same as ip packets in tun
+// probe: | 0x00 | ctrlMTUProbe | 8bytes seq | padding |
+// sealed with cryptoVersionProbe, acked by ctrlMTUAck with seq
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+const (
+	defaultMTU = 1400
+
+	// ipv4 minimum mtu, never probed
+	minPMTU = 576
+
+	// ipv6 requires 1280 mtu of link
+	minIPv6MTU = 1280
+
+	// sealed packet with fec header must fit in a stream frame
+	maxMTU = maxFrameLen - cryptoHeaderLen - cryptoTagLen - fecOverhead
+
+	// probe of the same size lost pmtuProbeLoss times
+	// is too big for path
+	pmtuProbeLoss  = 2
+	pmtuProbeEvery = time.Second
+
+	// search path mtu again periodically
+	pmtuResearch = time.Minute * 10
+)
+
+// pmtuState is binary search of path mtu,
+// the first probe of each search is the upper bound
+type pmtuState struct {
+	// acked size and upper bound
+	lo int
+	hi int
+
+	// size and seq of probe in flight
+	probing int
+	seq     uint64
+	losses  int
+	full    bool
+
+	// path mtu used for packets, never larger than acked size
+	// except lowering upper bound during search
+	pmtu   int
+	done   bool
+	doneAt time.Time
+}
+
+func (m *pmtuState) search(max int) {
+	m.lo, m.hi = minPMTU, max
+	if max < minPMTU {
+		m.lo = max
+	}
+	m.probing, m.losses, m.full, m.done = 0, 0, false, false
+}
+
+// next returns size and seq of the next probe,
+// 0 if nothing to probe
+func (m *pmtuState) next(max int) (int, uint64) {
+	if m.pmtu == 0 || m.hi > max {
+		m.search(max)
+		m.pmtu = m.lo
+	}
+
+	if m.probing > 0 {
+		m.losses += 1
+		if m.losses < pmtuProbeLoss {
+			m.seq += 1
+			return m.probing, m.seq
+		}
+
+		m.hi = m.probing - 1
+		m.probing, m.losses = 0, 0
+		if m.pmtu > m.hi {
+			m.pmtu = m.hi
+		}
+	}
+
+	if m.lo >= m.hi {
+		if !m.done {
+			m.done, m.doneAt, m.pmtu = true, time.Now(), m.lo
+		}
+
+		if time.Since(m.doneAt) < pmtuResearch {
+			return 0, 0
+		}
+		m.search(max)
+	}
+
+	m.probing = (m.lo + m.hi + 1) / 2
+	if !m.full {
+		m.probing, m.full = m.hi, true
+	}
+	m.seq += 1
+	return m.probing, m.seq
+}
+
+func (m *pmtuState) ack(seq uint64) {
+	if m.probing == 0 || seq != m.seq {
+		return
+	}
+
+	m.lo = m.probing
+	m.probing, m.losses = 0, 0
+	if m.lo > m.pmtu {
+		m.pmtu = m.lo
+	}
+}
+
+// SetMTU sets mtu of tun, the max size of
+// ip packets sent to peers
+func (s *Server) SetMTU(mtu int) {
+	s.mtu = mtu
+}
+
+// mtuOf returns path mtu of endpoint, caller must hold epMu
+func (s *Server) mtuOf(ep *endpoint) int {
+	if ep == nil || ep.relay || ep.stream != nil || ep.mtu.pmtu == 0 || ep.mtu.pmtu > s.mtu {
+		return s.mtu
+	}
+	return ep.mtu.pmtu
+}
+
+type mtuProbe struct {
+	addr *net.UDPAddr
+	size int
+	seq  uint64
+}
+
+// probeMTU searches path mtu of direct peers
+func (s *Server) probeMTU() {
+	tick := time.NewTicker(pmtuProbeEvery)
+	defer tick.Stop()
+	for range tick.C {
+		probes := make([]mtuProbe, 0)
+		s.epMu.Lock()
+		for _, ep := range s.endpoints {
+			if ep.relay || ep.addr == nil {
+				continue
+			}
+
+			done := ep.mtu.done
+			size, seq := ep.mtu.next(s.mtu)
+			if ep.mtu.done && !done {
+				log.Info("path mtu of peer %s is %d", ep.listenAddr, ep.mtu.pmtu)
+			}
+
+			// probe with room of fec header
+			if size > 0 && ep.fec != nil {
+				size += fecOverhead
+			}
+
+			if size > 0 {
+				probes = append(probes, mtuProbe{ep.addr, size, seq})
+			}
+		}
+		s.epMu.Unlock()
+
+		for _, p := range probes {
+			err := s.sendMTUProbe(p.addr, p.size, p.seq)
+			if err != nil {
+				// EMSGSIZE if larger than mtu of local link
+				log.Debug("send mtu probe %d to %s fail: %v", p.size, p.addr, err)
+			}
+		}
+	}
+}
+
+func (s *Server) sendMTUProbe(raddr *net.UDPAddr, size int, seq uint64) error {
+	pkt := make([]byte, size)
+	pkt[1] = ctrlMTUProbe
+	binary.BigEndian.PutUint64(pkt[2:ctrlLen], seq)
+
+	buf, err := s.crypto.SealProbe(pkt)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.WriteToUDP(buf, raddr)
+	return err
+}
+
+// onMTUProbe acks padded probe from raddr
+func (s *Server) onMTUProbe(pkt []byte, raddr *net.UDPAddr) {
+	if len(pkt) < ctrlLen || pkt[0] != 0 || pkt[1] != ctrlMTUProbe {
+		return
+	}
+
+	err := s.sendCtrl(ctrlMTUAck, raddr, ctrlSeq(pkt))
+	if err != nil {
+		log.Error("send mtu ack to %s fail: %v", raddr, err)
+	}
+}
+
+func (s *Server) onMTUAck(raddr *net.UDPAddr, seq uint64) {
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	for _, ep := range s.endpoints {
+		if ep.addr != nil && ep.addr.IP.Equal(raddr.IP) && ep.addr.Port == raddr.Port {
+			ep.mtu.ack(seq)
+		}
+	}
+}
+
+// oversize handles ip packet of nr bytes at buf[cryptoHeaderLen:]
+// larger than mtu of peer, buf is owned by oversize
+func (s *Server) oversize(buf *[]byte, nr, mtu, q int, peer string, sendQueue chan *datagram) {
+	defer putBuf(buf)
+	p := Packet((*buf)[cryptoHeaderLen : cryptoHeaderLen+nr])
+
+	// fragment ipv4 packet without DF
+	if p.Version() == 4 && binary.BigEndian.Uint16(p[6:8])&0x4000 == 0 {
+		for _, frag := range fragmentIPv4(p, mtu) {
+			fbuf := getBuf()
+			n := copy((*fbuf)[cryptoHeaderLen:], frag)
+			s.forward(fbuf, n, q, peer, sendQueue)
+		}
+		fragmentedPackets.Inc()
+		return
+	}
+
+	droppedPackets.WithLabelValues(dropTooBig).Inc()
+	reply := tooBig(p, mtu)
+	if reply == nil {
+		return
+	}
+
+	_, err := s.iface.WriteQueue(q, reply)
+	if err != nil {
+		log.Error("write icmp too big fail: %v", err)
+	}
+}
+
+// fragmentIPv4 splits ipv4 packet p into fragments not
+// larger than mtu, options are copied to every fragment
+func fragmentIPv4(p Packet, mtu int) []Packet {
+	hlen := int(p[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(p[2:4]))
+	if total > len(p) || total < hlen {
+		total = len(p)
+	}
+
+	payload := p[hlen:total]
+	maxData := (mtu - hlen) &^ 7
+	if maxData <= 0 {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint16(p[6:8])
+	base := int(flags&0x1fff) * 8
+	more := flags&0x2000 != 0
+
+	frags := make([]Packet, 0, len(payload)/maxData+1)
+	for off := 0; off < len(payload); off += maxData {
+		n := maxData
+		if off+n > len(payload) {
+			n = len(payload) - off
+		}
+
+		frag := make(Packet, hlen+n)
+		copy(frag, p[:hlen])
+		copy(frag[hlen:], payload[off:off+n])
+
+		fo := uint16((base + off) / 8)
+		if more || off+n < len(payload) {
+			fo |= 0x2000
+		}
+		binary.BigEndian.PutUint16(frag[2:4], uint16(hlen+n))
+		binary.BigEndian.PutUint16(frag[6:8], fo)
+		binary.BigEndian.PutUint16(frag[10:12], 0)
+		binary.BigEndian.PutUint16(frag[10:12], checksum(frag[:hlen], 0))
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// tooBig returns icmp fragmentation needed for ipv4
+// or icmpv6 packet too big for ipv6, sent from dst of p.
+// nil is returned for icmp errors
+func tooBig(p Packet, mtu int) []byte {
+	if p.Version() == 6 {
+		proto, off, _ := p.transport()
+		if proto == protoICMPv6 && off >= 0 && len(p) > off && p[off] < 128 {
+			return nil
+		}
+
+		quote := len(p)
+		if quote > minIPv6MTU-40-8 {
+			quote = minIPv6MTU - 40 - 8
+		}
+
+		reply := make([]byte, 40+8+quote)
+		reply[0] = 0x60
+		binary.BigEndian.PutUint16(reply[4:6], uint16(8+quote))
+		reply[6] = protoICMPv6
+		reply[7] = 64
+		copy(reply[8:24], p.DstIP())
+		copy(reply[24:40], p.SrcIP())
+
+		icmp := reply[40:]
+		icmp[0] = 2
+		binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+		copy(icmp[8:], p[:quote])
+
+		// pseudo header
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:32], reply[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(icmp)))
+		pseudo[39] = protoICMPv6
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, sum(pseudo)))
+		return reply
+	}
+
+	hlen := int(p[0]&0x0f) * 4
+	if p.Proto() == protoICMP && len(p) > hlen && p[hlen] != 0 && p[hlen] != 8 {
+		return nil
+	}
+
+	quote := hlen + 8
+	if quote > len(p) {
+		quote = len(p)
+	}
+
+	reply := make([]byte, 20+8+quote)
+	reply[0] = 0x45
+	binary.BigEndian.PutUint16(reply[2:4], uint16(len(reply)))
+	reply[8] = 64
+	reply[9] = protoICMP
+	copy(reply[12:16], p.DstIP())
+	copy(reply[16:20], p.SrcIP())
+	binary.BigEndian.PutUint16(reply[10:12], checksum(reply[:20], 0))
+
+	icmp := reply[20:]
+	icmp[0] = 3
+	icmp[1] = 4
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[8:], p[:quote])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+	return reply
+}
+
+// mtuFrom returns path mtu of peer at raddr
+func (s *Server) mtuFrom(raddr *net.UDPAddr, relayFrom string) int {
+	if len(relayFrom) > 0 {
+		return s.mtu
+	}
+
+	s.epMu.RLock()
+	defer s.epMu.RUnlock()
+	for _, ep := range s.endpoints {
+		if ep.addr != nil && ep.addr.IP.Equal(raddr.IP) && ep.addr.Port == raddr.Port {
+			return s.mtuOf(ep)
+		}
+	}
+	return s.mtu
+}
+
+// tcpSYN returns tcp header of syn with options, nil if not
+func tcpSYN(p Packet) []byte {
+	off := p.transportOffset()
+	if off < 0 || p.Proto() != protoTCP || len(p) < off+20 {
+		return nil
+	}
+
+	tcp := p[off:]
+	dataOff := int(tcp[12]>>4) * 4
+	if tcp[13]&0x02 == 0 || dataOff <= 20 || dataOff > len(tcp) {
+		return nil
+	}
+	return tcp[:dataOff]
+}
+
+// clampMSS lowers mss option of tcp syn to fit mtu
+func clampMSS(p Packet, mtu int) {
+	tcp := tcpSYN(p)
+	if tcp == nil {
+		return
+	}
+
+	max := mtu - p.transportOffset() - 20
+	opts := tcp[20:]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0:
+			return
+		case 1:
+			i += 1
+			continue
+		}
+
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return
+		}
+
+		if opts[i] == 2 && opts[i+1] == 4 {
+			mss := int(binary.BigEndian.Uint16(opts[i+2 : i+4]))
+			if mss <= max {
+				return
+			}
+
+			binary.BigEndian.PutUint16(opts[i+2:i+4], uint16(max))
+
+			// incremental checksum update, rfc1624
+			csum := uint32(^binary.BigEndian.Uint16(tcp[16:18]))
+			csum += uint32(^uint16(mss)) + uint32(max)
+			for csum > 0xffff {
+				csum = (csum >> 16) + (csum & 0xffff)
+			}
+			binary.BigEndian.PutUint16(tcp[16:18], ^uint16(csum))
+			clampedSYNs.Inc()
+			return
+		}
+		i += int(opts[i+1])
+	}
+}
+
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns internet checksum of b
+// initial is sum of pseudo header
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s > 0xffff {
+		s = (s >> 16) + (s & 0xffff)
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,307 @@
+package main
+
+// peer liveness probing
+// probes are sent to every peer each peerProbeInterval:
+//  1. punch packets to direct address, acks decide direct or relay
+//  2. probe packets via stream or relay if peer is connected
+//     by stream or relayed, stream is redialed if disconnected
+// replies of probes on active path are used for rtt, loss and last seen
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+const (
+	// probes kept for rtt and loss
+	probeWindow = 20
+
+	// probe not replied in probeReplyTimeout is lost
+	probeReplyTimeout = time.Second * 3
+)
+
+type probeSlot struct {
+	seq     uint64
+	sentAt  time.Time
+	rtt     time.Duration
+	replied bool
+}
+
+// probeStats is path health measured by probes
+type probeStats struct {
+	seq      uint64
+	slots    [probeWindow]probeSlot
+	lastSeen time.Time
+
+	// first probe sent
+	startAt time.Time
+}
+
+// next returns seq of a new probe
+func (st *probeStats) next() uint64 {
+	if st.startAt.IsZero() {
+		st.startAt = time.Now()
+	}
+
+	st.seq += 1
+	st.slots[st.seq%probeWindow] = probeSlot{
+		seq:    st.seq,
+		sentAt: time.Now(),
+	}
+	return st.seq
+}
+
+func (st *probeStats) reply(seq uint64) {
+	slot := &st.slots[seq%probeWindow]
+	if seq == 0 || slot.seq != seq || slot.replied {
+		return
+	}
+
+	slot.replied = true
+	slot.rtt = time.Since(slot.sentAt)
+	st.lastSeen = time.Now()
+}
+
+// up reports whether any probe replied in peerTimeout,
+// peer is up until probed for peerTimeout
+func (st *probeStats) up() bool {
+	seen := st.lastSeen
+	if seen.IsZero() {
+		seen = st.startAt
+	}
+	return seen.IsZero() || time.Since(seen) < peerTimeout
+}
+
+// rtt returns average rtt of replied probes
+func (st *probeStats) rtt() time.Duration {
+	var total time.Duration
+	count := 0
+	for _, slot := range st.slots {
+		if slot.replied {
+			total += slot.rtt
+			count += 1
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
+
+// loss returns lost ratio of probes which should have been replied
+func (st *probeStats) loss() float64 {
+	sent, lost := 0, 0
+	for _, slot := range st.slots {
+		if slot.seq == 0 || time.Since(slot.sentAt) < probeReplyTimeout {
+			continue
+		}
+
+		sent += 1
+		if !slot.replied {
+			lost += 1
+		}
+	}
+
+	if sent == 0 {
+		return 0
+	}
+	return float64(lost) / float64(sent)
+}
+
+type probeTarget struct {
+	addr string
+	seq  uint64
+}
+
+// probePeers sends probes to peers periodically,
+// it keeps nat mappings alive and switches peer to relay
+// if no direct reply in peerTimeout
+func (s *Server) probePeers() {
+	tick := time.NewTicker(peerProbeInterval)
+	defer tick.Stop()
+	for range tick.C {
+		direct := make([]probeTarget, 0)
+		relayed := make([]probeTarget, 0)
+		s.epMu.Lock()
+		for _, ep := range s.endpoints {
+			// counted as lost until connected
+			if ep.transport != codec.TransportUDP && ep.stream == nil {
+				ep.stats.next()
+				s.redial(ep)
+			}
+
+			indirect := ep.relay || ep.stream != nil
+			if indirect {
+				relayed = append(relayed, probeTarget{ep.listenAddr, ep.stats.next()})
+			}
+
+			if ep.addr != nil {
+				seq := uint64(0)
+				if !indirect {
+					seq = ep.stats.next()
+				}
+				direct = append(direct, probeTarget{ep.addr.String(), seq})
+			}
+
+			// keep punching public endpoint
+			if len(ep.publicAddr) > 0 && !ep.punched {
+				direct = append(direct, probeTarget{ep.publicAddr, 0})
+			}
+
+			alive := time.Since(ep.lastSeen) < peerTimeout
+			switch {
+			case !ep.relay && !alive && len(ep.publicAddr) > 0 && len(s.relayToken) > 0:
+				log.Warn("peer %s is unreachable directly, switch to relay", ep.listenAddr)
+				ep.relay = true
+				pathSwitches.WithLabelValues(pathRelay).Inc()
+
+			case ep.relay && len(s.relayToken) == 0:
+				log.Warn("relay is unavailable, switch peer %s to direct", ep.listenAddr)
+				ep.relay = false
+				pathSwitches.WithLabelValues(pathDirect).Inc()
+			}
+
+			// peer liveness for next hop failover
+			up := ep.stats.up()
+			switch {
+			case up && !ep.up:
+				log.Info("peer %s is up", ep.listenAddr)
+			case !up && ep.up:
+				log.Warn("peer %s is down", ep.listenAddr)
+			}
+			ep.up = up
+
+			peerRTT.WithLabelValues(ep.listenAddr).Set(ep.stats.rtt().Seconds())
+			peerLoss.WithLabelValues(ep.listenAddr).Set(ep.stats.loss())
+		}
+		s.epMu.Unlock()
+		s.updateNexthops()
+
+		for _, t := range direct {
+			raddr, err := net.ResolveUDPAddr("udp", t.addr)
+			if err != nil {
+				continue
+			}
+
+			err = s.sendCtrl(ctrlPunch, raddr, t.seq)
+			if err != nil {
+				log.Error("send probe to %s fail: %v", raddr, err)
+			}
+		}
+
+		for _, t := range relayed {
+			err := s.sendPeerCtrl(ctrlProbe, t.addr, t.seq)
+			if err != nil {
+				log.Error("send probe to %s fail: %v", t.addr, err)
+			}
+		}
+	}
+}
+
+// updateNexthops marks next hops of peers down,
+// next hop without endpoint is alive
+func (s *Server) updateNexthops() {
+	down := make(map[string]bool)
+	s.epMu.RLock()
+	for addr, ep := range s.endpoints {
+		down[addr] = !ep.up
+	}
+	s.epMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pc := range s.peerConns {
+		for _, n := range pc.nexthops {
+			var v int32
+			if down[n.addr] {
+				v = 1
+			}
+			atomic.StoreInt32(&n.down, v)
+		}
+	}
+}
+
+// onRelayCtrl handles probes from peer listenAddr via relay or stream
+func (s *Server) onRelayCtrl(typ byte, listenAddr string, seq uint64) {
+	switch typ {
+	case ctrlProbe:
+		err := s.sendPeerCtrl(ctrlEcho, listenAddr, seq)
+		if err != nil {
+			log.Error("send echo to %s via relay fail: %v", listenAddr, err)
+		}
+
+	case ctrlEcho:
+		s.epMu.Lock()
+		if ep := s.endpoints[listenAddr]; ep != nil {
+			ep.stats.reply(seq)
+		}
+		s.epMu.Unlock()
+
+	default:
+		log.Debug("unknown relayed control packet %d from %s", typ, listenAddr)
+	}
+}
+
+// PeerStats returns path health of peers
+func (s *Server) PeerStats() []*codec.PeerStat {
+	cidrs := make(map[string][]string)
+	s.mu.Lock()
+	for _, p := range s.peerConns {
+		for _, n := range p.nexthops {
+			cidrs[n.addr] = append(cidrs[n.addr], p.cidr)
+		}
+	}
+	s.mu.Unlock()
+
+	s.epMu.RLock()
+	defer s.epMu.RUnlock()
+
+	stats := make([]*codec.PeerStat, 0, len(s.endpoints))
+	for _, ep := range s.endpoints {
+		stat := &codec.PeerStat{
+			ListenAddr: ep.listenAddr,
+			Cidrs:      cidrs[ep.listenAddr],
+			Path:       pathDirect,
+			RTT:        float64(ep.stats.rtt()) / float64(time.Millisecond),
+			Loss:       ep.stats.loss(),
+			PMTU:       s.mtuOf(ep),
+			Up:         ep.up,
+		}
+
+		if ep.relay {
+			stat.Path = pathRelay
+		}
+
+		if ep.addr != nil {
+			stat.Addr = ep.addr.String()
+		}
+
+		if ep.fec != nil {
+			stat.FEC = ep.fec.cfg.String()
+		}
+		stat.FECRecovered, stat.FECLost = s.fecStats(ep.listenAddr, ep.addr)
+
+		if ep.stream != nil {
+			stat.Path = ep.stream.transport
+			stat.Addr = ep.stream.conn.RemoteAddr().String()
+		}
+
+		if !ep.stats.lastSeen.IsZero() {
+			stat.LastSeen = ep.stats.lastSeen.Unix()
+		}
+
+		sort.Strings(stat.Cidrs)
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ListenAddr < stats[j].ListenAddr
+	})
+	return stats
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ICKelin/cframe/codec"
@@ -13,42 +18,166 @@ import (
 )
 
 type Registry struct {
-	srv       string
+	// unix nano of the last heartbeat sent and replied,
+	// rtt of the last heartbeat in nanoseconds
+	// keep them first for 64 bit alignment
+	hbSentAt  int64
+	hbAckedAt int64
+	hbRTT     int64
+
+	// controllers are tried in order until connected
+	// srvIdx is index of current one, guarded by stateMu
+	srvs      []string
+	srvIdx    int
 	namespace string
 	secret    string
 	name      string
 	server    *Server
 
 	//heart beat channel
-	hbchan chan struct{}
+	hbchan     chan struct{}
+	hbInterval time.Duration
 
 	// report channel
-	reportchan chan struct{}
+	reportchan     chan struct{}
+	reportInterval time.Duration
+
+	// optional tls to controller
+	tlsConfig *tls.Config
+
+	// connection state for status api
+	stateMu     sync.Mutex
+	connected   bool
+	connectedAt time.Time
+	reconnects  int
+	lastError   string
+	listenAddr  string
+	vpc         codec.CSPType
 }
 
-func NewRegistry(srv, ns, secret string, name string, s *Server) *Registry {
+// RegistryStatus is state of connection to controller
+type RegistryStatus struct {
+	Controller  string `json:"controller"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Connected   bool   `json:"connected"`
+	ConnectedAt int64  `json:"connected_at"`
+	Reconnects  int    `json:"reconnects"`
+	LastError   string `json:"last_error,omitempty"`
+
+	// unix timestamp of last heartbeat replied
+	// and its rtt in milliseconds
+	LastHeartbeat int64   `json:"last_heartbeat"`
+	HeartbeatRTT  float64 `json:"heartbeat_rtt"`
+
+	// listen address known by peers
+	ListenAddr string `json:"listen_addr"`
+	VPC        string `json:"vpc"`
+}
+
+func NewRegistry(srvs []string, ns, secret string, name string, s *Server) *Registry {
 	return &Registry{
-		srv:        srv,
-		namespace:  ns,
-		secret:     secret,
-		name:       name,
-		server:     s,
-		hbchan:     make(chan struct{}),
-		reportchan: make(chan struct{}),
+		srvs:           srvs,
+		namespace:      ns,
+		secret:         secret,
+		name:           name,
+		server:         s,
+		hbchan:         make(chan struct{}),
+		hbInterval:     time.Second * 10,
+		reportchan:     make(chan struct{}),
+		reportInterval: time.Second * 30,
 	}
 }
 
+// SetTLSConfig sets tls to controllers,
+// host of controller is verified if server name is empty
+func (r *Registry) SetTLSConfig(cfg *tls.Config) {
+	r.tlsConfig = cfg
+}
+
+// SetIntervals sets intervals of heartbeat and stats report,
+// it should be called before Run
+func (r *Registry) SetIntervals(heartbeat, report time.Duration) {
+	r.hbInterval = heartbeat
+	r.reportInterval = report
+}
+
+// controller returns address of current controller
+func (r *Registry) controller() string {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	return r.srvs[r.srvIdx]
+}
+
 func (r *Registry) Run() error {
 	go r.heartbeat()
 	go r.report()
 	for {
-		r.run()
+		err := r.run()
+		r.setDisconnected(err)
 		time.Sleep(time.Second * 3)
+		registryReconnects.Inc()
+	}
+}
+
+func (r *Registry) setConnected(reply *codec.RegisterReply) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.connected = true
+	r.connectedAt = time.Now()
+	r.listenAddr = reply.ListenAddr
+	r.vpc = codec.CSP_TYPE_NONE
+	if reply.CSPInfo != nil {
+		r.vpc = reply.CSPInfo.CspType
 	}
 }
 
+func (r *Registry) setDisconnected(err error) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.connected = false
+	r.reconnects += 1
+	if err != nil {
+		r.lastError = err.Error()
+	}
+
+	// try the next controller
+	if len(r.srvs) > 1 {
+		r.srvIdx = (r.srvIdx + 1) % len(r.srvs)
+		log.Info("switch to controller %s", r.srvs[r.srvIdx])
+	}
+}
+
+// Status returns state of connection to controller
+func (r *Registry) Status() *RegistryStatus {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	status := &RegistryStatus{
+		Controller: r.srvs[r.srvIdx],
+		Namespace:  r.namespace,
+		Name:       r.name,
+		Connected:  r.connected,
+		Reconnects: r.reconnects,
+		LastError:  r.lastError,
+		ListenAddr: r.listenAddr,
+		VPC:        r.vpc.String(),
+	}
+
+	if r.connected {
+		status.ConnectedAt = r.connectedAt.Unix()
+	}
+
+	if ackedAt := atomic.LoadInt64(&r.hbAckedAt); ackedAt > 0 {
+		status.LastHeartbeat = time.Unix(0, ackedAt).Unix()
+		status.HeartbeatRTT = float64(atomic.LoadInt64(&r.hbRTT)) / float64(time.Millisecond)
+	}
+	return status
+}
+
 func (r *Registry) run() error {
-	conn, err := net.DialTimeout("tcp", r.srv, time.Second*30)
+	srv := r.controller()
+	conn, err := r.dial(srv)
 	if err != nil {
 		log.Error("%v", err)
 		return err
@@ -68,8 +197,13 @@ func (r *Registry) run() error {
 	}
 
 	reply := &codec.RegisterReply{}
-	codec.ReadJSON(conn, reply)
+	err = codec.ReadJSON(conn, reply)
+	if err != nil {
+		log.Error("read register reply fail: %v", err)
+		return err
+	}
 	log.Debug("%v", reply)
+	r.setConnected(reply)
 	if reply.CSPInfo != nil {
 		instance, err := vpc.GetVPCInstance(reply.CSPInfo.CspType, reply.CSPInfo.AccessKey, reply.CSPInfo.AccessSecret)
 		if err != nil {
@@ -80,24 +214,63 @@ func (r *Registry) run() error {
 		}
 	}
 
+	// transport of peers is required by routes and peers
+	r.server.SetTransport(reply.Transport, reply.ListenAddr)
+	r.server.SetCompress(reply.Compress)
+
 	// add peers route
 	for _, route := range reply.Routes {
-		r.server.AddPeer(&codec.Edge{
-			ListenAddr: route.Nexthop,
-			Cidr:       route.CIDR,
+		r.server.AddRoute(&codec.AddRouteMsg{
+			Cidr:     route.CIDR,
+			Nexthop:  route.Nexthop,
+			Nexthops: route.Nexthops,
+			ECMP:     route.ECMP,
 		})
 	}
 
 	// add peer edge
 	r.server.AddPeers(reply.EdgeList)
 
+	// learn public endpoint for nat traversal
+	done := make(chan struct{})
+	defer close(done)
+	r.server.SetPublicAddr("")
+	if len(reply.ProbeToken) > 0 {
+		log.Info("control connection observed as %s", reply.ObservedAddr)
+		go r.probe(srv, reply.ProbeToken, done)
+	}
+
+	// token is invalid once disconnected
+	if reply.Relay {
+		raddr, err := net.ResolveUDPAddr("udp", srv)
+		if err != nil {
+			log.Error("resolve relay %s fail: %v", srv, err)
+		} else {
+			r.server.SetRelay(raddr, reply.ProbeToken)
+			defer r.server.SetRelay(nil, "")
+		}
+	}
+
 	go r.read(conn)
 	r.write(conn)
 	return nil
 }
 
+func (r *Registry) dial(srv string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Second * 30}
+	if r.tlsConfig != nil {
+		cfg := r.tlsConfig
+		if len(cfg.ServerName) == 0 {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(srv)
+		}
+		return tls.DialWithDialer(dialer, "tcp", srv, cfg)
+	}
+	return dialer.Dial("tcp", srv)
+}
+
 func (r *Registry) report() {
-	tick := time.NewTicker(time.Second * 30)
+	tick := time.NewTicker(r.reportInterval)
 	defer tick.Stop()
 	for range tick.C {
 		select {
@@ -108,7 +281,7 @@ func (r *Registry) report() {
 }
 
 func (r *Registry) heartbeat() {
-	tick := time.NewTicker(time.Second * 10)
+	tick := time.NewTicker(r.hbInterval)
 	defer tick.Stop()
 
 	for range tick.C {
@@ -125,6 +298,7 @@ func (r *Registry) write(conn net.Conn) {
 		case <-r.hbchan:
 			log.Debug("send heartbeat to server")
 			hb := &codec.Heartbeat{}
+			atomic.StoreInt64(&r.hbSentAt, time.Now().UnixNano())
 			conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
 			err := codec.WriteJSON(conn, codec.CmdHeartbeat, hb)
 			conn.SetWriteDeadline(time.Time{})
@@ -134,6 +308,9 @@ func (r *Registry) write(conn net.Conn) {
 			}
 		case <-r.reportchan:
 			report := ResetStat()
+			report.Peers = r.server.PeerStats()
+			report.RateLimits = r.server.RateLimitStats()
+			report.KeyID = r.server.crypto.KeyID()
 			conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
 			err := codec.WriteJSON(conn, codec.CmdReport, report)
 			if err != nil {
@@ -155,6 +332,14 @@ func (r *Registry) read(conn net.Conn) {
 		switch hdr.Cmd() {
 		case codec.CmdHeartbeat:
 			log.Debug("heartbeat from server ")
+			sentAt := atomic.LoadInt64(&r.hbSentAt)
+			if sentAt > 0 {
+				now := time.Now()
+				rtt := now.Sub(time.Unix(0, sentAt))
+				atomic.StoreInt64(&r.hbAckedAt, now.UnixNano())
+				atomic.StoreInt64(&r.hbRTT, int64(rtt))
+				heartbeatRTT.Observe(rtt.Seconds())
+			}
 
 		case codec.CmdAdd:
 			log.Debug("online cmd: %s", string(body))
@@ -167,6 +352,8 @@ func (r *Registry) read(conn net.Conn) {
 			r.server.AddPeer(&codec.Edge{
 				ListenAddr: online.ListenAddr,
 				Cidr:       online.Cidr,
+				PublicAddr: online.PublicAddr,
+				FEC:        online.FEC,
 			})
 
 		case codec.CmdDel:
@@ -202,9 +389,86 @@ func (r *Registry) read(conn net.Conn) {
 			}
 			r.server.DelRoute(&delRoute)
 
+		case codec.CmdEndpoint:
+			endpoint := codec.EndpointMsg{}
+			err := json.Unmarshal(body, &endpoint)
+			if err != nil {
+				log.Error("invalid endpoint msg: %v", err)
+				continue
+			}
+			log.Info("public endpoint %s", endpoint.PublicAddr)
+			r.server.SetPublicAddr(endpoint.PublicAddr)
+
+		case codec.CmdACL:
+			acl := codec.ACLMsg{}
+			err := json.Unmarshal(body, &acl)
+			if err != nil {
+				log.Error("invalid acl msg: %v", err)
+				continue
+			}
+
+			err = r.server.SetACL(acl.Rules)
+			if err != nil {
+				log.Error("set acl fail: %v", err)
+				AddErrorLog(err)
+			}
+
+		case codec.CmdKey:
+			keyMsg := codec.KeyMsg{}
+			err := json.Unmarshal(body, &keyMsg)
+			if err != nil {
+				log.Error("invalid key msg: %v", err)
+				continue
+			}
+
+			err = r.setKeys(&keyMsg)
+			if err != nil {
+				log.Error("set keys fail: %v", err)
+				AddErrorLog(err)
+			}
+
+		case codec.CmdRateLimit:
+			rl := codec.RateLimitMsg{}
+			err := json.Unmarshal(body, &rl)
+			if err != nil {
+				log.Error("invalid rate limit msg: %v", err)
+				continue
+			}
+
+			err = r.server.SetRateLimits(rl.Limits)
+			if err != nil {
+				log.Error("set rate limits fail: %v", err)
+				AddErrorLog(err)
+			}
+
 		case codec.CmdExit:
 			log.Warn("receive exit signal")
+			r.server.Close()
 			os.Exit(0)
 		}
 	}
 }
+
+// setKeys installs data keys deployed by controller
+func (r *Registry) setKeys(msg *codec.KeyMsg) error {
+	if len(msg.Keys) == 0 || len(msg.Keys) > codec.MaxDataKeys {
+		return fmt.Errorf("invalid key count %d", len(msg.Keys))
+	}
+
+	keys := make(map[uint8][]byte)
+	for _, k := range msg.Keys {
+		if len(k.Key) == 0 {
+			keys[k.ID] = nil
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return fmt.Errorf("invalid key %d: %v", k.ID, err)
+		}
+		keys[k.ID] = key
+	}
+
+	log.Info("install %d keys, active key %d after %s", len(keys), msg.Active, msg.Delay)
+	return r.server.crypto.SetKeys(keys, msg.Active, msg.Delay)
+}
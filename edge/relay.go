@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// SetRelay sets controller udp address and token for relay,
+// relay is disabled if addr is nil
+func (s *Server) SetRelay(addr *net.UDPAddr, token string) {
+	s.epMu.Lock()
+	defer s.epMu.Unlock()
+	s.relayAddr = addr
+	s.relayToken = token
+}
+
+// sendRelay sends sealed packet to peer listenAddr via controller
+func (s *Server) sendRelay(listenAddr string, buf []byte) error {
+	s.epMu.RLock()
+	relayAddr, token := s.relayAddr, s.relayToken
+	s.epMu.RUnlock()
+	if relayAddr == nil {
+		return fmt.Errorf("relay unavailable")
+	}
+
+	msg := &codec.RelayMsg{
+		Token:   token,
+		Addr:    listenAddr,
+		Payload: buf,
+	}
+	payload, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+
+	frame := &bytes.Buffer{}
+	err = codec.Write(frame, codec.CmdRelay, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.WriteToUDP(frame.Bytes(), relayAddr)
+	return err
+}
+
+// isRelay reports whether buf is relayed by controller
+// relay frame starts with codec version which differs
+// from crypto envelope version
+func (s *Server) isRelay(buf []byte, raddr *net.UDPAddr) bool {
+	if len(buf) == 0 || buf[0] != codec.Version2 {
+		return false
+	}
+
+	s.epMu.RLock()
+	defer s.epMu.RUnlock()
+	return s.relayAddr != nil &&
+		s.relayAddr.IP.Equal(raddr.IP) &&
+		s.relayAddr.Port == raddr.Port
+}
+
+// isPeer reports whether listenAddr is endpoint of known peer,
+// relayed packets of other senders are dropped
+func (s *Server) isPeer(listenAddr string) bool {
+	idx, _ := s.peers.Load().(*peerIndex)
+	if idx == nil {
+		return false
+	}
+
+	_, ok := idx.byListen[listenAddr]
+	return ok
+}
+
+// openRelay returns sealed packet and sender listen address
+func openRelay(buf []byte) ([]byte, string, error) {
+	hdr, body, err := codec.Read(bytes.NewReader(buf))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if hdr.Cmd() != codec.CmdRelay {
+		return nil, "", fmt.Errorf("unexpected cmd %d", hdr.Cmd())
+	}
+
+	msg := codec.RelayMsg{}
+	err = msg.Decode(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return msg.Payload, msg.Addr, nil
+}
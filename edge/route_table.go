@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// routeTable is a longest prefix match table for peers
+// lookups walk an immutable binary trie without locking,
+// mutations build a new trie and swap it atomically.
+// ipv4 and ipv6 prefixes live in separate tries.
+type routeTable struct {
+	root atomic.Value // *routeRoot
+}
+
+type routeRoot struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	peer  *peerConn
+
+	// nearest ancestor with peer
+	up *trieNode
+}
+
+func newRouteTable() *routeTable {
+	t := &routeTable{}
+	t.root.Store(&routeRoot{v4: &trieNode{}, v6: &trieNode{}})
+	return t
+}
+
+// Rebuild replaces all entries of the table
+func (t *routeTable) Rebuild(peers map[string]*peerConn) {
+	root := &routeRoot{v4: &trieNode{}, v6: &trieNode{}}
+	for _, peer := range peers {
+		ones, _ := peer.ipnet.Mask.Size()
+		if ip4 := peer.ipnet.IP.To4(); ip4 != nil {
+			insert(root.v4, ip4, ones, peer)
+		} else {
+			insert(root.v6, peer.ipnet.IP.To16(), ones, peer)
+		}
+	}
+	link(root.v4, nil)
+	link(root.v6, nil)
+	t.root.Store(root)
+}
+
+// Lookup returns node of the most specific prefix matching dst,
+// less specific matches follow by up, nil if no match
+func (t *routeTable) Lookup(dst net.IP) *trieNode {
+	root := t.root.Load().(*routeRoot)
+
+	node, addr := root.v6, dst.To16()
+	if ip4 := dst.To4(); ip4 != nil {
+		node, addr = root.v4, ip4
+	}
+
+	var best *trieNode
+	bits := len(addr) * 8
+	for depth := 0; node != nil; depth++ {
+		if node.peer != nil {
+			best = node
+		}
+
+		if depth == bits {
+			break
+		}
+		node = node.child[bitAt(addr, depth)]
+	}
+	return best
+}
+
+func insert(root *trieNode, addr []byte, prefixLen int, peer *peerConn) {
+	node := root
+	for depth := 0; depth < prefixLen; depth++ {
+		b := bitAt(addr, depth)
+		if node.child[b] == nil {
+			node.child[b] = &trieNode{}
+		}
+		node = node.child[b]
+	}
+	node.peer = peer
+}
+
+// link points nodes with peer to their nearest ancestor with peer
+func link(node, up *trieNode) {
+	if node == nil {
+		return
+	}
+
+	if node.peer != nil {
+		node.up = up
+		up = node
+	}
+	link(node.child[0], up)
+	link(node.child[1], up)
+}
+
+func bitAt(addr []byte, depth int) int {
+	return int(addr[depth/8]>>(7-uint(depth%8))) & 1
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func newTestPeers(t *testing.T, cidrs ...string) map[string]*peerConn {
+	peers := make(map[string]*peerConn)
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers[cidr] = &peerConn{cidr: cidr, ipnet: ipnet}
+	}
+	return peers
+}
+
+func newTestRoutes(t *testing.T, cidrs ...string) *routeTable {
+	routes := newRouteTable()
+	routes.Rebuild(newTestPeers(t, cidrs...))
+	return routes
+}
+
+// lookup returns cidrs matched, the most specific one first
+func lookup(routes *routeTable, dst string) []string {
+	matches := make([]string, 0)
+	for n := routes.Lookup(net.ParseIP(dst)); n != nil; n = n.up {
+		matches = append(matches, n.peer.cidr)
+	}
+	return matches
+}
+
+func equalMatches(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRouteTableLookup(t *testing.T) {
+	routes := newTestRoutes(t,
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.3/32",
+		"192.168.1.0/24",
+		"::/0",
+		"fd00::/8",
+		"fd00:1::/32",
+		"fd00:1::1/128",
+	)
+
+	cases := []struct {
+		dst     string
+		matches []string
+	}{
+		{"10.1.2.3", []string{"10.1.2.3/32", "10.1.0.0/16", "10.0.0.0/8", "0.0.0.0/0"}},
+		{"10.1.2.4", []string{"10.1.0.0/16", "10.0.0.0/8", "0.0.0.0/0"}},
+		{"10.2.0.1", []string{"10.0.0.0/8", "0.0.0.0/0"}},
+		{"192.168.1.255", []string{"192.168.1.0/24", "0.0.0.0/0"}},
+		{"192.168.2.1", []string{"0.0.0.0/0"}},
+		{"8.8.8.8", []string{"0.0.0.0/0"}},
+		{"fd00:1::1", []string{"fd00:1::1/128", "fd00:1::/32", "fd00::/8", "::/0"}},
+		{"fd00:2::1", []string{"fd00::/8", "::/0"}},
+		{"2001:db8::1", []string{"::/0"}},
+	}
+
+	for _, c := range cases {
+		matches := lookup(routes, c.dst)
+		if !equalMatches(matches, c.matches) {
+			t.Errorf("lookup %s got %v, expect %v", c.dst, matches, c.matches)
+		}
+	}
+}
+
+func TestRouteTableNoMatch(t *testing.T) {
+	routes := newTestRoutes(t, "10.0.0.0/8", "fd00::/8")
+
+	// ipv4 and ipv6 do not match each other
+	for _, dst := range []string{"11.0.0.1", "::ffff:b00:1", "2001:db8::1"} {
+		if n := routes.Lookup(net.ParseIP(dst)); n != nil {
+			t.Errorf("lookup %s got %s, expect no match", dst, n.peer.cidr)
+		}
+	}
+
+	if n := newRouteTable().Lookup(net.ParseIP("10.0.0.1")); n != nil {
+		t.Errorf("empty table got %s", n.peer.cidr)
+	}
+}
+
+func TestRouteTableRebuild(t *testing.T) {
+	routes := newTestRoutes(t, "10.0.0.0/8", "10.1.0.0/16")
+	if matches := lookup(routes, "10.1.0.1"); !equalMatches(matches, []string{"10.1.0.0/16", "10.0.0.0/8"}) {
+		t.Fatalf("lookup got %v", matches)
+	}
+
+	// overlapping prefixes replaced
+	routes.Rebuild(newTestPeers(t, "10.1.0.0/16", "10.1.1.0/24", "0.0.0.0/0"))
+
+	cases := map[string][]string{
+		"10.1.1.1": {"10.1.1.0/24", "10.1.0.0/16", "0.0.0.0/0"},
+		"10.1.2.1": {"10.1.0.0/16", "0.0.0.0/0"},
+		"10.2.0.1": {"0.0.0.0/0"},
+	}
+
+	for dst, expect := range cases {
+		if matches := lookup(routes, dst); !equalMatches(matches, expect) {
+			t.Errorf("lookup %s got %v, expect %v", dst, matches, expect)
+		}
+	}
+}
+
+func TestRouteTableLookupAllocs(t *testing.T) {
+	routes := newTestRoutes(t, "0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16")
+	dst := net.ParseIP("10.1.2.3").To4()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		for n := routes.Lookup(dst); n != nil; n = n.up {
+		}
+	})
+
+	if allocs != 0 {
+		t.Fatalf("lookup allocates %v times", allocs)
+	}
+}
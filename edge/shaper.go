@@ -0,0 +1,402 @@
+package main
+
+// rate limits deployed by controller
+// packets from tun to peers matched by limits are queued
+// and sent at rate of limits by token bucket. each limit
+// queues packets in priority bands by dscp and the higher
+// band is always sent first, so interactive traffic is not
+// starved by bulk transfers sharing the limit.
+// a packet matched by more than one limit waits for all
+// of them, the more specific first. packets are dropped
+// once queue of its band is full.
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/ip"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// priority bands of packets queued by limits
+const (
+	bandHigh = iota
+	bandNormal
+	bandLow
+	bandCount
+)
+
+// packets queued in each band of a limit
+const bandQueueSize = 256
+
+// dscpBand returns priority band of dscp
+func dscpBand(dscp int) int {
+	switch dscp {
+	// EF, VOICE-ADMIT, CS5, CS6, CS7
+	case 46, 44, 40, 48, 56:
+		return bandHigh
+	// LE, CS1
+	case 1, 8:
+		return bandLow
+	}
+	return bandNormal
+}
+
+// shapedPacket is packet of nr bytes at buf[cryptoHeaderLen:]
+// read from tun queue q and waiting for limits
+type shapedPacket struct {
+	buf       *[]byte
+	nr, q     int
+	peer      string
+	sendQueue chan *datagram
+	band      int
+
+	// limits the packet waits for, the current first
+	limits []*rateLimiter
+}
+
+type rateLimiter struct {
+	// first in struct for 64bit atomic alignment
+	bytes   uint64
+	packets uint64
+	dropped uint64
+
+	limit *codec.RateLimit
+	dst   *net.IPNet
+
+	// token bucket in bytes
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	bands [bandCount]chan *shapedPacket
+	done  chan struct{}
+
+	// closed under mu, nothing is queued once closed
+	mu     sync.Mutex
+	closed bool
+
+	countBytes   prometheus.Counter
+	countDropped [bandCount]prometheus.Counter
+}
+
+func newRateLimiter(limit *codec.RateLimit) (*rateLimiter, error) {
+	if limit.Rate <= 0 {
+		return nil, fmt.Errorf("invalid rate %d", limit.Rate)
+	}
+
+	l := &rateLimiter{
+		limit: limit,
+		rate:  float64(limit.Rate) / 8,
+		burst: float64(limit.BurstBytes()),
+		last:  time.Now(),
+		done:  make(chan struct{}),
+	}
+	l.tokens = l.burst
+
+	if len(limit.Dst) > 0 {
+		dst, err := ip.ParseCIDR(limit.Dst)
+		if err != nil {
+			return nil, err
+		}
+		l.dst = dst
+	}
+
+	l.countBytes = rateLimitBytes.WithLabelValues(limit.Name)
+	for i := range l.bands {
+		l.bands[i] = make(chan *shapedPacket, bandQueueSize)
+		l.countDropped[i] = rateLimitDropped.WithLabelValues(limit.Name, strconv.Itoa(i))
+	}
+	return l, nil
+}
+
+// specificity orders limits, dst and peer limit first
+func (l *rateLimiter) specificity() int {
+	n := 0
+	if l.dst != nil {
+		n += 2
+	}
+	if len(l.limit.Peer) > 0 {
+		n += 1
+	}
+	return n
+}
+
+// match reports whether packet p to peer is limited,
+// p is nil if not ip packet
+func (l *rateLimiter) match(peer string, p Packet) bool {
+	if len(l.limit.Peer) > 0 && l.limit.Peer != peer {
+		return false
+	}
+
+	if l.dst != nil && (p == nil || !l.dst.Contains(p.DstIP())) {
+		return false
+	}
+	return true
+}
+
+// enqueue queues p to its band, ok is false if band is full,
+// closed is true if l is replaced and p is not queued
+func (l *rateLimiter) enqueue(p *shapedPacket) (ok, closed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false, true
+	}
+
+	select {
+	case l.bands[p.band] <- p:
+		return true, false
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		l.countDropped[p.band].Inc()
+		return false, false
+	}
+}
+
+// dequeue returns queued packet of the highest band,
+// nil once limiter is closed
+func (l *rateLimiter) dequeue() *shapedPacket {
+	for _, band := range l.bands {
+		select {
+		case p := <-band:
+			return p
+		default:
+		}
+	}
+
+	select {
+	case p := <-l.bands[bandHigh]:
+		return p
+	case p := <-l.bands[bandNormal]:
+		return p
+	case p := <-l.bands[bandLow]:
+		return p
+	case <-l.done:
+		return nil
+	}
+}
+
+// take takes n bytes from bucket and waits until
+// bucket is not in debt, false if limiter is closed meanwhile
+func (l *rateLimiter) take(n int, timer *time.Timer) bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return true
+	}
+
+	timer.Reset(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	select {
+	case <-timer.C:
+		return true
+	case <-l.done:
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		return false
+	}
+}
+
+func (l *rateLimiter) queued() int {
+	n := 0
+	for _, band := range l.bands {
+		n += len(band)
+	}
+	return n
+}
+
+func (l *rateLimiter) close() {
+	l.mu.Lock()
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+}
+
+// SetRateLimits replaces rate limits, packets queued
+// by the old ones are dropped
+func (s *Server) SetRateLimits(limits []*codec.RateLimit) error {
+	limiters := make([]*rateLimiter, 0, len(limits))
+	for _, limit := range limits {
+		l, err := newRateLimiter(limit)
+		if err != nil {
+			return fmt.Errorf("rate limit %s: %v", limit.Name, err)
+		}
+		limiters = append(limiters, l)
+	}
+
+	sort.SliceStable(limiters, func(i, j int) bool {
+		return limiters[i].specificity() > limiters[j].specificity()
+	})
+
+	old, _ := s.limiters.Load().([]*rateLimiter)
+	s.limiters.Store(limiters)
+	for _, l := range limiters {
+		log.Info("rate limit %s", l.limit)
+		go s.runLimiter(l)
+	}
+
+	// drop counters of removed limits
+	for _, l := range old {
+		l.close()
+		if !hasRateLimiter(limiters, l.limit.Name) {
+			rateLimitBytes.DeleteLabelValues(l.limit.Name)
+			for i := range l.bands {
+				rateLimitDropped.DeleteLabelValues(l.limit.Name, strconv.Itoa(i))
+			}
+		}
+	}
+
+	log.Info("set %d rate limits", len(limiters))
+	return nil
+}
+
+func hasRateLimiter(limiters []*rateLimiter, name string) bool {
+	for _, l := range limiters {
+		if l.limit.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// shape queues packet of nr bytes at buf[cryptoHeaderLen:]
+// to limits it matches or forwards it if not limited.
+// buf is owned by shape
+func (s *Server) shape(buf *[]byte, nr, q int, peer string, sendQueue chan *datagram) {
+	limiters, _ := s.limiters.Load().([]*rateLimiter)
+	if len(limiters) == 0 {
+		s.forward(buf, nr, q, peer, sendQueue)
+		return
+	}
+
+	pkt := (*buf)[cryptoHeaderLen : cryptoHeaderLen+nr]
+	if s.tap {
+		f := Frame(pkt)
+		pkt = nil
+		if f.IsIP() {
+			pkt = f.Payload()
+		}
+	}
+
+	p := Packet(pkt)
+	if p.Invalid() {
+		p = nil
+	}
+
+	var matched []*rateLimiter
+	for _, l := range limiters {
+		if l.match(peer, p) {
+			matched = append(matched, l)
+		}
+	}
+
+	if len(matched) == 0 {
+		s.forward(buf, nr, q, peer, sendQueue)
+		return
+	}
+
+	band := bandNormal
+	if p != nil {
+		band = dscpBand(p.DSCP())
+	}
+
+	sp := &shapedPacket{
+		buf:       buf,
+		nr:        nr,
+		q:         q,
+		peer:      peer,
+		sendQueue: sendQueue,
+		band:      band,
+		limits:    matched,
+	}
+	s.enqueue(sp)
+}
+
+// enqueue queues p to its current limit, p is forwarded
+// if the limit is replaced by SetRateLimits meanwhile
+func (s *Server) enqueue(p *shapedPacket) {
+	ok, closed := p.limits[0].enqueue(p)
+	if closed {
+		s.forward(p.buf, p.nr, p.q, p.peer, p.sendQueue)
+		return
+	}
+
+	if !ok {
+		droppedPackets.WithLabelValues(dropRateLimit).Inc()
+		putBuf(p.buf)
+	}
+}
+
+// runLimiter sends queued packets of l at rate of l
+// to the next limit or peer until l is closed
+func (s *Server) runLimiter(l *rateLimiter) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		p := l.dequeue()
+		if p == nil {
+			break
+		}
+
+		if !l.take(p.nr, timer) {
+			putBuf(p.buf)
+			break
+		}
+
+		atomic.AddUint64(&l.bytes, uint64(p.nr))
+		atomic.AddUint64(&l.packets, 1)
+		l.countBytes.Add(float64(p.nr))
+
+		p.limits = p.limits[1:]
+		if len(p.limits) == 0 {
+			s.forward(p.buf, p.nr, p.q, p.peer, p.sendQueue)
+			continue
+		}
+
+		s.enqueue(p)
+	}
+
+	// drop what is queued, nothing is queued after close
+	for _, band := range l.bands {
+		for len(band) > 0 {
+			p := <-band
+			putBuf(p.buf)
+		}
+	}
+}
+
+// RateLimitStats returns traffic of rate limits
+func (s *Server) RateLimitStats() []*codec.RateLimitStat {
+	limiters, _ := s.limiters.Load().([]*rateLimiter)
+	stats := make([]*codec.RateLimitStat, 0, len(limiters))
+	for _, l := range limiters {
+		stats = append(stats, &codec.RateLimitStat{
+			Name:    l.limit.Name,
+			Rate:    l.limit.Rate,
+			Bytes:   atomic.LoadUint64(&l.bytes),
+			Packets: atomic.LoadUint64(&l.packets),
+			Dropped: atomic.LoadUint64(&l.dropped),
+			Queued:  l.queued(),
+		})
+	}
+	return stats
+}
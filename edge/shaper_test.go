@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestRateLimiterEnqueueClosed(t *testing.T) {
+	l, err := newRateLimiter(&codec.RateLimit{Name: "test", Rate: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &shapedPacket{band: bandNormal, limits: []*rateLimiter{l}}
+	ok, closed := l.enqueue(p)
+	if !ok || closed {
+		t.Fatalf("enqueue %v %v, expect queued", ok, closed)
+	}
+
+	// packet of a shape racing with SetRateLimits is not queued
+	// to the replaced limiter and left for the caller to forward
+	l.close()
+	ok, closed = l.enqueue(p)
+	if ok || !closed {
+		t.Fatalf("enqueue %v %v after close, expect closed", ok, closed)
+	}
+
+	if n := l.queued(); n != 1 {
+		t.Fatalf("%d queued, expect 1", n)
+	}
+}
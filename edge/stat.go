@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ICKelin/cframe/codec"
@@ -18,35 +19,127 @@ func init() {
 	}
 }
 
+// counters added per packet, atomic so that
+// queues of pipeline never wait for each other
+var counters struct {
+	trafficIn    int64
+	trafficOut   int64
+	fecRecovered int64
+	fecLost      int64
+	compressIn   int64
+	compressOut  int64
+}
+
+// msgMu guards errors of msg, recentErrors and total
 var msgMu sync.Mutex
 var msg = &codec.ReportMsg{}
 
+// counters of reported msgs
+var total = &codec.ReportMsg{}
+
+// recent errors for status api
+const maxRecentErrors = 32
+
+var recentErrors = make([]*ErrorLog, 0, maxRecentErrors)
+
+// ErrorLog is error added by AddErrorLog
+type ErrorLog struct {
+	Time  int64  `json:"time"`
+	Error string `json:"error"`
+}
+
+// StatCounters is counters since edge started
+type StatCounters struct {
+	TrafficIn    int64 `json:"traffic_in"`
+	TrafficOut   int64 `json:"traffic_out"`
+	FECRecovered int64 `json:"fec_recovered"`
+	FECLost      int64 `json:"fec_lost"`
+	CompressIn   int64 `json:"compress_in"`
+	CompressOut  int64 `json:"compress_out"`
+}
+
 func AddTrafficIn(traffic int64) {
+	atomic.AddInt64(&counters.trafficIn, traffic)
+}
+
+func AddTrafficOut(traffic int64) {
+	atomic.AddInt64(&counters.trafficOut, traffic)
+}
+
+func AddFECRecovered(count int64) {
+	atomic.AddInt64(&counters.fecRecovered, count)
+}
+
+func AddFECLost(count int64) {
+	atomic.AddInt64(&counters.fecLost, count)
+}
+
+func AddCompress(in, out int64) {
+	atomic.AddInt64(&counters.compressIn, in)
+	atomic.AddInt64(&counters.compressOut, out)
+}
+
+func AddErrorLog(err error) {
 	msgMu.Lock()
 	defer msgMu.Unlock()
-	msg.TrafficIn += traffic
+	msg.Error = append(msg.Error, err.Error())
+
+	if len(recentErrors) == maxRecentErrors {
+		copy(recentErrors, recentErrors[1:])
+		recentErrors = recentErrors[:maxRecentErrors-1]
+	}
+	recentErrors = append(recentErrors, &ErrorLog{
+		Time:  time.Now().Unix(),
+		Error: err.Error(),
+	})
 }
 
-func AddTrafficOut(traffic int64) {
+// RecentErrors returns errors added recently, the oldest first
+func RecentErrors() []*ErrorLog {
 	msgMu.Lock()
 	defer msgMu.Unlock()
-	msg.TrafficOut += traffic
+	errs := make([]*ErrorLog, len(recentErrors))
+	copy(errs, recentErrors)
+	return errs
 }
 
-func AddErrorLog(err error) {
+// Stats returns counters since edge started
+func Stats() *StatCounters {
 	msgMu.Lock()
 	defer msgMu.Unlock()
-	msg.Error = append(msg.Error, err.Error())
+	return &StatCounters{
+		TrafficIn:    total.TrafficIn + atomic.LoadInt64(&counters.trafficIn),
+		TrafficOut:   total.TrafficOut + atomic.LoadInt64(&counters.trafficOut),
+		FECRecovered: total.FECRecovered + atomic.LoadInt64(&counters.fecRecovered),
+		FECLost:      total.FECLost + atomic.LoadInt64(&counters.fecLost),
+		CompressIn:   total.CompressIn + atomic.LoadInt64(&counters.compressIn),
+		CompressOut:  total.CompressOut + atomic.LoadInt64(&counters.compressOut),
+	}
 }
 
 func ResetStat() *codec.ReportMsg {
+	msgMu.Lock()
 	m := msg
+	msg = &codec.ReportMsg{Error: make([]string, 0, 3)}
+	m.TrafficIn = atomic.SwapInt64(&counters.trafficIn, 0)
+	m.TrafficOut = atomic.SwapInt64(&counters.trafficOut, 0)
+	m.FECRecovered = atomic.SwapInt64(&counters.fecRecovered, 0)
+	m.FECLost = atomic.SwapInt64(&counters.fecLost, 0)
+	m.CompressIn = atomic.SwapInt64(&counters.compressIn, 0)
+	m.CompressOut = atomic.SwapInt64(&counters.compressOut, 0)
+	total.TrafficIn += m.TrafficIn
+	total.TrafficOut += m.TrafficOut
+	total.FECRecovered += m.FECRecovered
+	total.FECLost += m.FECLost
+	total.CompressIn += m.CompressIn
+	total.CompressOut += m.CompressOut
+	msgMu.Unlock()
+
 	m.Timestamp = time.Now().Unix()
 	cpu, _ := p.CPUPercent()
 	mem, _ := p.MemoryPercent()
 	m.CPU = int32(cpu)
 	m.Mem = int32(mem)
-	msg = &codec.ReportMsg{Error: make([]string, 0, 3)}
 
 	return m
 }
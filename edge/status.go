@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+const defaultStatusSock = "/var/run/cframe_edge.sock"
+
+// EdgeStatus is state of running edge
+type EdgeStatus struct {
+	Registry   *RegistryStatus `json:"registry"`
+	Mode       string          `json:"mode"`
+	Listen     string          `json:"listen"`
+	PublicAddr string          `json:"public_addr"`
+	Transport  string          `json:"transport"`
+	Compress   string          `json:"compress"`
+	KeyID      uint8           `json:"key_id"`
+	MTU        int             `json:"mtu"`
+	Stats      *StatCounters   `json:"stats"`
+	Errors     []*ErrorLog     `json:"errors"`
+}
+
+// RouteStatus is route to peer cidr with liveness of next hops
+type RouteStatus struct {
+	Cidr     string           `json:"cidr"`
+	ECMP     bool             `json:"ecmp"`
+	Nexthops []*NexthopStatus `json:"nexthops"`
+}
+
+type NexthopStatus struct {
+	Addr     string `json:"addr"`
+	Priority int    `json:"priority"`
+	Up       bool   `json:"up"`
+}
+
+// Status returns state of running edge
+func (s *Server) Status(reg *Registry) *EdgeStatus {
+	mode := modeTUN
+	if s.tap {
+		mode = modeTAP
+	}
+
+	s.trMu.Lock()
+	transport := s.transport
+	s.trMu.Unlock()
+
+	if len(transport) == 0 {
+		transport = codec.TransportUDP
+	}
+
+	compress, _ := s.compress.Load().(string)
+	if len(compress) == 0 {
+		compress = "none"
+	}
+
+	return &EdgeStatus{
+		Registry:   reg.Status(),
+		Mode:       mode,
+		Listen:     s.laddr,
+		PublicAddr: s.PublicAddr(),
+		Transport:  transport,
+		Compress:   compress,
+		KeyID:      s.crypto.KeyID(),
+		MTU:        s.mtu,
+		Stats:      Stats(),
+		Errors:     RecentErrors(),
+	}
+}
+
+// Routes returns routes to peers sorted by cidr
+func (s *Server) Routes() []*RouteStatus {
+	s.mu.Lock()
+	pcs := make([]*peerConn, 0, len(s.peerConns))
+	for _, pc := range s.peerConns {
+		pcs = append(pcs, pc)
+	}
+	s.mu.Unlock()
+
+	routes := make([]*RouteStatus, 0, len(pcs))
+	for _, pc := range pcs {
+		r := &RouteStatus{
+			Cidr:     pc.cidr,
+			ECMP:     pc.ecmp,
+			Nexthops: make([]*NexthopStatus, 0, len(pc.nexthops)),
+		}
+		for _, n := range pc.nexthops {
+			r.Nexthops = append(r.Nexthops, &NexthopStatus{
+				Addr:     n.addr,
+				Priority: n.priority,
+				Up:       n.alive(),
+			})
+		}
+		routes = append(routes, r)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Cidr < routes[j].Cidr
+	})
+	return routes
+}
+
+// ServeStatus serves local status api over unix socket
+// GET /status: controller connection, counters and recent errors
+// GET /peers: path health of peers
+// GET /routes: routes to peers with liveness of next hops
+// GET /acl: acl rules with hits
+// GET /ratelimits: traffic of rate limits
+func ServeStatus(path string, s *Server, reg *Registry) error {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status(reg))
+	})
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.PeerStats())
+	})
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Routes())
+	})
+	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.ACLStats())
+	})
+	mux.HandleFunc("/ratelimits", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.RateLimitStats())
+	})
+	return http.Serve(lis, mux)
+}
+
+// removeStaleSocket removes socket left by edge exited,
+// path served by running edge or not a socket is kept
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another edge", path)
+	}
+	return os.Remove(path)
+}
+
+// statusGet requests local status api of running edge
+func statusGet(path, uri string, obj interface{}) error {
+	cli := &http.Client{
+		Timeout: time.Second * 5,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	resp, err := cli.Get("http://edge" + uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+// formatTime formats unix timestamp, never if zero
+func formatTime(ts int64) string {
+	if ts <= 0 {
+		return "never"
+	}
+	return time.Unix(ts, 0).Format("2006-01-02 15:04:05")
+}
+
+// printStatus prints controller connection, counters,
+// recent errors and rate limits
+func printStatus(path string) error {
+	status := &EdgeStatus{}
+	err := statusGet(path, "/status", status)
+	if err != nil {
+		return err
+	}
+
+	reg := status.Registry
+	state := "disconnected"
+	if reg.Connected {
+		state = "connected since " + formatTime(reg.ConnectedAt)
+	}
+
+	fmt.Printf("controller:     %s (%s)\n", reg.Controller, state)
+	fmt.Printf("namespace:      %s\n", reg.Namespace)
+	fmt.Printf("name:           %s\n", reg.Name)
+	fmt.Printf("reconnects:     %d\n", reg.Reconnects)
+	if len(reg.LastError) > 0 {
+		fmt.Printf("last error:     %s\n", reg.LastError)
+	}
+	fmt.Printf("last heartbeat: %s (rtt %.2fms)\n", formatTime(reg.LastHeartbeat), reg.HeartbeatRTT)
+	fmt.Printf("listen:         %s (%s)\n", reg.ListenAddr, status.Listen)
+	fmt.Printf("public addr:    %s\n", status.PublicAddr)
+	fmt.Printf("vpc:            %s\n", reg.VPC)
+	fmt.Printf("mode:           %s, mtu %d\n", status.Mode, status.MTU)
+	fmt.Printf("transport:      %s\n", status.Transport)
+	fmt.Printf("compress:       %s\n", status.Compress)
+	fmt.Printf("key id:         %d\n", status.KeyID)
+
+	c := status.Stats
+	fmt.Printf("\ntraffic:        in %d bytes, out %d bytes\n", c.TrafficIn, c.TrafficOut)
+	fmt.Printf("fec:            recovered %d, lost %d\n", c.FECRecovered, c.FECLost)
+	fmt.Printf("compress:       %d => %d bytes\n", c.CompressIn, c.CompressOut)
+
+	if len(status.Errors) > 0 {
+		fmt.Printf("\nrecent errors:\n")
+		for _, e := range status.Errors {
+			fmt.Printf("  %s %s\n", formatTime(e.Time), e.Error)
+		}
+	}
+
+	limits := make([]*codec.RateLimitStat, 0)
+	err = statusGet(path, "/ratelimits", &limits)
+	if err != nil {
+		return err
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+
+	fmt.Printf("\n%-15s %-12s %-15s %-12s %-8s %-8s\n",
+		"RateLimit", "Rate", "Bytes", "Packets", "Dropped", "Queued")
+	for _, l := range limits {
+		fmt.Printf("%-15s %-12s %-15d %-12d %-8d %-8d\n",
+			l.Name, codec.FormatRate(l.Rate), l.Bytes, l.Packets, l.Dropped, l.Queued)
+	}
+	return nil
+}
+
+// printPeers prints path health of peers
+func printPeers(path string) error {
+	peers := make([]*codec.PeerStat, 0)
+	err := statusGet(path, "/peers", &peers)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-25s %-5s %-6s %-25s %-10s %-6s %-5s %-6s %-13s %-20s %s\n",
+		"Peer", "Up", "Path", "Addr", "RTT", "Loss", "PMTU", "FEC", "Rec/Lost", "LastSeen", "Cidrs")
+	for _, p := range peers {
+		fec := p.FEC
+		if len(fec) == 0 {
+			fec = "-"
+		}
+
+		fmt.Printf("%-25s %-5v %-6s %-25s %-10s %-6s %-5d %-6s %-13s %-20s %s\n",
+			p.ListenAddr, p.Up, p.Path, p.Addr,
+			fmt.Sprintf("%.2fms", p.RTT),
+			fmt.Sprintf("%.0f%%", p.Loss*100),
+			p.PMTU, fec, fmt.Sprintf("%d/%d", p.FECRecovered, p.FECLost),
+			formatTime(p.LastSeen), strings.Join(p.Cidrs, ","))
+	}
+	return nil
+}
+
+// printRoutes prints routes to peers
+func printRoutes(path string) error {
+	routes := make([]*RouteStatus, 0)
+	err := statusGet(path, "/routes", &routes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-20s %-5s %-25s %-8s %s\n", "Cidr", "ECMP", "Nexthop", "Priority", "Up")
+	for _, r := range routes {
+		for i, n := range r.Nexthops {
+			cidr, ecmp := r.Cidr, fmt.Sprintf("%v", r.ECMP)
+			if i > 0 {
+				cidr, ecmp = "", ""
+			}
+			fmt.Printf("%-20s %-5s %-25s %-8d %v\n", cidr, ecmp, n.Addr, n.Priority, n.Up)
+		}
+	}
+	return nil
+}
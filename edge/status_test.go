@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "edge.sock")
+
+	// nothing to remove
+	err := removeStaleSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// served by running edge
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = removeStaleSocket(path)
+	if err == nil {
+		t.Fatal("socket in use removed")
+	}
+
+	// left by edge exited
+	lis.Close()
+	err = removeStaleSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("stale socket kept: %v", err)
+	}
+}
+
+func TestRemoveStaleSocketNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "edge.sock")
+	err := os.WriteFile(path, []byte("data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = removeStaleSocket(path)
+	if err == nil {
+		t.Fatal("regular file removed")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("regular file removed: %v", err)
+	}
+}
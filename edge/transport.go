@@ -0,0 +1,881 @@
+package main
+
+// transports between edges, selected by scheme of
+// peer listen address, eg: tcp://1.2.3.4:58423
+//  udp:  sealed packets in udp datagrams with nat traversal
+//        and relay, see nat.go and relay.go
+//  tcp:  sealed packets framed in tls over tcp,
+//        for networks blocking udp
+//  kcp:  sealed packets framed in kcp session
+//  quic: sealed packets framed in quic stream
+// listen address without scheme uses transport of namespace,
+// udp if not set.
+//
+// kcp and quic share udp sockets of edge, their datagrams are
+// prefixed by one byte which is never crypto or codec version.
+// streams are dialed on demand, the dialer sends hello with its
+// listen address as the first frame and the acceptor replies its
+// hello, so that the stream is used by both edges.
+// tls certificates of tcp and quic are generated by each edge at
+// startup. instead of chain verification, hello carries pin of
+// the certificate sealed by namespace secret, the pin must match
+// the certificate of tls peer, so that the peer holds the secret.
+// only transport of listen address of the edge is listened.
+//
+// frame: | 2bytes length | sealed packet |
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/pki"
+	"github.com/quic-go/quic-go"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// first byte of kcp and quic datagrams on udp sockets,
+// named by the receiver
+const (
+	muxKCPListen = 0x10
+	muxKCPDial   = 0x11
+	muxQUIC      = 0x12
+)
+
+const (
+	streamQueueSize    = 1024
+	streamDialTimeout  = time.Second * 10
+	streamHelloTimeout = time.Second * 10
+	streamRedial       = time.Second * 5
+	streamALPN         = "cframe"
+
+	// datagrams queued to kcp and quic
+	muxQueueSize = 1024
+)
+
+var errStreamDialing = errors.New("stream is dialing")
+
+// streamHello is the first frame of both edges of stream
+type streamHello struct {
+	ListenAddr string `json:"listen_addr"`
+
+	// pin of tls certificate, empty for kcp
+	Pin string `json:"pin,omitempty"`
+}
+
+// transport carries sealed packets to peers over streams,
+// udp is handled by the packet pipeline instead
+type transport interface {
+	// listen accepts streams from peers, it is idempotent
+	listen() error
+
+	// dial connects to peer at host:port
+	dial(hostport string) (net.Conn, error)
+}
+
+// packetTransport is transport on udp sockets of edge
+type packetTransport interface {
+	// input passes datagram prefixed by mux byte to transport,
+	// it returns false if the prefix is not of the transport
+	input(prefix byte, data []byte, raddr *net.UDPAddr) bool
+}
+
+func newTransports(s *Server) map[string]transport {
+	return map[string]transport{
+		codec.TransportTCP:  &tcpTransport{s: s},
+		codec.TransportKCP:  &kcpTransport{s: s, dials: make(map[string]*muxConn)},
+		codec.TransportQUIC: &quicTransport{s: s},
+	}
+}
+
+// SetTransport sets transport of namespace and listen address
+// of current edge from controller, listener of the transport
+// is started if the edge is reached via stream
+func (s *Server) SetTransport(transport, listenAddr string) {
+	s.trMu.Lock()
+	s.transport, s.listenAddr = transport, listenAddr
+	s.trMu.Unlock()
+
+	s.epMu.Lock()
+	for _, ep := range s.endpoints {
+		ep.transport, _ = s.transportOf(ep.listenAddr)
+	}
+	s.epMu.Unlock()
+
+	if t, _ := s.transportOf(listenAddr); t != codec.TransportUDP {
+		err := s.listenTransport(t)
+		if err != nil {
+			log.Error("listen %s fail: %v", t, err)
+		}
+	}
+}
+
+// transportOf returns transport and host:port of peer listen address
+func (s *Server) transportOf(listenAddr string) (string, string) {
+	transport, hostport, err := codec.ParseListenAddr(listenAddr)
+	if err != nil {
+		return codec.TransportUDP, listenAddr
+	}
+
+	if len(transport) == 0 {
+		s.trMu.Lock()
+		transport = s.transport
+		s.trMu.Unlock()
+	}
+
+	if len(transport) == 0 {
+		transport = codec.TransportUDP
+	}
+	return transport, hostport
+}
+
+// initTransports generates tls certificate of streams, transport
+// of laddr is listened if its scheme is set, otherwise it is
+// listened once transport of namespace is known
+func (s *Server) initTransports() error {
+	certPEM, keyPEM, err := pki.GenerateCA(streamALPN)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	s.streamPin, err = pki.PinFromPEM(certPEM)
+	if err != nil {
+		return err
+	}
+
+	// certificates are self signed, pins are checked by hello
+	s.tlsConfig = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		NextProtos:         []string{streamALPN},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if t, _, _ := codec.ParseListenAddr(s.laddr); len(t) > 0 && t != codec.TransportUDP {
+		return s.listenTransport(t)
+	}
+	return nil
+}
+
+func (s *Server) listenTransport(name string) error {
+	t := s.transports[name]
+	if t == nil {
+		return fmt.Errorf("unsupported transport %s", name)
+	}
+	return t.listen()
+}
+
+// demux passes kcp and quic datagrams to their transports,
+// it returns false for other datagrams
+func (s *Server) demux(buf []byte, raddr *net.UDPAddr) bool {
+	if len(buf) == 0 || buf[0] < muxKCPListen || buf[0] > muxQUIC {
+		return false
+	}
+
+	for _, t := range s.transports {
+		if pt, ok := t.(packetTransport); ok && pt.input(buf[0], buf[1:], raddr) {
+			break
+		}
+	}
+	return true
+}
+
+// redial starts dialing stream of ep if not connected,
+// caller must hold epMu
+func (s *Server) redial(ep *endpoint) {
+	if ep.stream != nil || ep.dialing || time.Since(ep.dialAt) < streamRedial {
+		return
+	}
+
+	// the stream between edges both reached via streams
+	// is dialed by the edge with the smaller listen address
+	s.trMu.Lock()
+	listenAddr := s.listenAddr
+	s.trMu.Unlock()
+	if t, _ := s.transportOf(listenAddr); t != codec.TransportUDP && listenAddr > ep.listenAddr {
+		return
+	}
+
+	ep.dialing = true
+	ep.dialAt = time.Now()
+	go s.dialStream(ep.listenAddr)
+}
+
+// dialStream connects to peer and serves the stream
+func (s *Server) dialStream(peer string) {
+	transport, hostport := s.transportOf(peer)
+	st, err := s.dial(peer, transport, hostport)
+	if err != nil {
+		log.Error("connect %s via %s fail: %v", peer, transport, err)
+		s.epMu.Lock()
+		if ep := s.endpoints[peer]; ep != nil {
+			ep.dialing = false
+		}
+		s.epMu.Unlock()
+		return
+	}
+
+	log.Info("peer %s connected via %s", peer, transport)
+	s.serveStream(st)
+}
+
+func (s *Server) dial(peer, transport, hostport string) (*stream, error) {
+	t := s.transports[transport]
+	if t == nil {
+		return nil, fmt.Errorf("unsupported transport %s", transport)
+	}
+
+	conn, err := t.dial(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.writeHello(conn)
+	if err == nil {
+		_, err = s.readHello(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newStream(peer, transport, conn), nil
+}
+
+// accept reads hello of peer, replies hello and serves the stream
+func (s *Server) accept(transport string, conn net.Conn) {
+	hello, err := s.readHello(conn)
+	if err == nil {
+		err = s.writeHello(conn)
+	}
+	if err != nil {
+		log.Error("hello with %s via %s fail: %v", conn.RemoteAddr(), transport, err)
+		conn.Close()
+		return
+	}
+
+	log.Info("peer %s connected via %s from %s", hello.ListenAddr, transport, conn.RemoteAddr())
+	s.serveStream(newStream(hello.ListenAddr, transport, conn))
+}
+
+func (s *Server) writeHello(conn net.Conn) error {
+	s.trMu.Lock()
+	listenAddr := s.listenAddr
+	s.trMu.Unlock()
+	if len(listenAddr) == 0 {
+		return fmt.Errorf("listen address unknown")
+	}
+
+	b, err := json.Marshal(&streamHello{ListenAddr: listenAddr, Pin: s.streamPin})
+	if err != nil {
+		return err
+	}
+
+	hello, err := s.crypto.Seal(b)
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(streamHelloTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	return writeFrame(conn, hello)
+}
+
+// readHello reads hello of peer and checks that its pin
+// matches certificate of tls peer
+func (s *Server) readHello(conn net.Conn) (*streamHello, error) {
+	buf := getBuf()
+	defer putBuf(buf)
+
+	conn.SetReadDeadline(time.Now().Add(streamHelloTimeout))
+	nr, err := readFrame(conn, *buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.crypto.Open((*buf)[:nr])
+	if err != nil {
+		return nil, err
+	}
+
+	hello := &streamHello{}
+	err = json.Unmarshal(b, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hello.ListenAddr) == 0 {
+		return nil, errInvalidPacket
+	}
+
+	pin, err := peerPin(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pin) > 0 && pin != hello.Pin {
+		return nil, fmt.Errorf("certificate pin of %s mismatch", hello.ListenAddr)
+	}
+	return hello, nil
+}
+
+// peerPin returns pin of certificate of tls peer,
+// empty if conn is not tls
+func peerPin(conn net.Conn) (string, error) {
+	var certs []*x509.Certificate
+	switch c := conn.(type) {
+	case *tls.Conn:
+		certs = c.ConnectionState().PeerCertificates
+	case *quicStream:
+		certs = c.conn.ConnectionState().TLS.PeerCertificates
+	default:
+		return "", nil
+	}
+
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no peer certificate")
+	}
+	return pki.Pin(certs[0]), nil
+}
+
+// serveStream makes st the stream of peer
+// and delivers packets from it until closed
+func (s *Server) serveStream(st *stream) {
+	s.epMu.Lock()
+	ep := s.endpoints[st.peer]
+	if ep == nil {
+		ep = s.newEndpoint(st.peer)
+		s.endpoints[st.peer] = ep
+		s.indexPeers()
+	}
+	if ep.stream != nil {
+		ep.stream.close()
+	}
+	ep.stream = st
+	st.counters = ep.counters
+	ep.dialing = false
+	s.epMu.Unlock()
+
+	go st.write()
+	defer func() {
+		st.close()
+		s.epMu.Lock()
+		if ep := s.endpoints[st.peer]; ep != nil && ep.stream == st {
+			ep.stream = nil
+		}
+		s.epMu.Unlock()
+	}()
+
+	q := int(atomic.AddUint32(&s.streamSeq, 1)) % s.iface.Queues()
+	buf := getBuf()
+	defer putBuf(buf)
+	for {
+		// probes are replied every peerProbeInterval
+		st.conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		nr, err := readFrame(st.conn, *buf)
+		if err != nil {
+			log.Error("read from %s via %s fail: %v", st.peer, st.transport, err)
+			return
+		}
+		s.deliver((*buf)[:nr], nil, st.peer, q)
+	}
+}
+
+// sendPeerCtrl sends control packet to peer listenAddr
+// via stream if connected, otherwise via relay
+func (s *Server) sendPeerCtrl(typ byte, listenAddr string, seq uint64) error {
+	buf, err := s.sealCtrl(typ, seq)
+	if err != nil {
+		return err
+	}
+
+	s.epMu.RLock()
+	var st *stream
+	if ep := s.endpoints[listenAddr]; ep != nil {
+		st = ep.stream
+	}
+	s.epMu.RUnlock()
+
+	if st != nil {
+		st.send(&datagram{data: buf})
+		return nil
+	}
+	return s.sendRelay(listenAddr, buf)
+}
+
+// stream is a connection to peer of stream transports
+type stream struct {
+	// peer listen address
+	peer      string
+	transport string
+	conn      net.Conn
+
+	sendQueue chan *datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// counters of peer, set before written
+	counters *peerCounters
+}
+
+func newStream(peer, transport string, conn net.Conn) *stream {
+	return &stream{
+		peer:      peer,
+		transport: transport,
+		conn:      conn,
+		sendQueue: make(chan *datagram, streamQueueSize),
+		closed:    make(chan struct{}),
+	}
+}
+
+// send queues sealed packet, it is dropped if queue is full
+func (st *stream) send(d *datagram) {
+	select {
+	case st.sendQueue <- d:
+	default:
+		droppedPackets.WithLabelValues(dropSendFail).Inc()
+		if d.buf != nil {
+			putBuf(d.buf)
+		}
+	}
+}
+
+func (st *stream) close() {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+		st.conn.Close()
+	})
+}
+
+// write sends queued packets, flushed once queue is empty
+func (st *stream) write() {
+	defer st.close()
+	w := bufio.NewWriterSize(st.conn, bufSize)
+	for {
+		var d *datagram
+		select {
+		case d = <-st.sendQueue:
+		case <-st.closed:
+			return
+		}
+
+		err := writeFrame(w, d.data)
+		if d.buf != nil {
+			putBuf(d.buf)
+		}
+		if err == nil && len(st.sendQueue) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Error("write to %s via %s fail: %v", st.peer, st.transport, err)
+			droppedPackets.WithLabelValues(dropSendFail).Inc()
+			return
+		}
+
+		st.counters.addOut(len(d.data))
+	}
+}
+
+// maxFrameLen is the largest frame fits in the length header
+const maxFrameLen = 0xffff
+
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxFrameLen {
+		return fmt.Errorf("frame of %d bytes too large", len(data))
+	}
+
+	var hdr [2]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(data)))
+	_, err := w.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// readFrame reads frame into buf and returns its length
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	_, err = io.ReadFull(r, buf[:n])
+	return n, err
+}
+
+// tcpTransport is tls over tcp, listened on laddr
+// once the edge is reached via tcp
+type tcpTransport struct {
+	s *Server
+
+	mu  sync.Mutex
+	lis net.Listener
+}
+
+func (t *tcpTransport) listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lis != nil {
+		return nil
+	}
+
+	_, laddr, err := codec.ParseListenAddr(t.s.laddr)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+	t.lis = lis
+	log.Info("listen tcp %s", laddr)
+
+	go func() {
+		tlsLis := tls.NewListener(lis, t.s.tlsConfig)
+		for {
+			conn, err := tlsLis.Accept()
+			if err != nil {
+				log.Error("accept tcp fail: %v", err)
+				return
+			}
+			go t.s.accept(codec.TransportTCP, conn)
+		}
+	}()
+	return nil
+}
+
+func (t *tcpTransport) dial(hostport string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: streamDialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", hostport, t.s.tlsConfig)
+}
+
+// kcpTransport is kcp on udp sockets, datagrams to listener
+// and to dialed sessions are demuxed by prefix
+type kcpTransport struct {
+	s *Server
+
+	mu  sync.Mutex
+	lis *muxConn
+
+	// key: peer udp address
+	dials map[string]*muxConn
+}
+
+func (t *kcpTransport) listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lis != nil {
+		return nil
+	}
+
+	// replies of listener are sent to dialer
+	t.lis = newMuxConn(t.s, muxKCPDial)
+	lis, err := kcp.ServeConn(nil, 0, 0, t.lis)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			sess, err := lis.AcceptKCP()
+			if err != nil {
+				log.Error("accept kcp fail: %v", err)
+				return
+			}
+			tuneKCP(sess)
+			go t.s.accept(codec.TransportKCP, sess)
+		}
+	}()
+	return nil
+}
+
+func (t *kcpTransport) dial(hostport string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	mc := newMuxConn(t.s, muxKCPListen)
+	key := raddr.String()
+	t.mu.Lock()
+	if old := t.dials[key]; old != nil {
+		old.Close()
+	}
+	t.dials[key] = mc
+	t.mu.Unlock()
+
+	sess, err := kcp.NewConn2(raddr, nil, 0, 0, mc)
+	if err != nil {
+		t.release(key, mc)
+		return nil, err
+	}
+	tuneKCP(sess)
+	return &kcpConn{sess, func() { t.release(key, mc) }}, nil
+}
+
+func (t *kcpTransport) release(key string, mc *muxConn) {
+	mc.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dials[key] == mc {
+		delete(t.dials, key)
+	}
+}
+
+func (t *kcpTransport) input(prefix byte, data []byte, raddr *net.UDPAddr) bool {
+	var mc *muxConn
+	switch prefix {
+	case muxKCPListen:
+		t.mu.Lock()
+		mc = t.lis
+		t.mu.Unlock()
+	case muxKCPDial:
+		t.mu.Lock()
+		mc = t.dials[raddr.String()]
+		t.mu.Unlock()
+	default:
+		return false
+	}
+
+	if mc != nil {
+		mc.input(data, raddr)
+	}
+	return true
+}
+
+func tuneKCP(sess *kcp.UDPSession) {
+	sess.SetNoDelay(1, 10, 2, 1)
+	sess.SetWindowSize(1024, 1024)
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+}
+
+// kcpConn releases packet conn of dialed session once closed
+type kcpConn struct {
+	*kcp.UDPSession
+	release func()
+}
+
+func (c *kcpConn) Close() error {
+	err := c.UDPSession.Close()
+	c.release()
+	return err
+}
+
+// quicTransport is quic on udp sockets,
+// one quic stream for each connection
+type quicTransport struct {
+	s *Server
+
+	// tr is created once dialed or listened
+	mu  sync.Mutex
+	tr  *quic.Transport
+	lis *quic.Listener
+}
+
+var quicConfig = &quic.Config{
+	KeepAlivePeriod: peerProbeInterval,
+	MaxIdleTimeout:  peerTimeout,
+}
+
+func (t *quicTransport) listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lis != nil {
+		return nil
+	}
+
+	lis, err := t.transport().Listen(t.s.tlsConfig, quicConfig)
+	if err != nil {
+		return err
+	}
+	t.lis = lis
+
+	go func() {
+		for {
+			conn, err := lis.Accept(context.Background())
+			if err != nil {
+				log.Error("accept quic fail: %v", err)
+				return
+			}
+			go t.accept(conn)
+		}
+	}()
+	return nil
+}
+
+// transport returns quic transport, caller must hold mu
+func (t *quicTransport) transport() *quic.Transport {
+	if t.tr == nil {
+		t.tr = &quic.Transport{Conn: newMuxConn(t.s, muxQUIC)}
+	}
+	return t.tr
+}
+
+func (t *quicTransport) accept(conn quic.Connection) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamHelloTimeout)
+	defer cancel()
+	qs, err := conn.AcceptStream(ctx)
+	if err != nil {
+		log.Error("accept quic stream from %s fail: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(0, "")
+		return
+	}
+	t.s.accept(codec.TransportQUIC, &quicStream{qs, conn})
+}
+
+func (t *quicTransport) dial(hostport string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	tr := t.transport()
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamDialTimeout)
+	defer cancel()
+	conn, err := tr.Dial(ctx, raddr, t.s.tlsConfig, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	qs, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicStream{qs, conn}, nil
+}
+
+func (t *quicTransport) input(prefix byte, data []byte, raddr *net.UDPAddr) bool {
+	if prefix != muxQUIC {
+		return false
+	}
+
+	t.mu.Lock()
+	tr := t.tr
+	t.mu.Unlock()
+	if tr != nil {
+		tr.Conn.(*muxConn).input(data, raddr)
+	}
+	return true
+}
+
+// quicStream is net.Conn of quic stream
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicStream) Close() error {
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+func (c *quicStream) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStream) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+type muxPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// muxConn is packet conn of kcp or quic on udp sockets of edge
+type muxConn struct {
+	s *Server
+
+	// prefix of datagrams sent
+	prefix byte
+
+	in        chan muxPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuxConn(s *Server, prefix byte) *muxConn {
+	return &muxConn{
+		s:      s,
+		prefix: prefix,
+		in:     make(chan muxPacket, muxQueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+// input queues copy of datagram, it is dropped if queue is full
+func (c *muxConn) input(data []byte, addr *net.UDPAddr) {
+	select {
+	case c.in <- muxPacket{append([]byte(nil), data...), addr}:
+	default:
+	}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p.data), p.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	raddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("invalid udp address %s", addr)
+	}
+
+	buf := getBuf()
+	defer putBuf(buf)
+	(*buf)[0] = c.prefix
+	n := copy((*buf)[1:], b)
+	_, err := c.s.conn.WriteToUDP((*buf)[:n+1], raddr)
+	return n, err
+}
+
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error      { return nil }
+func (c *muxConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *muxConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// buffers of udp sockets are set by listenUDP
+func (c *muxConn) SetReadBuffer(bytes int) error  { return nil }
+func (c *muxConn) SetWriteBuffer(bytes int) error { return nil }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func newTestStreamServer(t *testing.T, listenAddr string) *Server {
+	s := &Server{crypto: newTestCrypto(t), listenAddr: listenAddr}
+	err := s.initTransports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// handshake runs hello of dialer and acceptor over tls pipe,
+// tls of acceptor is served by certificate of tlsServer
+func handshake(dialer, acceptor, tlsServer *Server) (*streamHello, *streamHello, error, error) {
+	c1, c2 := net.Pipe()
+	client := tls.Client(c1, dialer.tlsConfig)
+	server := tls.Server(c2, tlsServer.tlsConfig)
+	defer c1.Close()
+	defer c2.Close()
+
+	type result struct {
+		hello *streamHello
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		hello, err := acceptor.readHello(server)
+		if err == nil {
+			err = acceptor.writeHello(server)
+		}
+		c2.Close()
+		done <- result{hello, err}
+	}()
+
+	err := dialer.writeHello(client)
+	var reply *streamHello
+	if err == nil {
+		reply, err = dialer.readHello(client)
+	}
+	c1.Close()
+
+	r := <-done
+	return r.hello, reply, r.err, err
+}
+
+func TestStreamHello(t *testing.T) {
+	a := newTestStreamServer(t, "tcp://10.0.0.1:58423")
+	b := newTestStreamServer(t, "tcp://10.0.0.2:58423")
+
+	hello, reply, errAccept, errDial := handshake(a, b, b)
+	if errAccept != nil || errDial != nil {
+		t.Fatalf("hello fail: %v, %v", errAccept, errDial)
+	}
+
+	if hello.ListenAddr != a.listenAddr || hello.Pin != a.streamPin {
+		t.Fatalf("accepted hello %+v, expect %s %s", hello, a.listenAddr, a.streamPin)
+	}
+
+	if reply.ListenAddr != b.listenAddr || reply.Pin != b.streamPin {
+		t.Fatalf("replied hello %+v, expect %s %s", reply, b.listenAddr, b.streamPin)
+	}
+}
+
+func TestStreamHelloPinMismatch(t *testing.T) {
+	a := newTestStreamServer(t, "tcp://10.0.0.1:58423")
+	b := newTestStreamServer(t, "tcp://10.0.0.2:58423")
+
+	// tls terminated by m with certificate of its own,
+	// hello of b is sealed by the secret but pins b
+	m := newTestStreamServer(t, "tcp://10.0.0.3:58423")
+	_, _, _, errDial := handshake(a, b, m)
+	if errDial == nil {
+		t.Fatal("hello with certificate of another peer accepted")
+	}
+}
+
+func TestFrameLen(t *testing.T) {
+	var w bytes.Buffer
+	data := make([]byte, maxFrameLen)
+	err := writeFrame(&w, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, bufSize)
+	n, err := readFrame(&w, buf)
+	if err != nil || n != maxFrameLen {
+		t.Fatalf("read frame of %d bytes: %v, expect %d", n, err, maxFrameLen)
+	}
+
+	err = writeFrame(&w, make([]byte, maxFrameLen+1))
+	if err == nil || w.Len() != 0 {
+		t.Fatal("frame over length header written")
+	}
+
+	// largest sealed packet with fec header fits in a frame
+	if maxMTU+cryptoHeaderLen+cryptoTagLen+fecOverhead > maxFrameLen {
+		t.Fatalf("mtu %d overflows frame", maxMTU)
+	}
+}
@@ -2,27 +2,85 @@ package main
 
 import (
 	"fmt"
-	"os/exec"
+	"net"
 	"runtime"
+	"sync"
 	"time"
 
 	log "github.com/ICKelin/cframe/pkg/logs"
 	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// rtnetlink protocol marks routes owned by cframe
+	// so that stale routes can be found on startup/shutdown
+	rtprotCframe = 99
+
+	defaultRouteTable  = unix.RT_TABLE_MAIN
+	defaultRouteMetric = 50
+
+	// ip rule priority for non main route table
+	// lower than main(32766)
+	rulePriority = 32000
+)
+
+// device modes
+const (
+	// ip packets are routed to peers
+	modeTUN = "tun"
+
+	// ethernet frames are bridged between peers
+	modeTAP = "tap"
 )
 
 type Interface struct {
-	tun *water.Interface
+	tun  *water.Interface
+	link netlink.Link
+
+	// tun queues, the first one is tun
+	queues []*water.Interface
+
+	// routing table and metric for cframe routes
+	table  int
+	metric int
+
+	closeOnce sync.Once
 }
 
-func NewInterface() (*Interface, error) {
-	iface := &Interface{}
+// NewInterface creates tun or tap device with queues file descriptors,
+// multi queue tun(IFF_MULTI_QUEUE) is used if queues > 1.
+// the first free one of cframe.0-9 is created if name is empty
+func NewInterface(mode, name string, queues int) (*Interface, error) {
+	iface := &Interface{
+		table:  defaultRouteTable,
+		metric: defaultRouteMetric,
+	}
 
 	ifconfig := water.Config{
 		DeviceType: water.TUN,
 	}
 
-	for i := 0; i < 10; i++ {
-		ifconfig.Name = fmt.Sprintf("cframe.%d", i)
+	switch mode {
+	case modeTUN:
+	case modeTAP:
+		ifconfig.DeviceType = water.TAP
+	default:
+		return nil, fmt.Errorf("unsupported mode %s", mode)
+	}
+	ifconfig.MultiQueue = queues > 1
+
+	names := []string{name}
+	if len(name) == 0 {
+		names = names[:0]
+		for i := 0; i < 10; i++ {
+			names = append(names, fmt.Sprintf("cframe.%d", i))
+		}
+	}
+
+	for _, name := range names {
+		ifconfig.Name = name
 
 		ifce, err := water.New(ifconfig)
 		if err != nil {
@@ -31,16 +89,42 @@ func NewInterface() (*Interface, error) {
 			continue
 		}
 
+		link, err := netlink.LinkByName(ifce.Name())
+		if err != nil {
+			ifce.Close()
+			return nil, fmt.Errorf("get link %s fail: %v", ifce.Name(), err)
+		}
+
 		iface.tun = ifce
+		iface.link = link
+		iface.queues = append(iface.queues, ifce)
+
+		// attach the other queues to the same device
+		for len(iface.queues) < queues {
+			q, err := water.New(ifconfig)
+			if err != nil {
+				iface.closeQueues()
+				return nil, fmt.Errorf("new queue %d of %s fail: %v",
+					len(iface.queues), ifconfig.Name, err)
+			}
+			iface.queues = append(iface.queues, q)
+		}
 		return iface, nil
 	}
 	return nil, fmt.Errorf("new interface %s fail", ifconfig.Name)
 }
 
+// SetRouteTable sets routing table and metric for cframe routes
+// it should be called before any route added
+func (iface *Interface) SetRouteTable(table, metric int) {
+	iface.table = table
+	iface.metric = metric
+}
+
 func (iface *Interface) SetMTU(mtu int) error {
-	out, err := execCmd("ifconfig", []string{iface.tun.Name(), "mtu", fmt.Sprintf("%d", mtu)})
+	err := netlink.LinkSetMTU(iface.link, mtu)
 	if err != nil {
-		return fmt.Errorf("set mtu fail: %s %v", out, err)
+		return fmt.Errorf("set mtu fail: %v", err)
 	}
 	return nil
 }
@@ -48,9 +132,9 @@ func (iface *Interface) SetMTU(mtu int) error {
 func (iface *Interface) Up() error {
 	switch runtime.GOOS {
 	case "linux":
-		out, err := execCmd("ifconfig", []string{iface.tun.Name(), "up"})
+		err := netlink.LinkSetUp(iface.link)
 		if err != nil {
-			return fmt.Errorf("ifconfig fail: %s %v", out, err)
+			return fmt.Errorf("link set up fail: %v", err)
 		}
 
 	default:
@@ -61,25 +145,168 @@ func (iface *Interface) Up() error {
 	return nil
 }
 
-func (iface *Interface) Read() ([]byte, error) {
-	buf := make([]byte, 2048)
-	n, err := iface.tun.Read(buf)
+// SetAddr replaces tun address, cidr eg: 10.10.0.1/24
+func (iface *Interface) SetAddr(cidr string) error {
+	addr, err := netlink.ParseAddr(cidr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return buf[:n], nil
+	err = netlink.AddrReplace(iface.link, addr)
+	if err != nil {
+		return fmt.Errorf("addr replace %s fail: %v", cidr, err)
+	}
+	return nil
 }
 
-func (iface *Interface) Write(buf []byte) (int, error) {
-	return iface.tun.Write(buf)
+// AddRoute adds or replaces route of dst via tun device
+func (iface *Interface) AddRoute(dst *net.IPNet) error {
+	err := netlink.RouteReplace(iface.route(dst))
+	if err != nil {
+		return fmt.Errorf("route replace %s fail: %v", dst, err)
+	}
+	return nil
 }
 
-func (iface *Interface) Close() {
-	iface.tun.Close()
+func (iface *Interface) DelRoute(dst *net.IPNet) error {
+	err := netlink.RouteDel(iface.route(dst))
+	if err != nil && err != unix.ESRCH {
+		return fmt.Errorf("route del %s fail: %v", dst, err)
+	}
+	return nil
+}
+
+// FlushRoutes removes cframe routes of the routing table via tun device
+// and stale ones via links that no longer exist. routes of other edges
+// on the same host are kept
+func (iface *Interface) FlushRoutes() (int, error) {
+	filter := &netlink.Route{
+		Protocol: rtprotCframe,
+		Table:    iface.table,
+	}
+
+	count := 0
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, filter,
+			netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return count, fmt.Errorf("route list fail: %v", err)
+		}
+
+		for i := range routes {
+			if !iface.ownRoute(&routes[i]) {
+				continue
+			}
+
+			err := netlink.RouteDel(&routes[i])
+			if err != nil && err != unix.ESRCH {
+				return count, fmt.Errorf("route del %s fail: %v", routes[i].Dst, err)
+			}
+			count += 1
+		}
+	}
+
+	return count, nil
+}
+
+// ownRoute reports whether route is via tun device or stale,
+// link of stale route is gone along with its edge
+func (iface *Interface) ownRoute(r *netlink.Route) bool {
+	if r.LinkIndex == iface.link.Attrs().Index {
+		return true
+	}
+
+	_, err := netlink.LinkByIndex(r.LinkIndex)
+	_, gone := err.(netlink.LinkNotFoundError)
+	return gone
+}
+
+// AddRule adds ip rule to lookup cframe routing table
+// nothing to do for main table. the rule is shared by edges
+// on the same host and kept after exit
+func (iface *Interface) AddRule() error {
+	if iface.table == unix.RT_TABLE_MAIN {
+		return nil
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("rule list fail: %v", err)
+		}
+
+		exists := false
+		for _, r := range rules {
+			if r.Table == iface.table && r.Priority == rulePriority {
+				exists = true
+				break
+			}
+		}
+
+		if exists {
+			continue
+		}
+
+		err = netlink.RuleAdd(iface.rule(family))
+		if err != nil {
+			return fmt.Errorf("rule add table %d fail: %v", iface.table, err)
+		}
+	}
+	return nil
+}
+
+func (iface *Interface) route(dst *net.IPNet) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: iface.link.Attrs().Index,
+		Dst:       dst,
+		Scope:     netlink.SCOPE_LINK,
+		Protocol:  rtprotCframe,
+		Table:     iface.table,
+		Priority:  iface.metric,
+	}
+}
+
+func (iface *Interface) rule(family int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = iface.table
+	rule.Priority = rulePriority
+	return rule
 }
 
-func execCmd(cmd string, args []string) (string, error) {
-	b, err := exec.Command(cmd, args...).CombinedOutput()
-	return string(b), err
+func (iface *Interface) IsTAP() bool {
+	return iface.tun.IsTAP()
+}
+
+func (iface *Interface) Queues() int {
+	return len(iface.queues)
+}
+
+// ReadQueue reads one packet from queue q into buf
+func (iface *Interface) ReadQueue(q int, buf []byte) (int, error) {
+	return iface.queues[q%len(iface.queues)].Read(buf)
+}
+
+// WriteQueue writes one packet to queue q
+func (iface *Interface) WriteQueue(q int, buf []byte) (int, error) {
+	return iface.queues[q%len(iface.queues)].Write(buf)
+}
+
+func (iface *Interface) closeQueues() {
+	for _, q := range iface.queues {
+		q.Close()
+	}
+}
+
+// Close removes cframe routes then close tun device
+func (iface *Interface) Close() {
+	iface.closeOnce.Do(func() {
+		n, err := iface.FlushRoutes()
+		if err != nil {
+			log.Error("flush routes fail: %v", err)
+		}
+		log.Info("flush %d cframe routes", n)
+
+		iface.closeQueues()
+	})
 }
@@ -37,6 +37,34 @@ func (s *Etcd) Set(key string, val interface{}) error {
 	return err
 }
 
+// Grant creates lease of ttl for SetWithLease
+func (s *Etcd) Grant(ttl time.Duration) (clientv3.LeaseID, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	lease, err := s.cli.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	return lease.ID, nil
+}
+
+// KeepAliveOnce renews lease, error if lease expired
+func (s *Etcd) KeepAliveOnce(lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	_, err := s.cli.KeepAliveOnce(ctx, lease)
+	return err
+}
+
+// SetWithLease sets key removed once lease expired
+func (s *Etcd) SetWithLease(key string, val interface{}, lease clientv3.LeaseID) error {
+	b, _ := json.Marshal(val)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	_, err := s.cli.Put(ctx, key, string(b), clientv3.WithLease(lease))
+	return err
+}
+
 func (s *Etcd) Get(key string, obj interface{}) error {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
 	defer cancel()
@@ -51,6 +79,38 @@ func (s *Etcd) Get(key string, obj interface{}) error {
 	return json.Unmarshal(resp.Kvs[0].Value, obj)
 }
 
+// GetRevision gets key and returns its mod revision,
+// 0 if key not found and obj is untouched
+func (s *Etcd) GetRevision(key string, obj interface{}) (int64, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	resp, err := s.cli.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) <= 0 {
+		return 0, nil
+	}
+
+	return resp.Kvs[0].ModRevision, json.Unmarshal(resp.Kvs[0].Value, obj)
+}
+
+// CompareAndSet sets key if its mod revision is still rev,
+// rev 0 means key not exists. false if key is modified
+func (s *Etcd) CompareAndSet(key string, rev int64, val interface{}) (bool, error) {
+	b, _ := json.Marshal(val)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	resp, err := s.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpPut(key, string(b))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
 func (s *Etcd) Del(key string) {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
 	defer cancel()
@@ -63,6 +123,23 @@ func (s *Etcd) DelPrefix(prefix string) {
 	s.cli.Delete(ctx, prefix, clientv3.WithPrefix())
 }
 
+// DelAll deletes keys and keys with prefixes in one txn
+func (s *Etcd) DelAll(keys, prefixes []string) error {
+	ops := make([]clientv3.Op, 0, len(keys)+len(prefixes))
+	for _, key := range keys {
+		ops = append(ops, clientv3.OpDelete(key))
+	}
+
+	for _, prefix := range prefixes {
+		ops = append(ops, clientv3.OpDelete(prefix, clientv3.WithPrefix()))
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	_, err := s.cli.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
 func (s *Etcd) List(root string) (map[string]string, error) {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
 	defer cancel()
@@ -77,6 +154,23 @@ func (s *Etcd) List(root string) (map[string]string, error) {
 	return res, nil
 }
 
+// Keys returns keys with prefix in ascending order
+func (s *Etcd) Keys(prefix string) ([]string, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	resp, err := s.cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys, nil
+}
+
 func (s *Etcd) Watch(prefix string) clientv3.WatchChan {
 	return s.cli.Watch(context.Background(), prefix,
 		clientv3.WithPrefix(), clientv3.WithPrevKV())
@@ -0,0 +1,199 @@
+package ip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type IP6 [16]byte
+
+func FromIP6Bytes(ip []byte) IP6 {
+	var ip6 IP6
+	copy(ip6[:], ip)
+	return ip6
+}
+
+func FromIP6(ip net.IP) IP6 {
+	return FromIP6Bytes(ip.To16())
+}
+
+func ParseIP6(s string) (IP6, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return IP6{}, errors.New("Invalid IPv6 address format")
+	}
+	return FromIP6(ip), nil
+}
+
+func MustParseIP6(s string) IP6 {
+	ip, err := ParseIP6(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func (ip IP6) ToIP() net.IP {
+	return net.IP(append([]byte(nil), ip[:]...))
+}
+
+func (ip IP6) String() string {
+	return ip.ToIP().String()
+}
+
+// MarshalJSON: json.Marshaler impl
+func (ip IP6) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, ip)), nil
+}
+
+// UnmarshalJSON: json.Unmarshaler impl
+func (ip *IP6) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if val, err := ParseIP6(string(j)); err != nil {
+		return err
+	} else {
+		*ip = val
+		return nil
+	}
+}
+
+// similar to IP4Net but for 128 bits address
+type IP6Net struct {
+	IP        IP6
+	PrefixLen uint
+}
+
+func (n IP6Net) String() string {
+	return fmt.Sprintf("%s/%d", n.IP.String(), n.PrefixLen)
+}
+
+func (n IP6Net) Network() IP6Net {
+	return IP6Net{
+		n.IP.and(n.Mask()),
+		n.PrefixLen,
+	}
+}
+
+func FromIP6Net(n *net.IPNet) IP6Net {
+	prefixLen, _ := n.Mask.Size()
+	return IP6Net{
+		FromIP6(n.IP),
+		uint(prefixLen),
+	}
+}
+
+func (n IP6Net) ToIPNet() *net.IPNet {
+	return &net.IPNet{
+		IP:   n.IP.ToIP(),
+		Mask: net.CIDRMask(int(n.PrefixLen), 128),
+	}
+}
+
+func (n IP6Net) Overlaps(other IP6Net) bool {
+	var mask IP6
+	if n.PrefixLen < other.PrefixLen {
+		mask = n.Mask()
+	} else {
+		mask = other.Mask()
+	}
+	return n.IP.and(mask) == other.IP.and(mask)
+}
+
+func (n IP6Net) Equal(other IP6Net) bool {
+	return n.IP == other.IP && n.PrefixLen == other.PrefixLen
+}
+
+func (n IP6Net) Mask() IP6 {
+	var mask IP6
+	copy(mask[:], net.CIDRMask(int(n.PrefixLen), 128))
+	return mask
+}
+
+func (n IP6Net) Contains(ip IP6) bool {
+	return n.IP.and(n.Mask()) == ip.and(n.Mask())
+}
+
+func (n IP6Net) Empty() bool {
+	return n.IP == IP6{} && n.PrefixLen == uint(0)
+}
+
+// MarshalJSON: json.Marshaler impl
+func (n IP6Net) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, n)), nil
+}
+
+// UnmarshalJSON: json.Unmarshaler impl
+func (n *IP6Net) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if _, val, err := net.ParseCIDR(string(j)); err != nil {
+		return err
+	} else {
+		*n = FromIP6Net(val)
+		return nil
+	}
+}
+
+func (ip IP6) and(mask IP6) IP6 {
+	var res IP6
+	for i := range ip {
+		res[i] = ip[i] & mask[i]
+	}
+	return res
+}
+
+// ParseCIDR parses ipv4/ipv6 cidr or single ip address,
+// single ip address is treated as host network (/32 or /128),
+// ipv4-mapped ipv6 network is treated as ipv4 network.
+// the returned ipnet is the network address
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if net.ParseIP(s) == nil {
+			return nil, fmt.Errorf("invalid cidr %s", s)
+		}
+
+		// ipv4-mapped host is normalized below
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %s", s)
+	}
+
+	ones, bits := n.Mask.Size()
+	if ip4 := n.IP.To4(); ip4 != nil && bits == 128 && ones >= 96 {
+		n = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 32)}
+	}
+	return n, nil
+}
+
+// CIDROverlaps reports whether cidr1 and cidr2 share any address,
+// cidrs of different address families never overlap
+func CIDROverlaps(cidr1, cidr2 string) (bool, error) {
+	n1, err := ParseCIDR(cidr1)
+	if err != nil {
+		return false, err
+	}
+
+	n2, err := ParseCIDR(cidr2)
+	if err != nil {
+		return false, err
+	}
+
+	v4n1, v4n2 := n1.IP.To4() != nil, n2.IP.To4() != nil
+	switch {
+	case v4n1 && v4n2:
+		return FromIPNet(n1).Overlaps(FromIPNet(n2)), nil
+	case !v4n1 && !v4n2:
+		return FromIP6Net(n1).Overlaps(FromIP6Net(n2)), nil
+	default:
+		return false, nil
+	}
+}
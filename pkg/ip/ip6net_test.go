@@ -0,0 +1,111 @@
+package ip
+
+import (
+	"testing"
+)
+
+func TestParseCIDR(t *testing.T) {
+	cases := []struct {
+		cidr   string
+		expect string
+		ipLen  int
+	}{
+		// bare host address
+		{"10.0.0.1", "10.0.0.1/32", 4},
+		{"2001:db8::1", "2001:db8::1/128", 16},
+		{"::ffff:10.0.0.1", "10.0.0.1/32", 4},
+
+		// network address of cidr
+		{"10.1.2.3/16", "10.1.0.0/16", 4},
+		{"0.0.0.0/0", "0.0.0.0/0", 4},
+		{"2001:db8::1/64", "2001:db8::/64", 16},
+		{"::/0", "::/0", 16},
+
+		// ipv4-mapped ipv6 network
+		{"::ffff:10.1.2.3/104", "10.0.0.0/8", 4},
+		{"::ffff:0:0/96", "0.0.0.0/0", 4},
+		{"::ffff:10.0.0.1/128", "10.0.0.1/32", 4},
+		{"::ffff:0:0/95", "::fffe:0:0/95", 16},
+	}
+
+	for _, c := range cases {
+		n, err := ParseCIDR(c.cidr)
+		if err != nil {
+			t.Errorf("parse %s fail: %v", c.cidr, err)
+			continue
+		}
+
+		if n.String() != c.expect || len(n.IP) != c.ipLen {
+			t.Errorf("parse %s got %s of %d bytes, expect %s of %d bytes",
+				c.cidr, n, len(n.IP), c.expect, c.ipLen)
+		}
+
+		if _, bits := n.Mask.Size(); bits != c.ipLen*8 {
+			t.Errorf("parse %s got %d bits mask, expect %d", c.cidr, bits, c.ipLen*8)
+		}
+	}
+}
+
+func TestParseCIDRInvalid(t *testing.T) {
+	for _, cidr := range []string{"", "10.0.0", "10.0.0.1/33", "2001:db8::/129", "10.0.0.0/", "abc/8", "/8"} {
+		if n, err := ParseCIDR(cidr); err == nil {
+			t.Errorf("parse %q got %s, expect error", cidr, n)
+		}
+	}
+}
+
+func TestCIDROverlaps(t *testing.T) {
+	cases := []struct {
+		cidr1, cidr2 string
+		overlap      bool
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", true},
+		{"10.1.0.0/16", "10.0.0.0/8", true},
+		{"10.0.0.0/16", "10.1.0.0/16", false},
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"0.0.0.0/0", "192.168.1.0/24", true},
+		{"192.168.1.0/24", "192.168.1.255", true},
+		{"192.168.1.0/24", "192.168.2.1", false},
+		{"192.168.1.1", "192.168.1.1/32", true},
+
+		{"2001:db8::/32", "2001:db8:1::/48", true},
+		{"2001:db8::/48", "2001:db8:1::/48", false},
+		{"::/0", "2001:db8::1", true},
+		{"2001:db8::1", "2001:db8::2", false},
+
+		// different address families
+		{"0.0.0.0/0", "::/0", false},
+		{"10.0.0.0/8", "2001:db8::/32", false},
+		{"10.0.0.1", "2001:db8::1", false},
+
+		// ipv4-mapped ipv6 is ipv4
+		{"::ffff:10.0.0.0/104", "10.1.0.0/16", true},
+		{"::ffff:10.0.0.1", "10.0.0.0/8", true},
+		{"::ffff:10.0.0.0/104", "11.0.0.0/8", false},
+		{"::ffff:10.0.0.0/104", "2001:db8::/32", false},
+	}
+
+	for _, c := range cases {
+		overlap, err := CIDROverlaps(c.cidr1, c.cidr2)
+		if err != nil {
+			t.Errorf("overlaps %s %s fail: %v", c.cidr1, c.cidr2, err)
+			continue
+		}
+
+		if overlap != c.overlap {
+			t.Errorf("overlaps %s %s got %v, expect %v", c.cidr1, c.cidr2, overlap, c.overlap)
+		}
+	}
+}
+
+func TestCIDROverlapsInvalid(t *testing.T) {
+	_, err := CIDROverlaps("10.0.0.0/33", "10.0.0.0/8")
+	if err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+
+	_, err = CIDROverlaps("10.0.0.0/8", "abc")
+	if err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+}
@@ -0,0 +1,274 @@
+// pki implements certificates management
+// for controller and edges:
+//  1. ca generation
+//  2. server/edge certificate issue
+//  3. tls config for controller and edge
+// edge certificate binds edge identity to certificate:
+// CommonName is edge name, Organization is namespace.
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	caValidity   = time.Hour * 24 * 365 * 10
+	certValidity = time.Hour * 24 * 365 * 2
+)
+
+// GenerateCA creates a self signed ca
+// returns pem encoded certificate and key
+func GenerateCA(cn string) ([]byte, []byte, error) {
+	tmpl, err := template(cn, caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encode(der, key)
+}
+
+// IssueServerCert issues controller certificate for hosts
+// hosts can be ip addresses or dns names
+func IssueServerCert(caCertPEM, caKeyPEM []byte, hosts []string) ([]byte, []byte, error) {
+	if len(hosts) == 0 {
+		return nil, nil, fmt.Errorf("empty hosts")
+	}
+
+	tmpl, err := template(hosts[0], certValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	return issue(caCertPEM, caKeyPEM, tmpl)
+}
+
+// IssueEdgeCert issues edge client certificate
+// bound to namespace and edge name
+func IssueEdgeCert(caCertPEM, caKeyPEM []byte, namespace, name string) ([]byte, []byte, error) {
+	tmpl, err := template(name, certValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.Subject.Organization = []string{namespace}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return issue(caCertPEM, caKeyPEM, tmpl)
+}
+
+// VerifyEdgeCert checks certificate identity
+// matches the edge registering
+func VerifyEdgeCert(cert *x509.Certificate, namespace, name string) error {
+	if cert.Subject.CommonName != name {
+		return fmt.Errorf("certificate is issued for edge %s, not %s",
+			cert.Subject.CommonName, name)
+	}
+
+	for _, o := range cert.Subject.Organization {
+		if o == namespace {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("certificate is issued for namespace %v, not %s",
+		cert.Subject.Organization, namespace)
+}
+
+// Pin returns hex encoded sha256 of certificate public key
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// PinFromPEM returns pin of pem encoded certificate
+func PinFromPEM(certPEM []byte) (string, error) {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return "", err
+	}
+	return Pin(cert), nil
+}
+
+// NewServerTLSConfig creates tls config for controller
+// clientCAFile is optional, if it is set, edges must present
+// certificate issued by it
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(clientCAFile) > 0 {
+		pool, err := loadPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// NewClientTLSConfig creates tls config for edge
+// caFile: verify controller certificate chain, system pool if empty
+// pin: controller certificate public key pin, optional
+// certFile/keyFile: edge certificate, optional
+func NewClientTLSConfig(serverName, caFile, pin, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(caFile) > 0 {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(pin) > 0 {
+		pin = strings.ToLower(pin)
+		// pinned certificate is trusted without chain verification
+		// if no ca is provided, eg: self signed controller
+		cfg.InsecureSkipVerify = len(caFile) == 0
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no controller certificate")
+			}
+
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+
+			if Pin(cert) != pin {
+				return fmt.Errorf("controller certificate pin mismatch")
+			}
+			return nil
+		}
+	}
+
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+func template(cn string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func issue(caCertPEM, caKeyPEM []byte, tmpl *x509.Certificate) ([]byte, []byte, error) {
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encode(der, key)
+}
+
+func encode(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+func parseCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid pem certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func loadPool(caFile string) (*x509.CertPool, error) {
+	cnt, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(cnt) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
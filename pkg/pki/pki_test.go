@@ -0,0 +1,256 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert, key []byte
+}
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	cert, key, err := GenerateCA(cn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIssueEdgeCert(t *testing.T) {
+	ca := newTestCA(t, "cframe ca")
+	certPEM, _, err := IssueEdgeCert(ca.cert, ca.key, "default", "edge1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = VerifyEdgeCert(cert, "default", "edge1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if VerifyEdgeCert(cert, "default", "edge2") == nil {
+		t.Fatal("certificate of edge1 accepted for edge2")
+	}
+
+	if VerifyEdgeCert(cert, "another", "edge1") == nil {
+		t.Fatal("certificate of namespace default accepted for another")
+	}
+
+	caCert, err := parseCert(ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatalf("verify edge certificate fail: %v", err)
+	}
+}
+
+func TestPinFromPEM(t *testing.T) {
+	ca := newTestCA(t, "cframe ca")
+	pin, err := PinFromPEM(ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	another, err := PinFromPEM(newTestCA(t, "cframe ca").cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pin) != 64 || pin == another {
+		t.Fatalf("pin %s of another key %s", pin, another)
+	}
+
+	_, err = PinFromPEM([]byte("not a certificate"))
+	if err == nil {
+		t.Fatal("pin of invalid pem")
+	}
+}
+
+// testTLS is controller tls of ca with edge certificates required
+type testTLS struct {
+	ca       *testCA
+	caFile   string
+	server   []byte
+	certFile string
+	keyFile  string
+}
+
+func newTestTLS(t *testing.T) *testTLS {
+	ca := newTestCA(t, "cframe ca")
+	cert, key, err := IssueServerCert(ca.cert, ca.key, []string{"controller.local", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testTLS{
+		ca:       ca,
+		caFile:   writeTestFile(t, "ca.crt", ca.cert),
+		server:   cert,
+		certFile: writeTestFile(t, "server.crt", cert),
+		keyFile:  writeTestFile(t, "server.key", key),
+	}
+}
+
+// handshake runs tls handshake of edge with controller,
+// returns error of edge and controller
+func (tt *testTLS) handshake(t *testing.T, pin string, edgeCert, edgeKey []byte) (error, error) {
+	server, err := NewServerTLSConfig(tt.certFile, tt.keyFile, tt.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var certFile, keyFile string
+	if edgeCert != nil {
+		certFile = writeTestFile(t, "edge.crt", edgeCert)
+		keyFile = writeTestFile(t, "edge.key", edgeKey)
+	}
+
+	caFile := tt.caFile
+	if len(pin) > 0 {
+		caFile = ""
+	}
+	client, err := NewClientTLSConfig("controller.local", caFile, pin, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	done := make(chan error)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+
+		// client certificate of tls 1.3 is verified after handshake
+		// of edge, edge reads one byte to get the result
+		sconn := tls.Server(conn, server)
+		err = sconn.Handshake()
+		if err == nil {
+			_, err = sconn.Write([]byte{0})
+		}
+		done <- err
+	}()
+
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if err != nil {
+		return err, <-done
+	}
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 1))
+	return err, <-done
+}
+
+func TestTLSEdgeCert(t *testing.T) {
+	tt := newTestTLS(t)
+	cert, key, err := IssueEdgeCert(tt.ca.cert, tt.ca.key, "default", "edge1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errEdge, errController := tt.handshake(t, "", cert, key)
+	if errEdge != nil || errController != nil {
+		t.Fatalf("handshake fail: %v, %v", errEdge, errController)
+	}
+}
+
+func TestTLSEdgeCertRejected(t *testing.T) {
+	tt := newTestTLS(t)
+
+	another := newTestCA(t, "cframe ca")
+	wrongCA, wrongCAKey, err := IssueEdgeCert(another.cert, another.key, "default", "edge1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := template("edge1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.NotBefore = time.Now().Add(-time.Hour * 2)
+	tmpl.NotAfter = time.Now().Add(-time.Hour)
+	tmpl.Subject.Organization = []string{"default"}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	expired, expiredKey, err := issue(tt.ca.cert, tt.ca.key, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string][2][]byte{
+		"wrong ca":       {wrongCA, wrongCAKey},
+		"expired":        {expired, expiredKey},
+		"no certificate": {nil, nil},
+	}
+
+	for name, c := range cases {
+		_, errController := tt.handshake(t, "", c[0], c[1])
+		if errController == nil {
+			t.Errorf("edge certificate of %s accepted", name)
+		}
+	}
+}
+
+func TestTLSPin(t *testing.T) {
+	tt := newTestTLS(t)
+	cert, key, err := IssueEdgeCert(tt.ca.cert, tt.ca.key, "default", "edge1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pin, err := PinFromPEM(tt.server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pinned controller is trusted without ca
+	errEdge, errController := tt.handshake(t, pin, cert, key)
+	if errEdge != nil || errController != nil {
+		t.Fatalf("handshake with pin fail: %v, %v", errEdge, errController)
+	}
+
+	another, err := PinFromPEM(tt.ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errEdge, _ = tt.handshake(t, another, cert, key)
+	if errEdge == nil {
+		t.Fatal("controller certificate of pin mismatch accepted")
+	}
+}
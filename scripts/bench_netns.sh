@@ -0,0 +1,90 @@
+#!/bin/bash
+# throughput benchmark of edge data path on loopback netns
+#
+#   ns cfa(edge a, 192.168.10.1) <-veth-> root(controller) <-veth-> ns cfb(edge b, 192.168.20.1)
+#
+# tcp traffic from cfa to 192.168.20.1 goes through both edges.
+# requires root, iperf3 and etcd listening on 127.0.0.1:2379
+#
+# usage: QUEUES=4 PARALLEL=4 DURATION=10 TRANSPORT=udp ./scripts/bench_netns.sh
+
+set -e
+
+QUEUES=${QUEUES:-4}
+PARALLEL=${PARALLEL:-$QUEUES}
+DURATION=${DURATION:-10}
+TRANSPORT=${TRANSPORT:-udp}
+NS=${NS:-bench$$}
+DIST=$(mktemp -d)
+
+cd "$(dirname "$0")/.."
+
+go build -o $DIST/controller ./controller
+go build -o $DIST/edge ./edge
+go build -o $DIST/cfctl ./cfctl
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null || true
+    wait 2>/dev/null || true
+    for i in a b; do
+        ip link del cf$i-0 2>/dev/null || true
+        ip netns del cf$i 2>/dev/null || true
+    done
+    $DIST/cfctl ns del --name $NS --force >/dev/null 2>&1 || true
+    rm -rf $DIST
+}
+trap cleanup EXIT
+
+# netns connected to root by veth
+for i in a b; do
+    n=1
+    [ $i = b ] && n=2
+    ip netns add cf$i
+    ip link add cf$i-0 type veth peer name cf$i-1
+    ip link set cf$i-1 netns cf$i
+    ip addr add 10.99.$n.1/24 dev cf$i-0
+    ip link set cf$i-0 up
+    ip netns exec cf$i ip addr add 10.99.$n.2/24 dev cf$i-1
+    ip netns exec cf$i ip link set cf$i-1 up
+    ip netns exec cf$i ip link set lo up
+    ip netns exec cf$i ip route add default via 10.99.$n.1
+done
+sysctl -qw net.ipv4.ip_forward=1
+
+cat > $DIST/controller.toml <<EOF
+listen_addr=":58422"
+etcd = ["127.0.0.1:2379"]
+
+[log]
+level = "error"
+path = "$DIST/controller.log"
+days = 1
+EOF
+
+secret=$($DIST/cfctl ns add --name $NS --transport $TRANSPORT | awk '{print $5}')
+$DIST/cfctl edge add --ns $NS --name a --listener 10.99.1.2:58423 --cidr 192.168.10.0/24
+$DIST/cfctl edge add --ns $NS --name b --listener 10.99.2.2:58423 --cidr 192.168.20.0/24
+
+$DIST/controller -c $DIST/controller.toml &
+sleep 1
+
+for i in a b; do
+    n=1
+    [ $i = b ] && n=2
+    (cd $DIST && exec ip netns exec cf$i env \
+        log_level=error \
+        controllers=10.99.$n.1:58422 \
+        namespace=$NS \
+        secret=$secret \
+        name=$i \
+        listen_addr=10.99.$n.2:58423 \
+        tun_address=192.168.${n}0.1/24 \
+        tun_queues=$QUEUES \
+        status_sock=$DIST/edge_$i.sock \
+        $DIST/edge) &
+done
+sleep 3
+
+ip netns exec cfb iperf3 -s -1 -B 192.168.20.1 >/dev/null &
+sleep 1
+ip netns exec cfa iperf3 -c 192.168.20.1 -B 192.168.10.1 -P $PARALLEL -t $DURATION